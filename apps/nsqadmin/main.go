@@ -27,28 +27,46 @@ var (
 	verbose   = flagSet.Bool("verbose", false, "deprecated in favor of log-level")
 
 	httpAddress = flagSet.String("http-address", "0.0.0.0:4171", "<addr>:<port> to listen on for HTTP clients")
+	tlsCert     = flagSet.String("tls-cert", "", "path to certificate file to serve HTTPS on --http-address (plaintext requests are redirected)")
+	tlsKey      = flagSet.String("tls-key", "", "path to key file for --tls-cert")
 
 	graphiteURL   = flagSet.String("graphite-url", "", "graphite HTTP address")
 	proxyGraphite = flagSet.Bool("proxy-graphite", false, "proxy HTTP requests to graphite")
 
+	graphiteCacheTTL  = flagSet.Duration("graphite-cache-ttl", 0, "duration of time proxied graphite responses are cached (0 disables caching)")
+	graphiteCacheSize = flagSet.Int("graphite-cache-size", 1000, "maximum number of proxied graphite responses to cache")
+
+	graphiteTLSRootCAFile = flagSet.String("graphite-tls-root-ca-file", "", "path to CA file for requests to graphite (defaults to --http-client-tls-root-ca-file)")
+	graphiteTLSCert       = flagSet.String("graphite-tls-cert", "", "path to certificate file for requests to graphite")
+	graphiteTLSKey        = flagSet.String("graphite-tls-key", "", "path to key file for requests to graphite")
+	graphiteUsername      = flagSet.String("graphite-username", "", "basic auth username for requests to graphite")
+	graphitePassword      = flagSet.String("graphite-password", "", "basic auth password for requests to graphite")
+
 	statsdCounterFormat = flagSet.String("statsd-counter-format", "stats.counters.%s.count", "The counter stats key formatting applied by the implementation of statsd. If no formatting is desired, set this to an empty string.")
 	statsdGaugeFormat   = flagSet.String("statsd-gauge-format", "stats.gauges.%s", "The gauge stats key formatting applied by the implementation of statsd. If no formatting is desired, set this to an empty string.")
 	statsdPrefix        = flagSet.String("statsd-prefix", "nsq.%s", "prefix used for keys sent to statsd (%s for host replacement, must match nsqd)")
 	statsdInterval      = flagSet.Duration("statsd-interval", 60*time.Second, "time interval nsqd is configured to push to statsd (must match nsqd)")
 
 	notificationHTTPEndpoint = flagSet.String("notification-http-endpoint", "", "HTTP endpoint (fully qualified) to which POST notifications of admin actions will be sent")
+	adminActionLogSize       = flagSet.Int("admin-action-log-size", 100, "number of recent admin actions kept in memory for /admin_actions (0 disables)")
 
 	httpConnectTimeout = flagSet.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
 	httpRequestTimeout = flagSet.Duration("http-client-request-timeout", 5*time.Second, "timeout for HTTP request")
+	httpMaxIdleConns   = flagSet.Int("http-client-max-idle-conns", 100, "maximum number of idle (keep-alive) connections kept open by the HTTP client (0 for no limit)")
+	httpIdleTimeout    = flagSet.Duration("http-client-idle-conn-timeout", 90*time.Second, "how long an idle (keep-alive) HTTP client connection is kept open")
+	dnsCacheTTL        = flagSet.Duration("dns-cache-ttl", 0, "how long resolved addresses of nsqlookupd/nsqd hosts are reused for HTTP client connections (0 disables)")
 
 	httpClientTLSInsecureSkipVerify = flagSet.Bool("http-client-tls-insecure-skip-verify", false, "configure the HTTP client to skip verification of TLS certificates")
 	httpClientTLSRootCAFile         = flagSet.String("http-client-tls-root-ca-file", "", "path to CA file for the HTTP client")
 	httpClientTLSCert               = flagSet.String("http-client-tls-cert", "", "path to certificate file for the HTTP client")
 	httpClientTLSKey                = flagSet.String("http-client-tls-key", "", "path to key file for the HTTP client")
 
-	allowConfigFromCIDR = flagSet.String("allow-config-from-cidr", "127.0.0.1/8", "A CIDR from which to allow HTTP requests to the /config endpoint")
+	allowConfigFromCIDR = flagSet.String("allow-config-from-cidr", "127.0.0.1/8", "A CIDR from which to allow HTTP requests to the /config and /admin_actions endpoints")
 	aclHttpHeader       = flagSet.String("acl-http-header", "X-Forwarded-User", "HTTP header to check for authenticated admin users")
 
+	contentSecurityPolicy = flagSet.String("content-security-policy", nsqadmin.DefaultContentSecurityPolicy, "Content-Security-Policy header set on responses (empty disables)")
+	xFrameOptions         = flagSet.String("x-frame-options", "DENY", "X-Frame-Options header set on responses, e.g. SAMEORIGIN to allow framing nsqadmin from its own origin (empty disables)")
+
 	adminUsers              = app.StringArray{}
 	nsqlookupdHTTPAddresses = app.StringArray{}
 	nsqdHTTPAddresses       = app.StringArray{}
@@ -87,9 +105,15 @@ func main() {
 	opts := nsqadmin.NewOptions()
 	// 合并命令行参数，配置文件，默认参数等配置信息到opts中
 	options.Resolve(opts, flagSet, cfg)
-	nsqadmin := nsqadmin.New(opts)
+	nsqadmin, err := nsqadmin.New(opts)
+	if err != nil {
+		log.Fatalf("ERROR: failed to instantiate nsqadmin - %s", err)
+	}
 
-	nsqadmin.Main()
+	err = nsqadmin.Main()
+	if err != nil {
+		log.Fatalf("ERROR: failed to start nsqadmin - %s", err)
+	}
 	<-exitChan
 	nsqadmin.Exit()
 }
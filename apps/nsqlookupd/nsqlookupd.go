@@ -23,14 +23,58 @@ func nsqlookupdFlagSet(opts *nsqlookupd.Options) *flag.FlagSet {
 
 	flagSet.String("log-level", "info", "set log verbosity: debug, info, warn, error, or fatal")
 	flagSet.String("log-prefix", "[nsqlookupd] ", "log message prefix")
+	flagSet.String("log-format", "text", "format of log lines: text or json (one object per line with ts, level, component and msg)")
+	flagSet.Duration("log-repeat-window", opts.LogRepeatWindow, "log identical protocol errors from one IP within this window once, followed by a \"(repeated N times)\" line (0 disables)")
 	flagSet.Bool("verbose", false, "deprecated in favor of log-level")
+	flagSet.String("registration-log-level", opts.RegistrationLogLevel, "level registration changes by TCP clients are logged at: debug, info, warn, error, or fatal")
 
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address of this lookupd node, (default to the OS hostname)")
-
+	flagSet.Bool("proxy-protocol", opts.ProxyProtocol, "expect a PROXY protocol (v1 or v2) header on TCP connections and use the client address it carries")
+	flagSet.String("proxy-protocol-trusted-cidr", opts.ProxyProtocolTrustedCIDR, "with --proxy-protocol, only expect a PROXY header on TCP connections from this CIDR (the load balancers)")
+	flagSet.String("allow-config-from-cidr", opts.AllowConfigFromCIDR, "only allow HTTP requests that create, delete or change registrations from this CIDR (empty allows all)")
+	flagSet.String("broadcast-address-check", opts.BroadcastAddressCheck, "reject (or replace with the client IP when set to 'replace') loopback, unspecified and link-local broadcast addresses on IDENTIFY")
+	flagSet.String("broadcast-address-allow-cidr", opts.BroadcastAddressAllowCIDR, "with --broadcast-address-check, accept broadcast addresses in this CIDR")
+	flagSet.String("broadcast-address-deny-cidr", opts.BroadcastAddressDenyCIDR, "with --broadcast-address-check, also reject broadcast addresses in this CIDR")
+	flagSet.Bool("read-only", opts.ReadOnly, "reject REGISTER/UNREGISTER and HTTP requests that change registrations (can be toggled with POST /read_only)")
+	flagSet.Bool("require-explicit-topics", opts.RequireExplicitTopics, "reject REGISTER for topics that have not been created with /topic/create (except #ephemeral topics)")
+	flagSet.Bool("case-insensitive-topics", opts.CaseInsensitiveTopics, "lowercase topic names so registrations differing only in case are merged")
+	flagSet.Bool("case-insensitive-channels", opts.CaseInsensitiveChannels, "lowercase channel names so registrations differing only in case are merged")
+	flagSet.Bool("db-lock-metrics", opts.DBLockMetrics, "record a histogram of the time registration changes wait for the DB lock (reported by /stats)")
+
+	flagSet.Duration("tcp-keepalive-period", opts.TCPKeepAlivePeriod, "TCP keepalive period for accepted connections (0 disables keepalive)")
+	flagSet.Duration("tcp-write-timeout", opts.TCPWriteTimeout, "maximum duration for writing a response to a TCP client before closing its connection (0 disables)")
+	flagSet.Duration("shutdown-timeout", opts.ShutdownTimeout, "duration of time to wait for connected clients to finish on exit before closing them")
+	flagSet.Int("max-line-length", opts.MaxLineLength, "maximum length in bytes of a single TCP protocol command line")
+	flagSet.Int("max-body-size", opts.MaxBodySize, "maximum size in bytes of an IDENTIFY or MREGISTER body")
+	flagSet.Int("max-connections-per-ip", opts.MaxConnectionsPerIP, "maximum number of TCP connections from a single IP (0 for no limit)")
+	flagSet.Float64("command-rate-limit", opts.CommandRateLimit, "maximum REGISTER/UNREGISTER commands per second per connection (0 disables)")
+	flagSet.Int("command-rate-burst", opts.CommandRateBurst, "number of REGISTER/UNREGISTER commands allowed in a burst above --command-rate-limit")
+
+	flagSet.Int("max-topics", opts.MaxTopics, "maximum number of topics, registering or creating more is rejected (0 for no limit)")
+	flagSet.Int("max-channels-per-topic", opts.MaxChannelsPerTopic, "maximum number of channels per topic, registering or creating more is rejected (0 for no limit)")
 	flagSet.Duration("inactive-producer-timeout", opts.InactiveProducerTimeout, "duration of time a producer will remain in the active list since its last ping")
 	flagSet.Duration("tombstone-lifetime", opts.TombstoneLifetime, "duration of time a producer will remain tombstoned if registration remains")
+	flagSet.Duration("producer-expiry", opts.ProducerExpiry, "duration of time after its last ping that a producer is removed from the DB, must be greater than --inactive-producer-timeout (0 disables)")
+	flagSet.Duration("producer-expiry-interval", opts.ProducerExpiryInterval, "how often to check for producers past --producer-expiry")
+	flagSet.Duration("producer-tombstone-after", opts.ProducerTombstoneAfter, "duration of time after its last ping that a topic producer is tombstoned (kept, but not returned by /lookup), must be less than --producer-expiry (0 disables)")
+
+	flagSet.Duration("nodes-cache-ttl", opts.NodesCacheTTL, "duration of time a /nodes response is cached (0 disables caching)")
+	flagSet.Duration("consistency-check-interval", opts.ConsistencyCheckInterval, "how often to look for channels registered without their topic and log them (0 disables)")
+	flagSet.Bool("consistency-check-repair", opts.ConsistencyCheckRepair, "add the missing topic registration of channels found by --consistency-check-interval")
+	flagSet.Int("lookup-cache-size", opts.LookupCacheSize, "maximum number of topics whose /lookup registrations are cached, entries are refreshed when the topic's registrations change (0 disables caching)")
+	flagSet.String("topic-webhook-url", opts.TopicWebhookURL, "URL to POST to when a topic gets its first producer (JSON with event, topic and timestamp)")
+	flagSet.Bool("topic-webhook-on-empty", opts.TopicWebhookOnEmpty, "also POST to --topic-webhook-url when a topic loses its last producer")
+
+	flagSet.Duration("http-read-timeout", opts.HTTPReadTimeout, "maximum duration for reading an entire HTTP request (0 disables)")
+	flagSet.Duration("http-write-timeout", opts.HTTPWriteTimeout, "maximum duration before timing out writes of an HTTP response (0 disables)")
+	flagSet.Duration("http-idle-timeout", opts.HTTPIdleTimeout, "maximum duration to wait for the next request on a keep-alive HTTP connection (0 disables, requires Go 1.8)")
+	flagSet.Int("http-max-header-bytes", opts.HTTPMaxHeaderBytes, "maximum size in bytes of HTTP request headers (0 uses the net/http default of 1MB)")
+	flagSet.Int64("http-max-body-size", opts.HTTPMaxBodySize, "maximum size in bytes of an HTTP request body, larger requests get a 413 (0 disables)")
+	flagSet.Int("http-log-min-status", opts.HTTPLogMinStatus, "only log HTTP requests with a response status >= this (e.g. 300 to skip successful requests)")
+	flagSet.Float64("http-log-sample-rate", opts.HTTPLogSampleRate, "fraction (0, 1] of HTTP requests to log (0 logs all)")
+	flagSet.String("http-log-format", opts.HTTPLogFormat, "format of HTTP request log lines: text or json")
 
 	return flagSet
 }
@@ -75,9 +119,24 @@ func (p *program) Start() error {
 	}
 
 	options.Resolve(opts, flagSet, cfg)
-	daemon := nsqlookupd.New(opts)
 
-	daemon.Main()
+	// sockets passed by systemd take precedence over --tcp-address/--http-address
+	listeners, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("ERROR: failed to use activated sockets - %s", err)
+	}
+	opts.TCPListener = listeners["tcp"]
+	opts.HTTPListener = listeners["http"]
+
+	daemon, err := nsqlookupd.New(opts)
+	if err != nil {
+		log.Fatalf("ERROR: failed to instantiate nsqlookupd - %s", err)
+	}
+
+	err = daemon.Main()
+	if err != nil {
+		log.Fatalf("ERROR: failed to start nsqlookupd - %s", err)
+	}
 	p.nsqlookupd = daemon
 	return nil
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// file descriptors passed by systemd start at 3 (see sd_listen_fds(3))
+const listenFDsStart = 3
+
+// activatedFDs maps the names of the file descriptors passed via socket
+// activation to their numbers. Without LISTEN_FDNAMES the descriptors are
+// expected in "tcp", "http" order.
+func activatedFDs(pid int, listenPID string, listenFDs string, fdNames string) (map[string]int, error) {
+	fds := make(map[string]int)
+	if listenPID == "" || listenFDs == "" {
+		return fds, nil
+	}
+	if p, err := strconv.Atoi(listenPID); err != nil || p != pid {
+		// not meant for this process
+		return fds, nil
+	}
+
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", listenFDs)
+	}
+
+	names := []string{"tcp", "http"}
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	if n > len(names) {
+		return nil, fmt.Errorf("LISTEN_FDS %d exceeds named sockets %v", n, names)
+	}
+
+	for i := 0; i < n; i++ {
+		name := names[i]
+		if name != "tcp" && name != "http" {
+			return nil, fmt.Errorf("unknown socket name %q", name)
+		}
+		if _, ok := fds[name]; ok {
+			return nil, fmt.Errorf("duplicate socket name %q", name)
+		}
+		fds[name] = listenFDsStart + i
+	}
+	return fds, nil
+}
+
+// activatedListeners returns the "tcp" and/or "http" listeners handed to
+// this process by systemd socket activation, if any
+func activatedListeners() (map[string]net.Listener, error) {
+	fds, err := activatedFDs(os.Getpid(),
+		os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make(map[string]net.Listener)
+	for name, fd := range fds {
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fd %d (%s) - %s", fd, name, err)
+		}
+		listeners[name] = l
+	}
+
+	// don't pass them on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return listeners, nil
+}
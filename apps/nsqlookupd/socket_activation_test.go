@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/nsqio/nsq/nsqlookupd"
+)
+
+func TestActivatedFDs(t *testing.T) {
+	fds, err := activatedFDs(100, "", "", "")
+	if err != nil || len(fds) != 0 {
+		t.Fatalf("expected no fds, got %v %v", fds, err)
+	}
+
+	fds, err = activatedFDs(100, "101", "2", "")
+	if err != nil || len(fds) != 0 {
+		t.Fatalf("expected no fds for another pid, got %v %v", fds, err)
+	}
+
+	fds, err = activatedFDs(100, "100", "2", "")
+	if err != nil || fds["tcp"] != 3 || fds["http"] != 4 {
+		t.Fatalf("unexpected fds %v %v", fds, err)
+	}
+
+	fds, err = activatedFDs(100, "100", "1", "http")
+	if err != nil || len(fds) != 1 || fds["http"] != 3 {
+		t.Fatalf("unexpected fds %v %v", fds, err)
+	}
+
+	_, err = activatedFDs(100, "100", "3", "")
+	if err == nil {
+		t.Fatalf("expected error for too many fds")
+	}
+
+	_, err = activatedFDs(100, "100", "2", "tcp:tcp")
+	if err == nil {
+		t.Fatalf("expected error for duplicate names")
+	}
+}
+
+func TestFileListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	// the same path an activated socket goes through
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	l.Close()
+	httpListener, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	opts := nsqlookupd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPListener = httpListener
+	daemon, err := nsqlookupd.New(opts)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = daemon.Main()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer daemon.Exit()
+
+	resp, err := http.Get("http://" + daemon.RealHTTPAddr().String() + "/ping")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "OK" {
+		t.Fatalf("unexpected response %q", body)
+	}
+}
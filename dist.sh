@@ -20,7 +20,9 @@ rm -rf   $DIR/dist/docker
 mkdir -p $DIR/dist/docker
 dep ensure
 
-GOFLAGS='-ldflags="-s -w"'
+commit=$(git rev-parse --short HEAD)
+builddate=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+GOFLAGS="-ldflags=\"-s -w -X github.com/nsqio/nsq/internal/version.Commit=$commit -X github.com/nsqio/nsq/internal/version.BuildDate=$builddate\""
 arch=$(go env GOARCH)
 version=$(awk '/const Binary/ {print $NF}' < $DIR/internal/version/binary.go | sed 's/"//g')
 goversion=$(go version | awk '{print $3}')
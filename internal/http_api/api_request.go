@@ -37,6 +37,12 @@ type Client struct {
 func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeout time.Duration) *Client {
 	transport := NewDeadlineTransport(connectTimeout, requestTimeout)
 	transport.TLSClientConfig = tlsConfig
+	return NewClientWithTransport(transport, requestTimeout)
+}
+
+// NewClientWithTransport returns a Client that sends its requests through
+// transport, so that several clients can share one pool of idle connections
+func NewClientWithTransport(transport http.RoundTripper, requestTimeout time.Duration) *Client {
 	return &Client{
 		c: &http.Client{
 			Transport: transport,
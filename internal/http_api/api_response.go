@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"time"
 
@@ -15,9 +16,14 @@ type Decorator func(APIHandler) APIHandler
 
 type APIHandler func(http.ResponseWriter, *http.Request, httprouter.Params) (interface{}, error)
 
+// Err is the error returned by an APIHandler. Text is the message; Key is
+// an optional machine readable error code which, when set, is included in
+// V1 responses alongside it. Use keyed fields, e.g. Err{Code: 400, Text: ...},
+// when there is no Key.
 type Err struct {
 	Code int
 	Text string
+	Key  string
 }
 
 func (e Err) Error() string {
@@ -37,8 +43,9 @@ func PlainText(f APIHandler) APIHandler {
 		code := 200
 		data, err := f(w, req, ps)
 		if err != nil {
-			code = err.(Err).Code
-			data = err.Error()
+			e, _ := asErr(err)
+			code = e.Code
+			data = e.Error()
 		}
 		switch d := data.(type) {
 		case string:
@@ -56,24 +63,119 @@ func PlainText(f APIHandler) APIHandler {
 
 // Version 1 的接口响应函数
 // 用于包装一层APIHandler， 执行被包裹的APIHandler, 对接口做相应的响应，
+// 请求带有 ?pretty=true 时，JSON 响应会被缩进，便于手工查看
+// 响应格式根据 Accept 头选择(JSON 或 msgpack)，默认 JSON
 func V1(f APIHandler) APIHandler {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		pretty := req.URL.Query().Get("pretty") == "true"
+		enc := negotiateEncoder(req)
 		data, err := f(w, req, ps)
 		if err != nil {
-			RespondV1(w, err.(Err).Code, err)
+			e, _ := asErr(err)
+			respondV1(w, e.Code, e, pretty, enc)
 			return nil, nil
 		}
-		RespondV1(w, 200, data)
+		respondV1(w, 200, data, pretty, enc)
 		return nil, nil
 	}
 }
 
+// Status is a response V1 writes with Code rather than 200, for the few
+// non 200 responses that carry data rather than an Err
+type Status struct {
+	Code int
+	Data interface{}
+}
+
+// StreamedArray is a response V1 writes as its elements are produced,
+// rather than marshalling all of it first, for large arrays. It is written
+// as {"<Key>":[...]}, or only the array when Key is empty. Next returns each
+// element in turn and false once there are no more. Pretty printed and
+// non JSON responses are collected and encoded whole.
+type StreamedArray struct {
+	Key  string
+	Next func() (interface{}, bool)
+}
+
+func (a *StreamedArray) collect() interface{} {
+	elements := []interface{}{}
+	for v, ok := a.Next(); ok; v, ok = a.Next() {
+		elements = append(elements, v)
+	}
+	if a.Key == "" {
+		return elements
+	}
+	return map[string]interface{}{a.Key: elements}
+}
+
+// writeTo writes the array one element at a time, once the status has been
+// sent an error can only truncate the response
+func (a *StreamedArray) writeTo(w io.Writer) error {
+	if a.Key != "" {
+		key, _ := json.Marshal(a.Key)
+		fmt.Fprintf(w, "{%s:", key)
+	}
+	io.WriteString(w, "[")
+	for i := 0; ; i++ {
+		v, ok := a.Next()
+		if !ok {
+			break
+		}
+		element, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		_, err = w.Write(element)
+		if err != nil {
+			return err
+		}
+	}
+	io.WriteString(w, "]")
+	if a.Key != "" {
+		io.WriteString(w, "}")
+	}
+	return nil
+}
+
 func RespondV1(w http.ResponseWriter, code int, data interface{}) {
+	respondV1(w, code, data, false, jsonEncoder{})
+}
+
+func marshalJSON(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+func respondV1(w http.ResponseWriter, code int, data interface{}, pretty bool, enc Encoder) {
 	var response []byte
 	var err error
-	var isJSON bool
+	var encoded bool
+
+	failed := code != 200
+	if s, ok := data.(Status); ok && !failed {
+		code, data = s.Code, s.Data
+	}
+
+	if a, ok := data.(*StreamedArray); ok && code == 200 {
+		if _, ok := enc.(jsonEncoder); ok && !pretty {
+			if b, ok := w.(*bufferedResponse); ok {
+				b.unbuffer()
+			}
+			w.Header().Set("Content-Type", enc.ContentType())
+			w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+			w.WriteHeader(code)
+			a.writeTo(w)
+			return
+		}
+		data = a.collect()
+	}
 
-	if code == 200 {
+	if !failed {
 		switch data.(type) {
 		case string:
 			response = []byte(data.(string))
@@ -82,22 +184,34 @@ func RespondV1(w http.ResponseWriter, code int, data interface{}) {
 		case nil:
 			response = []byte{}
 		default:
-			isJSON = true
-			response, err = json.Marshal(data)
+			encoded = true
+			response, err = enc.Encode(data, pretty)
 			if err != nil {
 				code = 500
 				data = err
+				failed = true
 			}
 		}
 	}
 
-	if code != 200 {
-		isJSON = true
-		response = []byte(fmt.Sprintf(`{"message":"%s"}`, data))
+	if failed {
+		encoded = true
+		if e, ok := data.(Err); ok && e.Key != "" {
+			response, _ = enc.Encode(struct {
+				Message string `json:"message"`
+				Error   string `json:"error"`
+			}{e.Text, e.Key}, pretty)
+		} else if _, ok := enc.(jsonEncoder); ok {
+			response = []byte(fmt.Sprintf(`{"message":"%s"}`, data))
+		} else {
+			response, _ = enc.Encode(struct {
+				Message string `json:"message"`
+			}{fmt.Sprintf("%s", data)}, pretty)
+		}
 	}
 
-	if isJSON {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if encoded {
+		w.Header().Set("Content-Type", enc.ContentType())
 	}
 	w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
 	w.WriteHeader(code)
@@ -124,18 +238,59 @@ func Decorate(f APIHandler, ds ...Decorator) httprouter.Handle {
 	}
 }
 
+// LogOptions controls which requests the Log decorator logs and how
+type LogOptions struct {
+	// only requests with a status >= MinStatus are logged
+	MinStatus int
+	// the fraction, in (0, 1], of requests that are logged (0 logs all)
+	SampleRate float64
+	// "text" (the default) or "json"
+	Format string
+}
+
 func Log(logf lg.AppLogFunc) Decorator {
+	return LogWithOptions(logf, LogOptions{})
+}
+
+func LogWithOptions(logf lg.AppLogFunc, opts LogOptions) Decorator {
 	return func(f APIHandler) APIHandler {
 		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			start := time.Now()
 			response, err := f(w, req, ps)
 			elapsed := time.Since(start)
 			status := 200
-			if e, ok := err.(Err); ok {
+			if err != nil {
+				e, _ := asErr(err)
 				status = e.Code
+			} else if s, ok := response.(Status); ok {
+				status = s.Code
+			}
+			if status < opts.MinStatus {
+				return response, err
+			}
+			if opts.SampleRate > 0 && opts.SampleRate < 1 && rand.Float64() >= opts.SampleRate {
+				return response, err
+			}
+			switch opts.Format {
+			case "json":
+				line, _ := json.Marshal(struct {
+					Status     int    `json:"status"`
+					Method     string `json:"method"`
+					Path       string `json:"path"`
+					RemoteAddr string `json:"remote_addr"`
+					Elapsed    string `json:"elapsed"`
+					Cause      string `json:"cause,omitempty"`
+				}{status, req.Method, req.URL.RequestURI(), req.RemoteAddr, elapsed.String(), causeString(err)})
+				logf(lg.INFO, "%s", line)
+			default:
+				if cause := causeString(err); cause != "" {
+					logf(lg.INFO, "%d %s %s (%s) %s - %s",
+						status, req.Method, req.URL.RequestURI(), req.RemoteAddr, elapsed, cause)
+					break
+				}
+				logf(lg.INFO, "%d %s %s (%s) %s",
+					status, req.Method, req.URL.RequestURI(), req.RemoteAddr, elapsed)
 			}
-			logf(lg.INFO, "%d %s %s (%s) %s",
-				status, req.Method, req.URL.RequestURI(), req.RemoteAddr, elapsed)
 			return response, err
 		}
 	}
@@ -146,7 +301,7 @@ func LogPanicHandler(logf lg.AppLogFunc) func(w http.ResponseWriter, req *http.R
 	return func(w http.ResponseWriter, req *http.Request, p interface{}) {
 		logf(lg.ERROR, "panic in HTTP handler - %s", p)
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-			return nil, Err{500, "INTERNAL_ERROR"}
+			return nil, ErrInternal
 		}, Log(logf), V1)(w, req, nil)
 	}
 }
@@ -158,7 +313,7 @@ func LogPanicHandler(logf lg.AppLogFunc) func(w http.ResponseWriter, req *http.R
 func LogNotFoundHandler(logf lg.AppLogFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-			return nil, Err{404, "NOT_FOUND"}
+			return nil, ErrNotFound
 		}, Log(logf), V1)(w, req, nil)
 	})
 }
@@ -167,7 +322,7 @@ func LogNotFoundHandler(logf lg.AppLogFunc) http.Handler {
 func LogMethodNotAllowedHandler(logf lg.AppLogFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-			return nil, Err{405, "METHOD_NOT_ALLOWED"}
+			return nil, ErrMethodNotAllowed
 		}, Log(logf), V1)(w, req, nil)
 	})
 }
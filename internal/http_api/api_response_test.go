@@ -0,0 +1,535 @@
+package http_api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestRespondV1Err(t *testing.T) {
+	w := httptest.NewRecorder()
+	RespondV1(w, 404, Err{Code: 404, Text: "NOT_FOUND"})
+	test.Equal(t, 404, w.Code)
+	test.Equal(t, `{"message":"NOT_FOUND"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	RespondV1(w, 404, Err{404, "topic not found", "TOPIC_NOT_FOUND"})
+	test.Equal(t, 404, w.Code)
+	test.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	var body struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	test.Nil(t, err)
+	test.Equal(t, "topic not found", body.Message)
+	test.Equal(t, "TOPIC_NOT_FOUND", body.Error)
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+		body string
+	}{
+		{ErrInvalidRequest, 400, `{"message":"INVALID_REQUEST","error":"INVALID_REQUEST"}`},
+		{ErrForbidden, 403, `{"message":"FORBIDDEN","error":"FORBIDDEN"}`},
+		{ErrNotFound, 404, `{"message":"NOT_FOUND"}`},
+		{ErrMethodNotAllowed, 405, `{"message":"METHOD_NOT_ALLOWED"}`},
+		{ErrBodyTooLarge, 413, `{"message":"BODY_TOO_LARGE","error":"BODY_TOO_LARGE"}`},
+		{ErrInternal, 500, `{"message":"INTERNAL_ERROR"}`},
+		{ErrMissingArg("topic"), 400, `{"message":"MISSING_ARG_TOPIC","error":"MISSING_ARG_TOPIC"}`},
+		{ErrMissingArg("new_topic"), 400, `{"message":"MISSING_ARG_NEW_TOPIC","error":"MISSING_ARG_NEW_TOPIC"}`},
+		{ErrInvalidArg("limit"), 400, `{"message":"INVALID_ARG_LIMIT","error":"INVALID_ARG_LIMIT"}`},
+		{ErrResourceNotFound("topic"), 404, `{"message":"TOPIC_NOT_FOUND","error":"TOPIC_NOT_FOUND"}`},
+		{ErrResourceExists("channel"), 409, `{"message":"CHANNEL_EXISTS","error":"CHANNEL_EXISTS"}`},
+		// the cause is only logged
+		{ErrInvalidRequest.WithCause(errors.New("bad query")), 400, `{"message":"INVALID_REQUEST","error":"INVALID_REQUEST"}`},
+		// errors that aren't an Err are internal errors
+		{errors.New("boom"), 500, `{"message":"INTERNAL_ERROR"}`},
+	}
+	for _, tt := range tests {
+		err := tt.err
+		h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			return nil, err
+		}, V1)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		h(w, req, nil)
+		test.Equal(t, tt.code, w.Code)
+		test.Equal(t, tt.body, w.Body.String())
+	}
+}
+
+func TestLogCause(t *testing.T) {
+	lines := testLogLines(LogOptions{}, 1, ErrInvalidRequest.WithCause(errors.New("bad query")))
+	test.Equal(t, 1, len(lines))
+	test.Equal(t, true, strings.HasPrefix(lines[0], "400 GET /lookup?topic=test"))
+	test.Equal(t, true, strings.HasSuffix(lines[0], " - bad query"))
+
+	lines = testLogLines(LogOptions{Format: "json"}, 1, ErrInvalidRequest.WithCause(errors.New("bad query")))
+	var entry struct {
+		Status int    `json:"status"`
+		Cause  string `json:"cause"`
+	}
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	test.Nil(t, err)
+	test.Equal(t, 400, entry.Status)
+	test.Equal(t, "bad query", entry.Cause)
+}
+
+func TestV1Pretty(t *testing.T) {
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return map[string]interface{}{"topics": []string{"a"}}, nil
+	}, V1)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/topics", nil)
+	h(w, req, nil)
+	test.Equal(t, `{"topics":["a"]}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/topics?pretty=true", nil)
+	h(w, req, nil)
+	test.Equal(t, "{\n  \"topics\": [\n    \"a\"\n  ]\n}", w.Body.String())
+}
+
+func streamedTopics(n int) *StreamedArray {
+	i := 0
+	return &StreamedArray{Key: "topics", Next: func() (interface{}, bool) {
+		if i >= n {
+			return nil, false
+		}
+		i++
+		return fmt.Sprintf("topic%d", i-1), true
+	}}
+}
+
+func TestV1StreamedArray(t *testing.T) {
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return streamedTopics(3), nil
+	}, V1)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/topics", nil)
+	h(w, req, nil)
+	test.Equal(t, 200, w.Code)
+	test.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	test.Equal(t, `{"topics":["topic0","topic1","topic2"]}`, w.Body.String())
+
+	// collected and encoded whole
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/topics?pretty=true", nil)
+	h(w, req, nil)
+	test.Equal(t, "{\n  \"topics\": [\n    \"topic0\",\n    \"topic1\",\n    \"topic2\"\n  ]\n}", w.Body.String())
+
+	w = httptest.NewRecorder()
+	h = Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return &StreamedArray{Next: func() (interface{}, bool) { return nil, false }}, nil
+	}, V1)
+	h(w, req, nil)
+	test.Equal(t, "[]", w.Body.String())
+}
+
+func TestV1Status(t *testing.T) {
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return Status{Code: 409, Data: map[string]interface{}{"created": false}}, nil
+	}, V1)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/topic/create", nil)
+	h(w, req, nil)
+	test.Equal(t, 409, w.Code)
+	test.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	test.Equal(t, `{"created":false}`, w.Body.String())
+}
+
+func TestETagStreamedArray(t *testing.T) {
+	w := httptest.NewRecorder()
+	written := 0
+	i := 0
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return &StreamedArray{Key: "topics", Next: func() (interface{}, bool) {
+			written = w.(*bufferedResponse).w.(*httptest.ResponseRecorder).Body.Len()
+			if i >= 3 {
+				return nil, false
+			}
+			i++
+			return fmt.Sprintf("topic%d", i-1), true
+		}}, nil
+	}, V1, ETag)
+
+	req, _ := http.NewRequest("GET", "/topics", nil)
+	h(w, req, nil)
+	test.Equal(t, 200, w.Code)
+	test.Equal(t, "", w.Header().Get("ETag"))
+	test.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	test.Equal(t, `{"topics":["topic0","topic1","topic2"]}`, w.Body.String())
+	// the earlier elements had reached the ResponseWriter before the last
+	test.Equal(t, len(`{"topics":["topic0","topic1","topic2"`), written)
+}
+
+// peakHeapWriter is a ResponseWriter that discards the body, sampling the
+// heap every so many writes
+type peakHeapWriter struct {
+	header http.Header
+	writes int
+	peak   uint64
+}
+
+func (p *peakHeapWriter) Header() http.Header { return p.header }
+func (p *peakHeapWriter) WriteHeader(int)     {}
+func (p *peakHeapWriter) Write(b []byte) (int, error) {
+	if p.writes%10000 == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > p.peak {
+			p.peak = m.HeapAlloc
+		}
+	}
+	p.writes++
+	return len(b), nil
+}
+
+func TestV1StreamedArrayLarge(t *testing.T) {
+	n := 1000000
+	peakHeap := func(f APIHandler) uint64 {
+		req, _ := http.NewRequest("GET", "/topics", nil)
+		pw := &peakHeapWriter{header: make(http.Header)}
+		runtime.GC()
+		Decorate(f, V1)(pw, req, nil)
+		return pw.peak
+	}
+
+	// the output is valid JSON
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/topics", nil)
+	Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return streamedTopics(n), nil
+	}, V1)(w, req, nil)
+	var doc struct {
+		Topics []string `json:"topics"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &doc)
+	test.Nil(t, err)
+	test.Equal(t, n, len(doc.Topics))
+	test.Equal(t, "topic999999", doc.Topics[n-1])
+	w, doc.Topics = nil, nil
+
+	streamed := peakHeap(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return streamedTopics(n), nil
+	})
+	buffered := peakHeap(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		topics := make([]string, n)
+		for i := range topics {
+			topics[i] = fmt.Sprintf("topic%d", i)
+		}
+		return map[string]interface{}{"topics": topics}, nil
+	})
+	t.Logf("peak heap streamed %d buffered %d", streamed, buffered)
+	test.Equal(t, true, streamed < buffered/2)
+}
+
+func testLogLines(opts LogOptions, n int, err error) []string {
+	var lines []string
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(f, args...))
+	}
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return nil, err
+	}, LogWithOptions(logf, opts))
+	for i := 0; i < n; i++ {
+		req, _ := http.NewRequest("GET", "/lookup?topic=test", nil)
+		h(httptest.NewRecorder(), req, nil)
+	}
+	return lines
+}
+
+func TestLogMinStatus(t *testing.T) {
+	lines := testLogLines(LogOptions{MinStatus: 300}, 10, nil)
+	test.Equal(t, 0, len(lines))
+
+	lines = testLogLines(LogOptions{MinStatus: 300}, 10, Err{Code: 404, Text: "NOT_FOUND"})
+	test.Equal(t, 10, len(lines))
+	test.Equal(t, true, strings.HasPrefix(lines[0], "404 GET /lookup?topic=test"))
+}
+
+func TestLogSampling(t *testing.T) {
+	lines := testLogLines(LogOptions{}, 1000, nil)
+	test.Equal(t, 1000, len(lines))
+
+	lines = testLogLines(LogOptions{SampleRate: 0.1}, 1000, nil)
+	test.Equal(t, true, len(lines) > 20)
+	test.Equal(t, true, len(lines) < 300)
+}
+
+func TestLogJSON(t *testing.T) {
+	lines := testLogLines(LogOptions{Format: "json"}, 1, Err{Code: 404, Text: "NOT_FOUND"})
+	test.Equal(t, 1, len(lines))
+
+	var entry struct {
+		Status  int    `json:"status"`
+		Method  string `json:"method"`
+		Path    string `json:"path"`
+		Elapsed string `json:"elapsed"`
+	}
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	test.Nil(t, err)
+	test.Equal(t, 404, entry.Status)
+	test.Equal(t, "GET", entry.Method)
+	test.Equal(t, "/lookup?topic=test", entry.Path)
+	test.NotEqual(t, "", entry.Elapsed)
+}
+
+func TestETag(t *testing.T) {
+	topics := []string{"a"}
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return map[string]interface{}{"topics": topics}, nil
+	}, V1, ETag)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/topics", nil)
+	h(w, req, nil)
+	test.Equal(t, 200, w.Code)
+	test.Equal(t, `{"topics":["a"]}`, w.Body.String())
+	test.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	test.Equal(t, true, strings.HasPrefix(etag, `W/"`))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/topics", nil)
+	req.Header.Set("If-None-Match", etag)
+	h(w, req, nil)
+	test.Equal(t, 304, w.Code)
+	test.Equal(t, 0, w.Body.Len())
+	test.Equal(t, etag, w.Header().Get("ETag"))
+
+	// a changed body gets a new ETag
+	topics = append(topics, "b")
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/topics", nil)
+	req.Header.Set("If-None-Match", etag)
+	h(w, req, nil)
+	test.Equal(t, 200, w.Code)
+	test.Equal(t, `{"topics":["a","b"]}`, w.Body.String())
+	test.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestETagError(t *testing.T) {
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return nil, Err{404, "topic not found", "TOPIC_NOT_FOUND"}
+	}, V1, ETag)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/lookup", nil)
+	req.Header.Set("If-None-Match", "*")
+	h(w, req, nil)
+	test.Equal(t, 404, w.Code)
+	test.Equal(t, "", w.Header().Get("ETag"))
+}
+
+// decodeMsgpack decodes the subset of MessagePack written by msgpackEncoder
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(size int) uint64 {
+		buf := make([]byte, 8)
+		r.Read(buf[8-size:])
+		return binary.BigEndian.Uint64(buf)
+	}
+	var n int
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b == 0xc0:
+		return nil, nil
+	case b == 0xc2, b == 0xc3:
+		return b == 0xc3, nil
+	case b == 0xd3:
+		return int64(readN(8)), nil
+	case b == 0xcb:
+		return math.Float64frombits(readN(8)), nil
+	case b&0xe0 == 0xa0, b == 0xd9, b == 0xda, b == 0xdb:
+		switch b {
+		case 0xd9:
+			n = int(readN(1))
+		case 0xda:
+			n = int(readN(2))
+		case 0xdb:
+			n = int(readN(4))
+		default:
+			n = int(b & 0x1f)
+		}
+		s := make([]byte, n)
+		r.Read(s)
+		return string(s), nil
+	case b&0xf0 == 0x90, b == 0xdc, b == 0xdd:
+		switch b {
+		case 0xdc:
+			n = int(readN(2))
+		case 0xdd:
+			n = int(readN(4))
+		default:
+			n = int(b & 0x0f)
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case b&0xf0 == 0x80, b == 0xde, b == 0xdf:
+		switch b {
+		case 0xde:
+			n = int(readN(2))
+		case 0xdf:
+			n = int(readN(4))
+		default:
+			n = int(b & 0x0f)
+		}
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			if m[k.(string)], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unexpected msgpack type 0x%x", b)
+}
+
+func TestV1Msgpack(t *testing.T) {
+	longTopic := strings.Repeat("t", 40)
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return struct {
+			Topics  []string `json:"topics"`
+			Count   int      `json:"count"`
+			Depth   int64    `json:"depth"`
+			Rate    float64  `json:"rate"`
+			Paused  bool     `json:"paused"`
+			Missing *string  `json:"missing"`
+		}{[]string{"a", longTopic}, -5, 1 << 40, 0.5, true, nil}, nil
+	}, V1)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/topics", nil)
+	req.Header.Set("Accept", "application/msgpack")
+	h(w, req, nil)
+	test.Equal(t, 200, w.Code)
+	test.Equal(t, "application/msgpack", w.Header().Get("Content-Type"))
+
+	v, err := decodeMsgpack(bytes.NewReader(w.Body.Bytes()))
+	test.Nil(t, err)
+	test.Equal(t, map[string]interface{}{
+		"topics":  []interface{}{"a", longTopic},
+		"count":   int64(-5),
+		"depth":   int64(1 << 40),
+		"rate":    0.5,
+		"paused":  true,
+		"missing": nil,
+	}, v)
+
+	// JSON is the default and is used for anything that isn't supported
+	for _, accept := range []string{"", "application/json", "text/html, */*", "application/vnd.nsq; version=1.0"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/topics", nil)
+		req.Header.Set("Accept", accept)
+		h(w, req, nil)
+		test.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+		var body map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &body)
+		test.Nil(t, err)
+		test.Equal(t, true, body["paused"])
+	}
+}
+
+func TestV1MsgpackErr(t *testing.T) {
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return nil, Err{404, "topic not found", "TOPIC_NOT_FOUND"}
+	}, V1)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/lookup", nil)
+	req.Header.Set("Accept", "application/x-msgpack;q=0.9, application/json;q=0.5")
+	h(w, req, nil)
+	test.Equal(t, 404, w.Code)
+	test.Equal(t, "application/msgpack", w.Header().Get("Content-Type"))
+
+	v, err := decodeMsgpack(bytes.NewReader(w.Body.Bytes()))
+	test.Nil(t, err)
+	test.Equal(t, map[string]interface{}{
+		"message": "topic not found",
+		"error":   "TOPIC_NOT_FOUND",
+	}, v)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	f := func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		_, err := NewReqParams(req)
+		if err != nil {
+			return nil, ErrInvalidRequest
+		}
+		return "OK", nil
+	}
+	h := Decorate(f, MaxBodySize(8), V1)
+
+	for _, tc := range []struct {
+		body          string
+		contentLength int64
+		code          int
+	}{
+		{"12345678", 8, 200},
+		{"123456789", 9, 413},
+		// chunked, the size isn't known up front
+		{"12345678", -1, 200},
+		{"123456789", -1, 413},
+	} {
+		req := httptest.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader(tc.body)))
+		req.ContentLength = tc.contentLength
+		w := httptest.NewRecorder()
+		h(w, req, nil)
+		test.Equal(t, tc.code, w.Code)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	h := Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		return nil, Err{Code: 404, Text: "NOT_FOUND"}
+	}, SecurityHeaders(map[string]string{
+		"X-Frame-Options":         "DENY",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "",
+	}), V1, ETag)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h(w, req, nil)
+	test.Equal(t, 404, w.Code)
+	test.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+	test.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	_, ok := w.Header()["Content-Security-Policy"]
+	test.Equal(t, false, ok)
+}
@@ -0,0 +1,161 @@
+package http_api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Encoder serializes the body of a V1 response
+type Encoder interface {
+	ContentType() string
+	Encode(v interface{}, pretty bool) ([]byte, error)
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+func (jsonEncoder) Encode(v interface{}, pretty bool) ([]byte, error) {
+	return marshalJSON(v, pretty)
+}
+
+// msgpackEncoder encodes to MessagePack (https://msgpack.org).
+//
+// Values are first round-tripped through encoding/json so that the json
+// struct tags (and custom MarshalJSON methods) used by every response
+// apply here as well. pretty has no effect.
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackEncoder) Encode(v interface{}, pretty bool) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	err = dec.Decode(&generic)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = writeMsgpack(&buf, generic)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// the media types that can be requested in the Accept header, JSON is
+// used when none of them are
+var encoders = map[string]Encoder{
+	"application/json":      jsonEncoder{},
+	"application/msgpack":   msgpackEncoder{},
+	"application/x-msgpack": msgpackEncoder{},
+}
+
+// negotiateEncoder returns the Encoder for the first supported media
+// type in the request's Accept header
+func negotiateEncoder(req *http.Request) Encoder {
+	for _, mediaType := range strings.Split(req.Header.Get("Accept"), ",") {
+		if i := strings.Index(mediaType, ";"); i != -1 {
+			mediaType = mediaType[:i]
+		}
+		if enc, ok := encoders[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+			return enc
+		}
+	}
+	return jsonEncoder{}
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := writeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			writeMsgpack(buf, k)
+			if err := writeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// writeMsgpackHeader writes the type and length of a str, array or map,
+// using the "fix" form when n < fixMax. op8 is 0 when there is no 8 bit form.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, op8 byte, op16 byte, op32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case op8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(op8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(op16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(op32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
@@ -0,0 +1,87 @@
+package http_api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the errors that handlers and decorators return in more than one place
+var (
+	ErrInvalidRequest   = keyErr(400, "INVALID_REQUEST")
+	ErrForbidden        = keyErr(403, "FORBIDDEN")
+	ErrLimitExceeded    = keyErr(403, "LIMIT_EXCEEDED")
+	ErrNotFound         = Err{Code: 404, Text: "NOT_FOUND"}
+	ErrMethodNotAllowed = Err{Code: 405, Text: "METHOD_NOT_ALLOWED"}
+	ErrBodyTooLarge     = keyErr(413, "BODY_TOO_LARGE")
+	ErrInternal         = Err{Code: 500, Text: "INTERNAL_ERROR"}
+)
+
+// ErrMissingArg is a 400 for a required query argument that wasn't given,
+// e.g. ErrMissingArg("topic") is MISSING_ARG_TOPIC
+func ErrMissingArg(name string) Err {
+	return keyErr(400, "MISSING_ARG_"+strings.ToUpper(name))
+}
+
+// ErrInvalidArg is a 400 for a query argument that couldn't be parsed or
+// is out of range, e.g. INVALID_ARG_LIMIT
+func ErrInvalidArg(name string) Err {
+	return keyErr(400, "INVALID_ARG_"+strings.ToUpper(name))
+}
+
+// ErrResourceNotFound is a 404 for a named thing that doesn't exist, e.g.
+// TOPIC_NOT_FOUND
+func ErrResourceNotFound(what string) Err {
+	return keyErr(404, strings.ToUpper(what)+"_NOT_FOUND")
+}
+
+// ErrResourceExists is a 409 for a named thing that already exists, e.g.
+// TOPIC_EXISTS
+func ErrResourceExists(what string) Err {
+	return keyErr(409, strings.ToUpper(what)+"_EXISTS")
+}
+
+// keyErr is an Err whose message is its key, as the messages have always
+// been upper case codes that clients match on
+func keyErr(code int, key string) Err {
+	return Err{code, key, key}
+}
+
+// causeErr is an Err with the error that caused it, the cause is logged
+// but not sent to the client
+type causeErr struct {
+	Err
+	cause error
+}
+
+func (e causeErr) Cause() error {
+	return e.cause
+}
+
+// WithCause attaches the underlying error to e for the Log decorator
+func (e Err) WithCause(cause error) error {
+	return causeErr{e, cause}
+}
+
+// asErr returns the Err that err is or wraps, any other error is an
+// ErrInternal caused by it
+func asErr(err error) (Err, error) {
+	switch e := err.(type) {
+	case Err:
+		return e, nil
+	case causeErr:
+		return e.Err, e.cause
+	}
+	return ErrInternal, err
+}
+
+// causeString is the cause of err, if any, for logging
+func causeString(err error) string {
+	if err == nil {
+		return ""
+	}
+	_, cause := asErr(err)
+	if cause == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s", cause)
+}
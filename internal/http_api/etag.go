@@ -0,0 +1,117 @@
+package http_api
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// bufferedResponse holds a response so that it can be inspected before
+// it is written to the real ResponseWriter
+type bufferedResponse struct {
+	w      http.ResponseWriter
+	header http.Header
+	code   int
+	body   bytes.Buffer
+
+	// set by unbuffer, everything is then written straight to w
+	unbuffered bool
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	if b.unbuffered {
+		return b.w.Header()
+	}
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.unbuffered {
+		b.w.WriteHeader(code)
+		return
+	}
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.unbuffered {
+		return b.w.Write(p)
+	}
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// unbuffer gives up on the ETag for a response that is streamed (see
+// StreamedArray), it must be called before anything has been written
+func (b *bufferedResponse) unbuffer() {
+	for k, v := range b.header {
+		b.w.Header()[k] = v
+	}
+	b.unbuffered = true
+}
+
+// ETag sets a weak ETag (a hash of the body) on successful GET responses
+// and responds 304 Not Modified when it matches the request's If-None-Match.
+//
+// It buffers the response, so it must be applied after (i.e. outside of)
+// the decorator that writes it, e.g. Decorate(f, log, V1, ETag). Streamed
+// responses are passed through as they are written and get no ETag.
+func ETag(f APIHandler) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		if req.Method != "GET" {
+			return f(w, req, ps)
+		}
+
+		buf := &bufferedResponse{w: w, header: make(http.Header)}
+		data, err := f(buf, req, ps)
+		if buf.unbuffered {
+			return data, err
+		}
+		if buf.code == 0 {
+			buf.code = http.StatusOK
+		}
+
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+
+		if buf.code == http.StatusOK {
+			h := fnv.New64a()
+			h.Write(buf.body.Bytes())
+			etag := fmt.Sprintf(`W/"%x"`, h.Sum64())
+			w.Header().Set("ETag", etag)
+			if etagMatch(req.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return data, err
+			}
+		}
+
+		w.WriteHeader(buf.code)
+		w.Write(buf.body.Bytes())
+		return data, err
+	}
+}
+
+// etagMatch implements the weak comparison used for If-None-Match
+func etagMatch(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
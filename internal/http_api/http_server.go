@@ -1,10 +1,12 @@
 package http_api
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/nsqio/nsq/internal/lg"
 )
@@ -18,12 +20,38 @@ func (l logWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// ServerConfig holds the http.Server knobs, the zero value matches the
+// behavior of Serve (no timeouts, http.DefaultMaxHeaderBytes)
+type ServerConfig struct {
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration // ignored prior to Go 1.8
+	MaxHeaderBytes int
+
+	// HTTP2 allows HTTP/2 to be negotiated (ALPN "h2") on TLS listeners
+	// whose config advertises it. Go's net/http does not speak HTTP/2 over
+	// plain TCP (h2c) so it has no effect on other listeners.
+	HTTP2 bool
+}
+
 func Serve(listener net.Listener, handler http.Handler, proto string, logf lg.AppLogFunc) {
+	ServeWithConfig(listener, handler, ServerConfig{}, proto, logf)
+}
+
+func ServeWithConfig(listener net.Listener, handler http.Handler, cfg ServerConfig, proto string, logf lg.AppLogFunc) {
 	logf(lg.INFO, "%s: listening on %s", proto, listener.Addr())
 
 	server := &http.Server{
-		Handler:  handler,
-		ErrorLog: log.New(logWriter{logf}, "", 0),
+		Handler:        handler,
+		ErrorLog:       log.New(logWriter{logf}, "", 0),
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	setIdleTimeout(server, cfg.IdleTimeout)
+	if !cfg.HTTP2 {
+		// a non-nil, empty map keeps net/http from configuring HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
 	err := server.Serve(listener)
 	// theres no direct way to detect this error because it is not exposed
@@ -0,0 +1,12 @@
+// +build !go1.8
+
+package http_api
+
+import (
+	"net/http"
+	"time"
+)
+
+// http.Server.IdleTimeout was added in Go 1.8, ReadTimeout still bounds
+// idle keep-alive connections
+func setIdleTimeout(s *http.Server, d time.Duration) {}
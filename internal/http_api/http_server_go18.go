@@ -0,0 +1,12 @@
+// +build go1.8
+
+package http_api
+
+import (
+	"net/http"
+	"time"
+)
+
+func setIdleTimeout(s *http.Server, d time.Duration) {
+	s.IdleTimeout = d
+}
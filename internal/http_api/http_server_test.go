@@ -0,0 +1,48 @@
+package http_api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func nopLogf(lvl lg.LogLevel, f string, args ...interface{}) {}
+
+func TestServeWriteTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("OK"))
+	})
+	go ServeWithConfig(listener, handler, ServerConfig{
+		WriteTimeout: 50 * time.Millisecond,
+	}, "HTTP", nopLogf)
+
+	client := &http.Client{Timeout: time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/fast", listener.Addr()))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "OK", string(body))
+
+	// the response is written after the deadline so the connection is
+	// closed without one
+	resp, err = client.Get(fmt.Sprintf("http://%s/slow", listener.Addr()))
+	if err == nil {
+		resp.Body.Close()
+	}
+	test.NotNil(t, err)
+}
@@ -0,0 +1,52 @@
+package http_api
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// limitedBody is an http.MaxBytesReader that remembers whether the limit
+// was exceeded
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// MaxBodySize limits request bodies to n bytes (0 disables the limit),
+// responding 413 when a request's body is larger.
+//
+// The handler's error is replaced when it failed because the body was
+// too large, so it must be applied before (i.e. inside of) the decorators
+// that log or write the response, e.g. Decorate(f, MaxBodySize(n), log, V1)
+func MaxBodySize(n int64) Decorator {
+	return func(f APIHandler) APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			if n <= 0 {
+				return f(w, req, ps)
+			}
+			if req.ContentLength > n {
+				return nil, ErrBodyTooLarge
+			}
+			body := &limitedBody{ReadCloser: http.MaxBytesReader(w, req.Body, n), limit: n}
+			req.Body = body
+			data, err := f(w, req, ps)
+			if body.exceeded {
+				return nil, ErrBodyTooLarge
+			}
+			return data, err
+		}
+	}
+}
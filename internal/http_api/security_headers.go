@@ -0,0 +1,30 @@
+package http_api
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// SecurityHeaders sets headers (e.g. Content-Security-Policy,
+// X-Frame-Options) on every response, those with an empty value are
+// skipped. They are set before the handler runs, so it can be applied
+// anywhere in the chain and handlers can still override them.
+func SecurityHeaders(headers map[string]string) Decorator {
+	names := make([]string, 0, len(headers))
+	for name, value := range headers {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return func(f APIHandler) APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			for _, name := range names {
+				w.Header().Set(name, headers[name])
+			}
+			return f(w, req, ps)
+		}
+	}
+}
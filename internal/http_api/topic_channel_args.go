@@ -1,8 +1,6 @@
 package http_api
 
 import (
-	"errors"
-
 	"github.com/nsqio/nsq/internal/protocol"
 )
 
@@ -13,20 +11,20 @@ type getter interface {
 func GetTopicChannelArgs(rp getter) (string, string, error) {
 	topicName, err := rp.Get("topic")
 	if err != nil {
-		return "", "", errors.New("MISSING_ARG_TOPIC")
+		return "", "", ErrMissingArg("topic")
 	}
 
 	if !protocol.IsValidTopicName(topicName) {
-		return "", "", errors.New("INVALID_ARG_TOPIC")
+		return "", "", ErrInvalidArg("topic")
 	}
 
 	channelName, err := rp.Get("channel")
 	if err != nil {
-		return "", "", errors.New("MISSING_ARG_CHANNEL")
+		return "", "", ErrMissingArg("channel")
 	}
 
 	if !protocol.IsValidChannelName(channelName) {
-		return "", "", errors.New("INVALID_ARG_CHANNEL")
+		return "", "", ErrInvalidArg("channel")
 	}
 
 	return topicName, channelName, nil
@@ -0,0 +1,57 @@
+package lg
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// levelLogger is implemented by Loggers that want the level of a message
+// as a field rather than as a prefix of it
+type levelLogger interface {
+	OutputLevel(maxdepth int, lvl LogLevel, s string) error
+}
+
+// JSONLogger writes each message as a line of JSON, e.g.
+//
+//	{"ts":"2018-01-02T15:04:05.999999999Z","level":"INFO","component":"nsqlookupd","msg":"..."}
+type JSONLogger struct {
+	sync.Mutex
+	w         io.Writer
+	component string
+}
+
+func NewJSONLogger(w io.Writer, component string) *JSONLogger {
+	return &JSONLogger{
+		w:         w,
+		component: component,
+	}
+}
+
+// Output implements Logger for messages logged without a level
+func (l *JSONLogger) Output(maxdepth int, s string) error {
+	return l.write("", s)
+}
+
+func (l *JSONLogger) OutputLevel(maxdepth int, lvl LogLevel, s string) error {
+	return l.write(lvl.String(), s)
+}
+
+func (l *JSONLogger) write(level string, s string) error {
+	line, err := json.Marshal(struct {
+		Timestamp string `json:"ts"`
+		Level     string `json:"level,omitempty"`
+		Component string `json:"component"`
+		Message   string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), level, l.component, s})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.w.Write(line)
+	return err
+}
@@ -71,5 +71,9 @@ func Logf(logger Logger, cfgLevel LogLevel, msgLevel LogLevel, f string, args ..
 	if cfgLevel > msgLevel {
 		return
 	}
+	if l, ok := logger.(levelLogger); ok {
+		l.OutputLevel(3, msgLevel, fmt.Sprintf(f, args...))
+		return
+	}
 	logger.Output(3, fmt.Sprintf(msgLevel.String()+": "+f, args...))
 }
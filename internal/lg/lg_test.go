@@ -1,6 +1,8 @@
 package lg
 
 import (
+	"bytes"
+	"encoding/json"
 	"log"
 	"os"
 	"testing"
@@ -107,3 +109,30 @@ func TestNoLogger(t *testing.T) {
 
 	app.logf(ERROR, "should never be logged")
 }
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, "app")
+
+	Logf(logger, INFO, DEBUG, "filtered")
+	Logf(logger, INFO, WARN, "hello %s", "world")
+	logger.Output(2, "no level")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	test.Equal(t, 2, len(lines))
+
+	var entry map[string]string
+	err := json.Unmarshal(lines[0], &entry)
+	test.Nil(t, err)
+	test.Equal(t, "WARNING", entry["level"])
+	test.Equal(t, "app", entry["component"])
+	test.Equal(t, "hello world", entry["msg"])
+	test.NotEqual(t, "", entry["ts"])
+
+	entry = nil
+	err = json.Unmarshal(lines[1], &entry)
+	test.Nil(t, err)
+	_, ok := entry["level"]
+	test.Equal(t, false, ok)
+	test.Equal(t, "no level", entry["msg"])
+}
@@ -0,0 +1,197 @@
+// Package lookupclient is a client for the nsqlookupd TCP protocol.
+//
+// It speaks the same "  V1" protocol that nsqd uses to announce its topics
+// and channels, and is intended for tests and tooling that need to act as
+// an nsqd without hand-rolling the wire format.
+package lookupclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// MagicV1 is sent as the first 4 bytes of every connection
+var MagicV1 = []byte("  V1")
+
+// PeerInfo is the metadata sent in an IDENTIFY
+type PeerInfo struct {
+	Hostname         string `json:"hostname"`
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+	HTTPPort         int    `json:"http_port"`
+	Version          string `json:"version"`
+}
+
+// LookupdInfo is the metadata nsqlookupd responds with to an IDENTIFY
+type LookupdInfo struct {
+	Hostname         string `json:"hostname"`
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+	HTTPPort         int    `json:"http_port"`
+	Version          string `json:"version"`
+}
+
+// Error is an error response from nsqlookupd, e.g. "E_BAD_TOPIC ..."
+type Error struct {
+	Code string
+	Desc string
+}
+
+func (e *Error) Error() string {
+	return e.Code + " " + e.Desc
+}
+
+// Client is a single connection to nsqlookupd
+//
+// A Client is not safe for concurrent use, each command is a
+// synchronous round-trip.
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// Dial connects to the nsqlookupd TCP address and sends the protocol magic.
+//
+// timeout bounds the dial as well as each subsequent read and write.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: timeout,
+	}
+	_, err = c.write(MagicV1)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the underlying connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Identify sends an IDENTIFY, it must be the first command after Dial
+func (c *Client) Identify(info PeerInfo) (*LookupdInfo, error) {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.command("IDENTIFY", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var li LookupdInfo
+	err = json.Unmarshal(resp, &li)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse IDENTIFY response %q - %s", resp, err)
+	}
+	return &li, nil
+}
+
+// Register announces the topic (and channel, if not empty)
+func (c *Client) Register(topic string, channel string) error {
+	return c.ok(c.command("REGISTER", topicChan(topic, channel), nil))
+}
+
+// Unregister removes the topic (and channel, if not empty) announcement
+func (c *Client) Unregister(topic string, channel string) error {
+	return c.ok(c.command("UNREGISTER", topicChan(topic, channel), nil))
+}
+
+// Ping keeps the registrations from becoming inactive
+func (c *Client) Ping() error {
+	return c.ok(c.command("PING", nil, nil))
+}
+
+func topicChan(topic string, channel string) []string {
+	if channel == "" {
+		return []string{topic}
+	}
+	return []string{topic, channel}
+}
+
+func (c *Client) ok(resp []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if string(resp) != "OK" {
+		return fmt.Errorf("unexpected response %q", resp)
+	}
+	return nil
+}
+
+// command writes "NAME param1 param2\n" followed by a size prefixed body
+// (when not nil) and reads the size prefixed response
+func (c *Client) command(name string, params []string, body []byte) ([]byte, error) {
+	line := name
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	buf := make([]byte, 0, len(line)+1+4+len(body))
+	buf = append(buf, line...)
+	buf = append(buf, '\n')
+	if body != nil {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(body)))
+		buf = append(buf, size[:]...)
+		buf = append(buf, body...)
+	}
+
+	_, err := c.write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(resp), "E_") {
+		parts := strings.SplitN(string(resp), " ", 2)
+		e := &Error{Code: parts[0]}
+		if len(parts) == 2 {
+			e.Desc = parts[1]
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+func (c *Client) write(b []byte) (int, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.conn.Write(b)
+}
+
+func (c *Client) readResponse() ([]byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	var size int32
+	err := binary.Read(c.r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, errors.New("invalid response size")
+	}
+
+	resp := make([]byte, size)
+	_, err = io.ReadFull(c.r, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+package lookupclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+	"github.com/nsqio/nsq/nsqlookupd"
+)
+
+func mustStartLookupd(t *testing.T) *nsqlookupd.NSQLookupd {
+	opts := nsqlookupd.NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	lookupd, err := nsqlookupd.New(opts)
+	test.Nil(t, err)
+	err = lookupd.Main()
+	test.Nil(t, err)
+	return lookupd
+}
+
+func TestClient(t *testing.T) {
+	lookupd := mustStartLookupd(t)
+	defer lookupd.Exit()
+
+	c, err := Dial(lookupd.RealTCPAddr().String(), time.Second)
+	test.Nil(t, err)
+	defer c.Close()
+
+	// commands other than PING require an IDENTIFY first
+	err = c.Register("lookupclient", "")
+	test.NotNil(t, err)
+	test.Equal(t, "E_INVALID", err.(*Error).Code)
+
+	c, err = Dial(lookupd.RealTCPAddr().String(), time.Second)
+	test.Nil(t, err)
+	defer c.Close()
+
+	err = c.Ping()
+	test.Nil(t, err)
+
+	info, err := c.Identify(PeerInfo{
+		Hostname:         "lookupclient-host",
+		BroadcastAddress: "lookupclient-host",
+		TCPPort:          4150,
+		HTTPPort:         4151,
+		Version:          "1.0.0",
+	})
+	test.Nil(t, err)
+	test.Equal(t, lookupd.RealTCPAddr().Port, info.TCPPort)
+	test.Equal(t, lookupd.RealHTTPAddr().Port, info.HTTPPort)
+
+	err = c.Register("lookupclient", "")
+	test.Nil(t, err)
+	err = c.Register("lookupclient", "ch1")
+	test.Nil(t, err)
+
+	producers := lookupd.DB.FindProducers("topic", "lookupclient", "")
+	test.Equal(t, 1, len(producers))
+	producers = lookupd.DB.FindProducers("channel", "lookupclient", "ch1")
+	test.Equal(t, 1, len(producers))
+
+	err = c.Unregister("lookupclient", "ch1")
+	test.Nil(t, err)
+	producers = lookupd.DB.FindProducers("channel", "lookupclient", "ch1")
+	test.Equal(t, 0, len(producers))
+
+	err = c.Ping()
+	test.Nil(t, err)
+
+	err = c.Register("bad_topic!", "")
+	test.NotNil(t, err)
+	test.Equal(t, "E_BAD_TOPIC", err.(*Error).Code)
+}
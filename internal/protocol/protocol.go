@@ -1,9 +1,12 @@
 package protocol
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
 // Protocol describes the basic behavior of any protocol in the system
@@ -11,6 +14,12 @@ type Protocol interface {
 	IOLoop(conn net.Conn) error
 }
 
+// ContextProtocol is a Protocol whose IOLoop returns once ctx is done
+type ContextProtocol interface {
+	Protocol
+	IOLoopContext(ctx context.Context, conn net.Conn) error
+}
+
 // SendResponse is a server side utility function to prefix data with a length header
 // and write to the supplied Writer
 func SendResponse(w io.Writer, data []byte) (int, error) {
@@ -27,6 +36,44 @@ func SendResponse(w io.Writer, data []byte) (int, error) {
 	return (n + 4), nil
 }
 
+// MaxResponseSize is the largest response ReadResponse accepts
+const MaxResponseSize = 16 * 1024 * 1024
+
+// ReadResponse is a client side utility function to read a response sent
+// with SendResponse from the supplied Reader, returning its data. A length
+// header greater than MaxResponseSize is an error (nothing more is read).
+func ReadResponse(r io.Reader) ([]byte, error) {
+	var size uint32
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxResponseSize {
+		return nil, fmt.Errorf("response size %d exceeds max %d", size, MaxResponseSize)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SendResponseTimeout is SendResponse with a write deadline timeout from now
+// (none when timeout is 0), so that a client that stopped reading can't block
+// the caller forever
+func SendResponseTimeout(conn net.Conn, data []byte, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := SendResponse(conn, data)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return n, fmt.Errorf("write timed out after %s - %s", timeout, err)
+	}
+	return n, err
+}
+
 // SendFramedResponse is a server side utility function to prefix data with a length header
 // and frame header and write to the supplied Writer
 func SendFramedResponse(w io.Writer, frameType int32, data []byte) (int, error) {
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestReadResponse(t *testing.T) {
+	var buf bytes.Buffer
+	for _, data := range [][]byte{[]byte("OK"), {}, bytes.Repeat([]byte("a"), 4096)} {
+		n, err := SendResponse(&buf, data)
+		test.Nil(t, err)
+		test.Equal(t, len(data)+4, n)
+	}
+
+	data, err := ReadResponse(&buf)
+	test.Nil(t, err)
+	test.Equal(t, "OK", string(data))
+	data, err = ReadResponse(&buf)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(data))
+	data, err = ReadResponse(&buf)
+	test.Nil(t, err)
+	test.Equal(t, 4096, len(data))
+
+	_, err = ReadResponse(&buf)
+	test.Equal(t, io.EOF, err)
+
+	// a truncated body
+	SendResponse(&buf, []byte("truncated"))
+	buf.Truncate(buf.Len() - 1)
+	_, err = ReadResponse(&buf)
+	test.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReadResponseTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(MaxResponseSize+1))
+	buf.WriteString("data")
+	_, err := ReadResponse(&buf)
+	test.NotNil(t, err)
+	// the body isn't read
+	test.Equal(t, 4, buf.Len())
+
+	// a negative int32 length
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, int32(-1))
+	_, err = ReadResponse(&buf)
+	test.NotNil(t, err)
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature is the fixed 12 byte prefix of a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// the longest possible v1 header, including the trailing CRLF
+const proxyV1MaxLength = 107
+
+var errBadProxyHeader = errors.New("malformed PROXY protocol header")
+
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// ReadProxyHeader consumes a PROXY protocol (v1 or v2) header from conn and
+// returns a net.Conn whose RemoteAddr() is the original client address
+// described by the header.
+//
+// A connection that does not start with a valid header is rejected.
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReaderSize(conn, 256)
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		addr, err = readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		addr, err = readProxyV1(r)
+	default:
+		err = errBadProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		// UNKNOWN/LOCAL - keep the address of the connection itself
+		addr = conn.RemoteAddr()
+	}
+
+	return &proxyConn{Conn: conn, r: r, remoteAddr: addr}, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errBadProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, errBadProxyHeader
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errBadProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errBadProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errBadProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xF {
+	case 0x0:
+		// LOCAL - health checks etc. from the proxy itself
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errBadProxyHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	case 0x00: // UNSPEC
+		return nil, nil
+	}
+
+	return nil, errBadProxyHeader
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func proxyPipe(t *testing.T, header []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(header)
+		client.Write([]byte("  V1"))
+		client.Close()
+	}()
+	conn, err := ReadProxyHeader(server)
+	if err != nil {
+		server.Close()
+	}
+	return conn, err
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	conn, err := proxyPipe(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160\r\n"))
+	test.Nil(t, err)
+	test.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+
+	// the data following the header must still be readable
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	test.Nil(t, err)
+	test.Equal(t, "  V1", string(buf))
+
+	conn, err = proxyPipe(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4242 4160\r\n"))
+	test.Nil(t, err)
+	test.Equal(t, "[2001:db8::1]:4242", conn.RemoteAddr().String())
+
+	conn, err = proxyPipe(t, []byte("PROXY UNKNOWN\r\n"))
+	test.Nil(t, err)
+	test.Equal(t, "pipe", conn.RemoteAddr().String())
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 10, 0, 0, 1, 10, 0, 0, 2)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], 5150)
+	binary.BigEndian.PutUint16(ports[2:4], 4160)
+	header = append(header, ports...)
+
+	conn, err := proxyPipe(t, header)
+	test.Nil(t, err)
+	test.Equal(t, "10.0.0.1:5150", conn.RemoteAddr().String())
+}
+
+func TestReadProxyHeaderMalformed(t *testing.T) {
+	for _, header := range []string{
+		"  V1IDENTIFY\n",
+		"PROXY TCP4 not.an.ip 192.168.0.11 56324 4160\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 4160\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 99999 4160\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160\n",
+	} {
+		_, err := proxyPipe(t, []byte(header))
+		test.NotNil(t, err)
+	}
+}
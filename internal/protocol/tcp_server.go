@@ -1,8 +1,10 @@
 package protocol
 
 import (
+	"context"
 	"net"
 	"runtime"
+	"runtime/debug"
 	"strings"
 
 	"github.com/nsqio/nsq/internal/lg"
@@ -11,9 +13,23 @@ import (
 type TCPHandler interface {
 	Handle(net.Conn)
 }
+
+// ContextTCPHandler is implemented by handlers that accept the server's
+// context, it is cancelled when the server wants in-flight handlers to
+// return (e.g. on shutdown)
+type ContextTCPHandler interface {
+	HandleContext(context.Context, net.Conn)
+}
+
 // 接收一个连接请求，并开启一个 goroutine 并发处理改请求
 // 处理工作在handler 里面执行，handler在nsqlookupd Main()里面得到
 func TCPServer(listener net.Listener, handler TCPHandler, logf lg.AppLogFunc) {
+	TCPServerContext(context.Background(), listener, handler, logf)
+}
+
+// TCPServerContext is TCPServer with a base context passed to handlers that
+// implement ContextTCPHandler, others are called with Handle
+func TCPServerContext(ctx context.Context, listener net.Listener, handler TCPHandler, logf lg.AppLogFunc) {
 	logf(lg.INFO, "TCP: listening on %s", listener.Addr())
 
 	for {
@@ -30,8 +46,23 @@ func TCPServer(listener net.Listener, handler TCPHandler, logf lg.AppLogFunc) {
 			}
 			break
 		}
-		go handler.Handle(clientConn)
+		go handle(ctx, handler, clientConn, logf)
 	}
 
 	logf(lg.INFO, "TCP: closing %s", listener.Addr())
 }
+
+// a panic while handling one client only closes that connection
+func handle(ctx context.Context, handler TCPHandler, clientConn net.Conn, logf lg.AppLogFunc) {
+	defer func() {
+		if r := recover(); r != nil {
+			logf(lg.ERROR, "panic handling client(%s) - %s\n%s", clientConn.RemoteAddr(), r, debug.Stack())
+			clientConn.Close()
+		}
+	}()
+	if h, ok := handler.(ContextTCPHandler); ok {
+		h.HandleContext(ctx, clientConn)
+		return
+	}
+	handler.Handle(clientConn)
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+type panicHandler struct {
+	count int32
+}
+
+func (h *panicHandler) Handle(conn net.Conn) {
+	if atomic.AddInt32(&h.count, 1) == 1 {
+		panic("boom")
+	}
+	conn.Write([]byte("OK"))
+	conn.Close()
+}
+
+func TestTCPServerRecoversPanic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+
+	var mtx sync.Mutex
+	var logs []string
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		mtx.Lock()
+		logs = append(logs, f)
+		mtx.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		TCPServer(listener, &panicHandler{}, logf)
+		close(done)
+	}()
+
+	// the connection that panicked is closed
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	test.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	test.Equal(t, io.EOF, err)
+	conn.Close()
+
+	// and the server keeps accepting new ones
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	test.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	test.Nil(t, err)
+	test.Equal(t, "OK", string(buf))
+	conn.Close()
+
+	listener.Close()
+	<-done
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	found := false
+	for _, l := range logs {
+		if strings.HasPrefix(l, "panic handling client") {
+			found = true
+		}
+	}
+	test.Equal(t, true, found)
+}
+
+type contextHandler struct {
+	returned chan struct{}
+}
+
+func (h *contextHandler) Handle(conn net.Conn) {
+	panic("Handle called instead of HandleContext")
+}
+
+func (h *contextHandler) HandleContext(ctx context.Context, conn net.Conn) {
+	<-ctx.Done()
+	conn.Close()
+	close(h.returned)
+}
+
+func TestTCPServerContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &contextHandler{returned: make(chan struct{})}
+	go TCPServerContext(ctx, listener, h, logf)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	test.Nil(t, err)
+	defer conn.Close()
+
+	select {
+	case <-h.returned:
+		t.Fatal("handler returned before the context was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-h.returned:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not return after the context was cancelled")
+	}
+}
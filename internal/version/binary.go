@@ -7,6 +7,16 @@ import (
 
 const Binary = "1.0.0-compat"
 
+// Commit and BuildDate are set at build time with -ldflags "-X ..." (see
+// dist.sh), they are empty in development builds
+var (
+	Commit    string
+	BuildDate string
+)
+
 func String(app string) string {
-	return fmt.Sprintf("%s v%s (built w/%s)", app, Binary, runtime.Version())
+	if Commit == "" {
+		return fmt.Sprintf("%s v%s (built w/%s)", app, Binary, runtime.Version())
+	}
+	return fmt.Sprintf("%s v%s (%s %s, built w/%s)", app, Binary, Commit, BuildDate, runtime.Version())
 }
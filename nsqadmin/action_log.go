@@ -0,0 +1,50 @@
+package nsqadmin
+
+import (
+	"sync"
+)
+
+// actionLog is a fixed size ring buffer of the most recent AdminActions
+type actionLog struct {
+	sync.Mutex
+	actions []*AdminAction
+	next    int
+	full    bool
+}
+
+func newActionLog(size int) *actionLog {
+	if size < 0 {
+		size = 0
+	}
+	return &actionLog{
+		actions: make([]*AdminAction, size),
+	}
+}
+
+func (l *actionLog) add(a *AdminAction) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.actions) == 0 {
+		return
+	}
+	l.actions[l.next] = a
+	l.next = (l.next + 1) % len(l.actions)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the actions, most recent first
+func (l *actionLog) list() []*AdminAction {
+	l.Lock()
+	defer l.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.actions)
+	}
+	actions := make([]*AdminAction, 0, n)
+	for i := 1; i <= n; i++ {
+		actions = append(actions, l.actions[(l.next-i+len(l.actions))%len(l.actions)])
+	}
+	return actions
+}
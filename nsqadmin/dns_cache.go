@@ -0,0 +1,115 @@
+package nsqadmin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dnsCache caches the addresses hostnames resolve to for ttl, so the
+// outbound requests nsqadmin makes to nsqlookupd and nsqd don't each do a
+// DNS lookup. IP literals are dialed as is.
+type dnsCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	lookupHost func(host string) ([]string, error)
+	entries    map[string]dnsCacheEntry
+
+	hits   int64
+	misses int64
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:        ttl,
+		lookupHost: net.LookupHost,
+		entries:    make(map[string]dnsCacheEntry),
+	}
+}
+
+// resolve returns the addresses of host and whether they were cached
+func (c *dnsCache) resolve(host string) ([]string, bool, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, false, nil
+	}
+
+	c.Lock()
+	entry, ok := c.entries[host]
+	if ok && time.Now().Before(entry.expires) {
+		c.hits++
+		c.Unlock()
+		return entry.addrs, true, nil
+	}
+	c.misses++
+	c.Unlock()
+
+	addrs, err := c.lookupHost(host)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.Lock()
+	c.entries[host] = dnsCacheEntry{addrs, time.Now().Add(c.ttl)}
+	c.Unlock()
+	return addrs, false, nil
+}
+
+// forget drops host so it is resolved again on its next use
+func (c *dnsCache) forget(host string) {
+	c.Lock()
+	delete(c.entries, host)
+	c.Unlock()
+}
+
+// stats returns the number of hits and misses
+func (c *dnsCache) stats() (int64, int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses
+}
+
+// dialContext wraps dial to connect to the resolved addresses of the host
+// in turn. When none of the cached addresses can be dialed the host is
+// resolved again, its addresses may have changed.
+func (c *dnsCache) dialContext(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+
+		conn, cached, err := c.dialHost(ctx, dial, network, host, port)
+		if err != nil && cached {
+			c.forget(host)
+			conn, _, err = c.dialHost(ctx, dial, network, host, port)
+		}
+		return conn, err
+	}
+}
+
+func (c *dnsCache) dialHost(ctx context.Context, dial dialContextFunc,
+	network string, host string, port string) (net.Conn, bool, error) {
+	addrs, cached, err := c.resolve(host)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		conn, err = dial(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, cached, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, cached, err
+}
@@ -0,0 +1,148 @@
+package nsqadmin
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// graphiteCache serves repeated graphite render requests for the same URL
+// from memory for up to ttl, keeping at most maxEntries responses
+type graphiteCache struct {
+	sync.Mutex
+	handler    http.Handler
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*graphiteCacheEntry
+}
+
+type graphiteCacheEntry struct {
+	code    int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newGraphiteCache(handler http.Handler, ttl time.Duration, maxEntries int) *graphiteCache {
+	return &graphiteCache{
+		handler:    handler,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*graphiteCacheEntry),
+	}
+}
+
+func (c *graphiteCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the credentials a request is forwarded with are part of the key, a
+	// response fetched with them isn't served to other callers
+	key := req.URL.RequestURI() + "\x00" + req.Header.Get("Authorization")
+
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.Unlock()
+
+	if ok {
+		for k, v := range e.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(e.code)
+		w.Write(e.body)
+		return
+	}
+
+	// the cached body is shared by clients accepting different encodings,
+	// so it is fetched unencoded (compressing it is left to CompressHandler)
+	upstreamReq := *req
+	upstreamReq.Header = cloneHeader(req.Header)
+	upstreamReq.Header.Del("Accept-Encoding")
+
+	rec := &cacheRecorder{w: w, header: make(http.Header), code: http.StatusOK}
+	c.handler.ServeHTTP(rec, &upstreamReq)
+	if rec.code != http.StatusOK {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	if len(c.entries) < c.maxEntries {
+		c.entries[key] = &graphiteCacheEntry{
+			code:    rec.code,
+			header:  rec.header,
+			body:    rec.buf.Bytes(),
+			expires: time.Now().Add(c.ttl),
+		}
+	}
+}
+
+// evict drops expired entries, or the entry closest to expiring when
+// there are none, must be called with the lock held
+func (c *graphiteCache) evict() {
+	now := time.Now()
+	var oldestKey string
+	var oldest time.Time
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldestKey == "" || e.expires.Before(oldest) {
+			oldestKey = k
+			oldest = e.expires
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldestKey != "" {
+		delete(c.entries, oldestKey)
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
+
+// cacheRecorder passes a response through while keeping a copy of it. It
+// has its own header map so that only the upstream response headers are
+// recorded, not those set by the handlers wrapping the cache (e.g. the
+// Content-Encoding of CompressHandler).
+type cacheRecorder struct {
+	w           http.ResponseWriter
+	header      http.Header
+	code        int
+	wroteHeader bool
+	buf         bytes.Buffer
+}
+
+func (r *cacheRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *cacheRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.code = code
+	for k, v := range r.header {
+		r.w.Header()[k] = append([]string(nil), v...)
+	}
+	r.w.WriteHeader(code)
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.buf.Write(b)
+	return r.w.Write(b)
+}
@@ -32,7 +32,7 @@ func maybeWarnMsg(msgs []string) string {
 }
 
 // this is similar to httputil.NewSingleHostReverseProxy except it passes along basic auth
-func NewSingleHostReverseProxy(target *url.URL, connectTimeout time.Duration, requestTimeout time.Duration) *httputil.ReverseProxy {
+func NewSingleHostReverseProxy(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
 	director := func(req *http.Request) {
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
@@ -43,21 +43,22 @@ func NewSingleHostReverseProxy(target *url.URL, connectTimeout time.Duration, re
 	}
 	return &httputil.ReverseProxy{
 		Director:  director,
-		Transport: http_api.NewDeadlineTransport(connectTimeout, requestTimeout),
+		Transport: transport,
 	}
 }
 
 type httpServer struct {
-	ctx    *Context
-	router http.Handler
-	client *http_api.Client
-	ci     *clusterinfo.ClusterInfo
+	ctx            *Context
+	router         http.Handler
+	client         *http_api.Client
+	graphiteClient *http_api.Client
+	ci             *clusterinfo.ClusterInfo
 }
 
 func NewHTTPServer(ctx *Context) *httpServer {
 	log := http_api.Log(ctx.nsqadmin.logf)
 
-	client := http_api.NewClient(ctx.nsqadmin.httpClientTLSConfig, ctx.nsqadmin.getOpts().HTTPClientConnectTimeout,
+	client := http_api.NewClientWithTransport(ctx.nsqadmin.httpClientTransport,
 		ctx.nsqadmin.getOpts().HTTPClientRequestTimeout)
 
 	router := httprouter.New()
@@ -69,48 +70,76 @@ func NewHTTPServer(ctx *Context) *httpServer {
 		ctx:    ctx,
 		router: router,
 		client: client,
-		ci:     clusterinfo.New(ctx.nsqadmin.logf, client),
+		graphiteClient: http_api.NewClientWithTransport(ctx.nsqadmin.graphiteTransport,
+			ctx.nsqadmin.getOpts().HTTPClientRequestTimeout),
+		ci: clusterinfo.New(ctx.nsqadmin.logf, client),
 	}
 
-	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	// 所有Decorate 的接口都设置安全相关的header
+	secure := http_api.SecurityHeaders(map[string]string{
+		"Content-Security-Policy": contentSecurityPolicy(ctx.nsqadmin.getOpts()),
+		"X-Frame-Options":         ctx.nsqadmin.getOpts().XFrameOptions,
+		"X-Content-Type-Options":  "nosniff",
+	})
+
+	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, secure, log, http_api.PlainText))
 
-	router.Handle("GET", "/", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/topics", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/topics/:topic", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/topics/:topic/:channel", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/nodes", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/nodes/:node", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/counter", http_api.Decorate(s.indexHandler, log))
-	router.Handle("GET", "/lookup", http_api.Decorate(s.indexHandler, log))
+	router.Handle("GET", "/", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/topics", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/topics/:topic", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/topics/:topic/:channel", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/nodes", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/nodes/:node", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/counter", http_api.Decorate(s.indexHandler, secure, log))
+	router.Handle("GET", "/lookup", http_api.Decorate(s.indexHandler, secure, log))
 
-	router.Handle("GET", "/static/:asset", http_api.Decorate(s.staticAssetHandler, log, http_api.PlainText))
-	router.Handle("GET", "/fonts/:asset", http_api.Decorate(s.staticAssetHandler, log, http_api.PlainText))
+	router.Handle("GET", "/static/:asset", http_api.Decorate(s.staticAssetHandler, secure, log, http_api.PlainText))
+	router.Handle("GET", "/fonts/:asset", http_api.Decorate(s.staticAssetHandler, secure, log, http_api.PlainText))
 	if s.ctx.nsqadmin.getOpts().ProxyGraphite {
-		proxy := NewSingleHostReverseProxy(ctx.nsqadmin.graphiteURL, ctx.nsqadmin.getOpts().HTTPClientConnectTimeout,
-			ctx.nsqadmin.getOpts().HTTPClientRequestTimeout)
+		var proxy http.Handler = NewSingleHostReverseProxy(ctx.nsqadmin.graphiteURL, ctx.nsqadmin.graphiteTransport)
+		if ctx.nsqadmin.getOpts().GraphiteCacheTTL > 0 {
+			proxy = newGraphiteCache(proxy, ctx.nsqadmin.getOpts().GraphiteCacheTTL,
+				ctx.nsqadmin.getOpts().GraphiteCacheSize)
+		}
 		router.Handler("GET", "/render", proxy)
 	}
 
 	// v1 endpoints
-	router.Handle("GET", "/api/topics", http_api.Decorate(s.topicsHandler, log, http_api.V1))
-	router.Handle("GET", "/api/topics/:topic", http_api.Decorate(s.topicHandler, log, http_api.V1))
-	router.Handle("GET", "/api/topics/:topic/:channel", http_api.Decorate(s.channelHandler, log, http_api.V1))
-	router.Handle("GET", "/api/nodes", http_api.Decorate(s.nodesHandler, log, http_api.V1))
-	router.Handle("GET", "/api/nodes/:node", http_api.Decorate(s.nodeHandler, log, http_api.V1))
-	router.Handle("POST", "/api/topics", http_api.Decorate(s.createTopicChannelHandler, log, http_api.V1))
-	router.Handle("POST", "/api/topics/:topic", http_api.Decorate(s.topicActionHandler, log, http_api.V1))
-	router.Handle("POST", "/api/topics/:topic/:channel", http_api.Decorate(s.channelActionHandler, log, http_api.V1))
-	router.Handle("DELETE", "/api/nodes/:node", http_api.Decorate(s.tombstoneNodeForTopicHandler, log, http_api.V1))
-	router.Handle("DELETE", "/api/topics/:topic", http_api.Decorate(s.deleteTopicHandler, log, http_api.V1))
-	router.Handle("DELETE", "/api/topics/:topic/:channel", http_api.Decorate(s.deleteChannelHandler, log, http_api.V1))
-	router.Handle("GET", "/api/counter", http_api.Decorate(s.counterHandler, log, http_api.V1))
-	router.Handle("GET", "/api/graphite", http_api.Decorate(s.graphiteHandler, log, http_api.V1))
-	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
-	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Handle("GET", "/api/topics", http_api.Decorate(s.topicsHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/api/topics/:topic", http_api.Decorate(s.topicHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/api/topics/:topic/:channel", http_api.Decorate(s.channelHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/api/nodes", http_api.Decorate(s.nodesHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/api/nodes/:node", http_api.Decorate(s.nodeHandler, secure, log, http_api.V1))
+	router.Handle("POST", "/api/topics", http_api.Decorate(s.createTopicChannelHandler, secure, log, http_api.V1))
+	router.Handle("POST", "/api/topics/:topic", http_api.Decorate(s.topicActionHandler, secure, log, http_api.V1))
+	router.Handle("POST", "/api/topics/:topic/:channel", http_api.Decorate(s.channelActionHandler, secure, log, http_api.V1))
+	router.Handle("DELETE", "/api/nodes/:node", http_api.Decorate(s.tombstoneNodeForTopicHandler, secure, log, http_api.V1))
+	router.Handle("DELETE", "/api/topics/:topic", http_api.Decorate(s.deleteTopicHandler, secure, log, http_api.V1))
+	router.Handle("DELETE", "/api/topics/:topic/:channel", http_api.Decorate(s.deleteChannelHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/api/counter", http_api.Decorate(s.counterHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/api/graphite", http_api.Decorate(s.graphiteHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/admin_actions", http_api.Decorate(s.adminActionsHandler, secure, log, http_api.V1))
+	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, secure, log, http_api.V1))
+	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, secure, log, http_api.V1))
 
 	return s
 }
 
+// contentSecurityPolicy returns --content-security-policy, the default
+// policy also allows the scripts of --graphite-url when the UI requests
+// graphite (JSONP) directly rather than through the proxy
+func contentSecurityPolicy(opts *Options) string {
+	csp := opts.ContentSecurityPolicy
+	if csp != DefaultContentSecurityPolicy || opts.GraphiteURL == "" || opts.ProxyGraphite {
+		return csp
+	}
+	u, err := url.Parse(opts.GraphiteURL)
+	if err != nil || u.Host == "" {
+		return csp
+	}
+	return strings.Replace(csp, "script-src 'self'", fmt.Sprintf("script-src 'self' %s://%s", u.Scheme, u.Host), 1)
+}
+
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.router.ServeHTTP(w, req)
 }
@@ -157,7 +186,7 @@ func (s *httpServer) staticAssetHandler(w http.ResponseWriter, req *http.Request
 
 	asset, err := Asset(assetName)
 	if err != nil {
-		return nil, http_api.Err{404, "NOT_FOUND"}
+		return nil, http_api.Err{Code: 404, Text: "NOT_FOUND"}
 	}
 
 	ext := path.Ext(assetName)
@@ -199,7 +228,7 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, err.Error()}
+		return nil, http_api.Err{Code: 400, Text: err.Error()}
 	}
 
 	var topics []string
@@ -212,7 +241,7 @@ func (s *httpServer) topicsHandler(w http.ResponseWriter, req *http.Request, ps
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topics - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -258,7 +287,7 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topic producers - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -268,7 +297,7 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topic metadata - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -298,7 +327,7 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topic producers - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -308,7 +337,7 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get channel metadata - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -328,7 +357,7 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps h
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nodes - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -350,7 +379,7 @@ func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps ht
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get producers - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -358,13 +387,13 @@ func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps ht
 
 	producer := producers.Search(node)
 	if producer == nil {
-		return nil, http_api.Err{404, "NODE_NOT_FOUND"}
+		return nil, http_api.Err{Code: 404, Text: "NODE_NOT_FOUND"}
 	}
 
 	topicStats, _, err := s.ci.GetNSQDStats(clusterinfo.Producers{producer}, "", "")
 	if err != nil {
 		s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
-		return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 	}
 
 	var totalClients int64
@@ -401,11 +430,11 @@ func (s *httpServer) tombstoneNodeForTopicHandler(w http.ResponseWriter, req *ht
 	}
 	err := json.NewDecoder(req.Body).Decode(&body)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_BODY"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_BODY"}
 	}
 
 	if !protocol.IsValidTopicName(body.Topic) {
-		return nil, http_api.Err{400, "INVALID_TOPIC"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
 	}
 
 	err = s.ci.TombstoneNodeForTopic(body.Topic, node,
@@ -414,7 +443,7 @@ func (s *httpServer) tombstoneNodeForTopicHandler(w http.ResponseWriter, req *ht
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to tombstone node for topic - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -436,20 +465,20 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 	}
 
 	if !s.isAuthorizedAdminRequest(req) {
-		return nil, http_api.Err{403, "FORBIDDEN"}
+		return nil, http_api.Err{Code: 403, Text: "FORBIDDEN"}
 	}
 
 	err := json.NewDecoder(req.Body).Decode(&body)
 	if err != nil {
-		return nil, http_api.Err{400, err.Error()}
+		return nil, http_api.Err{Code: 400, Text: err.Error()}
 	}
 
 	if !protocol.IsValidTopicName(body.Topic) {
-		return nil, http_api.Err{400, "INVALID_TOPIC"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
 	}
 
 	if len(body.Channel) > 0 && !protocol.IsValidChannelName(body.Channel) {
-		return nil, http_api.Err{400, "INVALID_CHANNEL"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_CHANNEL"}
 	}
 
 	err = s.ci.CreateTopicChannel(body.Topic, body.Channel,
@@ -458,7 +487,7 @@ func (s *httpServer) createTopicChannelHandler(w http.ResponseWriter, req *http.
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to create topic/channel - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -478,7 +507,7 @@ func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request
 	var messages []string
 
 	if !s.isAuthorizedAdminRequest(req) {
-		return nil, http_api.Err{403, "FORBIDDEN"}
+		return nil, http_api.Err{Code: 403, Text: "FORBIDDEN"}
 	}
 
 	topicName := ps.ByName("topic")
@@ -490,7 +519,7 @@ func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to delete topic - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -507,7 +536,7 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 	var messages []string
 
 	if !s.isAuthorizedAdminRequest(req) {
-		return nil, http_api.Err{403, "FORBIDDEN"}
+		return nil, http_api.Err{Code: 403, Text: "FORBIDDEN"}
 	}
 
 	topicName := ps.ByName("topic")
@@ -520,7 +549,7 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to delete channel - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -552,12 +581,12 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 	}
 
 	if !s.isAuthorizedAdminRequest(req) {
-		return nil, http_api.Err{403, "FORBIDDEN"}
+		return nil, http_api.Err{Code: 403, Text: "FORBIDDEN"}
 	}
 
 	err := json.NewDecoder(req.Body).Decode(&body)
 	if err != nil {
-		return nil, http_api.Err{400, err.Error()}
+		return nil, http_api.Err{Code: 400, Text: err.Error()}
 	}
 
 	switch body.Action {
@@ -604,14 +633,14 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 			s.notifyAdminAction("empty_topic", topicName, "", "", req)
 		}
 	default:
-		return nil, http_api.Err{400, "INVALID_ACTION"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_ACTION"}
 	}
 
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to %s topic/channel - %s", body.Action, err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -629,6 +658,22 @@ type counterStats struct {
 	MessageCount int64  `json:"message_count"`
 }
 
+// 返回最近的admin action, 最新的在前面
+// 返回的action 包含操作者的用户名、IP 和 User-Agent, 所以和/config 一样只对
+// --allow-config-from-cidr 内的admin 用户开放
+func (s *httpServer) adminActionsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if !s.isAuthorizedAdminRequest(req) {
+		return nil, http_api.Err{Code: 403, Text: "FORBIDDEN"}
+	}
+	if err := s.checkConfigCIDR(req); err != nil {
+		return nil, err
+	}
+
+	return struct {
+		Actions []*AdminAction `json:"actions"`
+	}{s.ctx.nsqadmin.actionLog.list()}, nil
+}
+
 func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 	stats := make(map[string]*counterStats)
@@ -638,7 +683,7 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get counter producer list - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -648,7 +693,7 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
 			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
-			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			return nil, http_api.Err{Code: 502, Text: fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
 		messages = append(messages, pe.Error())
@@ -679,17 +724,17 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
 	}
 
 	metric, err := reqParams.Get("metric")
 	if err != nil || metric != "rate" {
-		return nil, http_api.Err{400, "INVALID_ARG_METRIC"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_ARG_METRIC"}
 	}
 
 	target, err := reqParams.Get("target")
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_ARG_TARGET"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_ARG_TARGET"}
 	}
 
 	params := url.Values{}
@@ -706,10 +751,10 @@ func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, p
 		Target     string       `json:"target"`
 		DataPoints [][]*float64 `json:"datapoints"`
 	}
-	err = s.client.GETV1(url, &response)
+	err = s.graphiteClient.GETV1(s.ctx.nsqadmin.graphiteRequestURL(url), &response)
 	if err != nil {
 		s.ctx.nsqadmin.logf(LOG_ERROR, "graphite request failed - %s", err)
-		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
 	}
 
 	var rateStr string
@@ -729,23 +774,8 @@ func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, p
 func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	opt := ps.ByName("opt")
 
-	// 检查请求源IP是否有权限访问该接口，默认为127.0.0.1/8
-	allowConfigFromCIDR := s.ctx.nsqadmin.getOpts().AllowConfigFromCIDR
-	if allowConfigFromCIDR != "" {
-		_, ipnet, _ := net.ParseCIDR(allowConfigFromCIDR)
-		addr, _, err := net.SplitHostPort(req.RemoteAddr)
-		if err != nil {
-			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to parse RemoteAddr %s", req.RemoteAddr)
-			return nil, http_api.Err{400, "INVALID_REMOTE_ADDR"}
-		}
-		ip := net.ParseIP(addr)
-		if ip == nil {
-			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to parse RemoteAddr %s", req.RemoteAddr)
-			return nil, http_api.Err{400, "INVALID_REMOTE_ADDR"}
-		}
-		if !ipnet.Contains(ip) {
-			return nil, http_api.Err{403, "FORBIDDEN"}
-		}
+	if err := s.checkConfigCIDR(req); err != nil {
+		return nil, err
 	}
 
 	if req.Method == "PUT" {
@@ -754,10 +784,10 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 		readMax := int64(1024*1024 + 1)
 		body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
 		if err != nil {
-			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+			return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
 		}
 		if int64(len(body)) == readMax || len(body) == 0 {
-			return nil, http_api.Err{413, "INVALID_VALUE"}
+			return nil, http_api.Err{Code: 413, Text: "INVALID_VALUE"}
 		}
 
 		opts := *s.ctx.nsqadmin.getOpts()
@@ -765,30 +795,53 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 		case "nsqlookupd_http_addresses":
 			err := json.Unmarshal(body, &opts.NSQLookupdHTTPAddresses)
 			if err != nil {
-				return nil, http_api.Err{400, "INVALID_VALUE"}
+				return nil, http_api.Err{Code: 400, Text: "INVALID_VALUE"}
 			}
 		case "log_level":
 			logLevelStr := string(body)
 			logLevel, err := lg.ParseLogLevel(logLevelStr, opts.Verbose)
 			if err != nil {
-				return nil, http_api.Err{400, "INVALID_VALUE"}
+				return nil, http_api.Err{Code: 400, Text: "INVALID_VALUE"}
 			}
 			opts.LogLevel = logLevelStr
 			opts.logLevel = logLevel
 		default:
-			return nil, http_api.Err{400, "INVALID_OPTION"}
+			return nil, http_api.Err{Code: 400, Text: "INVALID_OPTION"}
 		}
 		s.ctx.nsqadmin.swapOpts(&opts)
 	}
 
 	v, ok := getOptByCfgName(s.ctx.nsqadmin.getOpts(), opt)
 	if !ok {
-		return nil, http_api.Err{400, "INVALID_OPTION"}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_OPTION"}
 	}
 
 	return v, nil
 }
 
+// 检查请求源IP是否有权限访问该接口，默认为127.0.0.1/8
+func (s *httpServer) checkConfigCIDR(req *http.Request) error {
+	allowConfigFromCIDR := s.ctx.nsqadmin.getOpts().AllowConfigFromCIDR
+	if allowConfigFromCIDR == "" {
+		return nil
+	}
+	_, ipnet, _ := net.ParseCIDR(allowConfigFromCIDR)
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		s.ctx.nsqadmin.logf(LOG_ERROR, "failed to parse RemoteAddr %s", req.RemoteAddr)
+		return http_api.Err{Code: 400, Text: "INVALID_REMOTE_ADDR"}
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		s.ctx.nsqadmin.logf(LOG_ERROR, "failed to parse RemoteAddr %s", req.RemoteAddr)
+		return http_api.Err{Code: 400, Text: "INVALID_REMOTE_ADDR"}
+	}
+	if !ipnet.Contains(ip) {
+		return http_api.Err{Code: 403, Text: "FORBIDDEN"}
+	}
+	return nil
+}
+
 func (s *httpServer) isAuthorizedAdminRequest(req *http.Request) bool {
 	adminUsers := s.ctx.nsqadmin.getOpts().AdminUsers
 	if len(adminUsers) == 0 {
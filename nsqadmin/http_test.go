@@ -2,17 +2,23 @@ package nsqadmin
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nsqio/nsq/internal/clusterinfo"
+	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/test"
 	"github.com/nsqio/nsq/internal/version"
 	"github.com/nsqio/nsq/nsqd"
@@ -49,8 +55,14 @@ type ChannelStatsDoc struct {
 func mustStartNSQLookupd(opts *nsqlookupd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqlookupd.NSQLookupd) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
-	lookupd := nsqlookupd.New(opts)
-	lookupd.Main()
+	lookupd, err := nsqlookupd.New(opts)
+	if err != nil {
+		panic(err)
+	}
+	err = lookupd.Main()
+	if err != nil {
+		panic(err)
+	}
 	return lookupd.RealTCPAddr(), lookupd.RealHTTPAddr(), lookupd
 }
 
@@ -66,8 +78,14 @@ func bootstrapNSQClusterWithAuth(t *testing.T, withAuth bool) (string, []*nsqd.N
 	nsqlookupdOpts.HTTPAddress = "127.0.0.1:0"
 	nsqlookupdOpts.BroadcastAddress = "127.0.0.1"
 	nsqlookupdOpts.Logger = lgr
-	nsqlookupd1 := nsqlookupd.New(nsqlookupdOpts)
-	go nsqlookupd1.Main()
+	nsqlookupd1, err := nsqlookupd.New(nsqlookupdOpts)
+	if err != nil {
+		panic(err)
+	}
+	err = nsqlookupd1.Main()
+	if err != nil {
+		panic(err)
+	}
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -92,8 +110,14 @@ func bootstrapNSQClusterWithAuth(t *testing.T, withAuth bool) (string, []*nsqd.N
 	if withAuth {
 		nsqadminOpts.AdminUsers = []string{"matt"}
 	}
-	nsqadmin1 := New(nsqadminOpts)
-	go nsqadmin1.Main()
+	nsqadmin1, err := New(nsqadminOpts)
+	if err != nil {
+		panic(err)
+	}
+	err = nsqadmin1.Main()
+	if err != nil {
+		panic(err)
+	}
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -312,6 +336,171 @@ func TestHTTPCreateTopicPOST(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestHTTPAdminActionsGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_admin_actions" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/api/topics", nsqadmin1.RealHTTPAddr())
+	body, _ := json.Marshal(map[string]interface{}{
+		"topic":   topicName,
+		"channel": "ch",
+	})
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	var doc struct {
+		Actions []AdminAction `json:"actions"`
+	}
+	client := http_api.NewClient(nil, time.Second, time.Second)
+	err = client.GETV1(fmt.Sprintf("http://%s/admin_actions", nsqadmin1.RealHTTPAddr()), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Actions))
+	// most recent first
+	test.Equal(t, "create_channel", doc.Actions[0].Action)
+	test.Equal(t, topicName, doc.Actions[0].Topic)
+	test.Equal(t, "ch", doc.Actions[0].Channel)
+	test.Equal(t, "create_topic", doc.Actions[1].Action)
+	test.Equal(t, topicName, doc.Actions[1].Topic)
+	test.NotEqual(t, int64(0), doc.Actions[1].Timestamp)
+}
+
+func TestHTTPAdminActionsAuth(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQClusterWithAuth(t, true)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	url := fmt.Sprintf("http://%s/admin_actions", nsqadmin1.RealHTTPAddr())
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 403, resp.StatusCode)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("X-Forwarded-User", "matt")
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	// nor from outside --allow-config-from-cidr
+	opts := *nsqadmin1.getOpts()
+	opts.AllowConfigFromCIDR = "10.0.0.0/8"
+	nsqadmin1.swapOpts(&opts)
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 403, resp.StatusCode)
+}
+
+func TestHTTPAdminActionNotification(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	notifications := make(chan []byte, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		notifications <- body
+	}))
+	defer endpoint.Close()
+
+	opts := *nsqadmin1.getOpts()
+	opts.NotificationHTTPEndpoint = endpoint.URL
+	nsqadmin1.swapOpts(&opts)
+
+	topicName := "test_admin_action_notification" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/api/topics", nsqadmin1.RealHTTPAddr())
+	body, _ := json.Marshal(map[string]interface{}{
+		"topic": topicName,
+	})
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req.Header.Set("X-Forwarded-User", "matt")
+	req.Header.Set("User-Agent", "nsqadmin-test")
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	var content []byte
+	select {
+	case content = <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(content, &doc)
+	test.Nil(t, err)
+	test.Equal(t, "create_topic", doc["action"])
+	test.Equal(t, topicName, doc["topic"])
+	test.Equal(t, "matt", doc["user"])
+	test.Equal(t, "nsqadmin-test", doc["user_agent"])
+	host, _, err := net.SplitHostPort(doc["remote_ip"].(string))
+	test.Nil(t, err)
+	test.Equal(t, "127.0.0.1", host)
+}
+
+func TestHTTPAdminActionNotificationConnReuse(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	var newConns int32
+	notifications := make(chan []byte, 1)
+	endpoint := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		notifications <- body
+	}))
+	endpoint.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	endpoint.Start()
+	defer endpoint.Close()
+
+	opts := *nsqadmin1.getOpts()
+	opts.NotificationHTTPEndpoint = endpoint.URL
+	nsqadmin1.swapOpts(&opts)
+
+	transport := nsqadmin1.notificationClient.Transport
+
+	topicName := "test_admin_action_conn_reuse" + strconv.Itoa(int(time.Now().Unix()))
+	for i := 0; i < 3; i++ {
+		url := fmt.Sprintf("http://%s/api/topics", nsqadmin1.RealHTTPAddr())
+		body, _ := json.Marshal(map[string]interface{}{
+			"topic": fmt.Sprintf("%s_%d", topicName, i),
+		})
+		resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+
+		select {
+		case <-notifications:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for notification")
+		}
+	}
+
+	test.Equal(t, transport, nsqadmin1.notificationClient.Transport)
+	test.Equal(t, int32(1), atomic.LoadInt32(&newConns))
+}
+
 func TestHTTPCreateTopicChannelPOST(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -591,8 +780,10 @@ func TestHTTPconfigCIDR(t *testing.T) {
 	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
 	opts.Logger = test.NewTestLogger(t)
 	opts.AllowConfigFromCIDR = "10.0.0.0/8"
-	nsqadmin := New(opts)
-	go nsqadmin.Main()
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
 	defer nsqadmin.Exit()
 
 	time.Sleep(100 * time.Millisecond)
@@ -604,3 +795,230 @@ func TestHTTPconfigCIDR(t *testing.T) {
 	_, _ = ioutil.ReadAll(resp.Body)
 	test.Equal(t, 403, resp.StatusCode)
 }
+
+func TestGraphiteProxyCache(t *testing.T) {
+	var hits int32
+	graphite := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"target":"%s","datapoints":[[1.0, 1]]}]`, req.URL.Query().Get("target"))
+	}))
+	defer graphite.Close()
+
+	opts := NewOptions()
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.Logger = test.NewTestLogger(t)
+	opts.GraphiteURL = graphite.URL
+	opts.ProxyGraphite = true
+	opts.GraphiteCacheTTL = time.Minute
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
+	defer nsqadmin.Exit()
+
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(target string) string {
+		url := fmt.Sprintf("http://%s/render?target=%s&format=json", nsqadmin.RealHTTPAddr(), target)
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		test.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	body := get("a")
+	test.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	test.Equal(t, body, get("a"))
+	test.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	get("b")
+	test.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.Logger = test.NewTestLogger(t)
+	opts.GraphiteURL = "http://graphite.example.com:8080"
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
+	defer nsqadmin.Exit()
+
+	// the headers survive gzip compression
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/topics", nsqadmin.RealHTTPAddr()), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	test.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+	test.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+	test.Equal(t, "default-src 'self'; script-src 'self' http://graphite.example.com:8080 'unsafe-inline'; "+
+		"style-src 'self' 'unsafe-inline'; img-src * data:; frame-ancestors 'none'",
+		resp.Header.Get("Content-Security-Policy"))
+
+	opts = NewOptions()
+	opts.GraphiteURL = "http://graphite.example.com:8080"
+	opts.ProxyGraphite = true
+	test.Equal(t, DefaultContentSecurityPolicy, contentSecurityPolicy(opts))
+	opts.ContentSecurityPolicy = ""
+	test.Equal(t, "", contentSecurityPolicy(opts))
+}
+
+func TestGraphiteProxyCacheEncoding(t *testing.T) {
+	var hits int32
+	graphite := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"target":"%s","auth":"%s"}]`,
+			req.URL.Query().Get("target"), req.Header.Get("Authorization"))
+	}))
+	defer graphite.Close()
+
+	opts := NewOptions()
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.Logger = test.NewTestLogger(t)
+	opts.GraphiteURL = graphite.URL
+	opts.ProxyGraphite = true
+	opts.GraphiteCacheTTL = time.Minute
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
+	defer nsqadmin.Exit()
+
+	url := fmt.Sprintf("http://%s/render?target=a&format=json", nsqadmin.RealHTTPAddr())
+	// the body isn't decoded, the transport doesn't ask for gzip itself
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(acceptEncoding string, auth string) (string, []byte) {
+		req, _ := http.NewRequest("GET", url, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Encoding"), body
+	}
+
+	plain := `[{"target":"a","auth":""}]`
+	encoding, body := get("gzip", "")
+	test.Equal(t, "gzip", encoding)
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(gr)
+	test.Equal(t, plain, string(body))
+
+	encoding, body = get("", "")
+	test.Equal(t, "", encoding)
+	test.Equal(t, plain, string(body))
+
+	encoding, body = get("deflate", "")
+	test.Equal(t, "deflate", encoding)
+	body, _ = ioutil.ReadAll(flate.NewReader(bytes.NewReader(body)))
+	test.Equal(t, plain, string(body))
+	test.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// a response fetched with credentials is only served to that caller
+	_, body = get("", "Basic dXNlcjpwYXNz")
+	test.Equal(t, `[{"target":"a","auth":"Basic dXNlcjpwYXNz"}]`, string(body))
+	test.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	_, body = get("", "")
+	test.Equal(t, plain, string(body))
+	_, body = get("", "Basic dXNlcjpwYXNz")
+	test.Equal(t, `[{"target":"a","auth":"Basic dXNlcjpwYXNz"}]`, string(body))
+	test.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestGraphiteCacheBounded(t *testing.T) {
+	var hits int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("ok"))
+	})
+	c := newGraphiteCache(handler, time.Minute, 2)
+
+	for _, target := range []string{"a", "b", "c", "c"} {
+		req, _ := http.NewRequest("GET", "/render?target="+target, nil)
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	test.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	test.Equal(t, 2, len(c.entries))
+
+	// expired entries are not served
+	c.ttl = -time.Second
+	req, _ := http.NewRequest("GET", "/render?target=d", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+	test.Equal(t, int32(5), atomic.LoadInt32(&hits))
+}
+
+func TestGraphiteProxyTLSAuth(t *testing.T) {
+	var hits int32
+	graphite := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "graphite" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`[{"target":"a","datapoints":[[120.0, 1]]}]`))
+	}))
+	defer graphite.Close()
+
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	caFile := tmpDir + "/ca.pem"
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: graphite.TLS.Certificates[0].Certificate[0]})
+	err = ioutil.WriteFile(caFile, caPEM, 0644)
+	test.Nil(t, err)
+
+	opts := NewOptions()
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.Logger = test.NewTestLogger(t)
+	opts.GraphiteURL = graphite.URL
+	opts.ProxyGraphite = true
+	opts.GraphiteTLSRootCAFile = caFile
+	opts.GraphiteUsername = "graphite"
+	opts.GraphitePassword = "secret"
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
+	defer nsqadmin.Exit()
+
+	time.Sleep(100 * time.Millisecond)
+
+	url := fmt.Sprintf("http://%s/render?target=a&format=json", nsqadmin.RealHTTPAddr())
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	url = fmt.Sprintf("http://%s/api/graphite?metric=rate&target=a", nsqadmin.RealHTTPAddr())
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"rate":"2.00"}`, string(body))
+	test.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,116 @@
+package nsqadmin
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// how long a new connection has to send its first byte
+const httpsHandshakeTimeout = 10 * time.Second
+
+// httpsListener serves TLS on a listener, plaintext HTTP requests sent to it
+// are redirected to https instead of failing the TLS handshake.
+//
+// Connections are classified by their first byte (a TLS record starts with
+// 0x16) in their own goroutine, so that a slow client doesn't hold up Accept.
+type httpsListener struct {
+	net.Listener
+	config *tls.Config
+	logf   lg.AppLogFunc
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error // why the listener stopped, set before done is closed
+}
+
+func newHTTPSListener(l net.Listener, config *tls.Config, logf lg.AppLogFunc) *httpsListener {
+	hl := &httpsListener{
+		Listener: l,
+		config:   config,
+		logf:     logf,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go hl.acceptLoop()
+	return hl
+}
+
+func (l *httpsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *httpsListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.classify(conn)
+	}
+}
+
+func (l *httpsListener) classify(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(httpsHandshakeTimeout))
+	b, err := br.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if b[0] != 0x16 {
+		l.redirect(conn, br)
+		return
+	}
+
+	tlsConn := tls.Server(&bufferedConn{conn, br}, l.config)
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// redirect answers a plaintext HTTP request with a redirect to the same URL
+// over https
+func (l *httpsListener) redirect(conn net.Conn, br *bufio.Reader) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(httpsHandshakeTimeout))
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Host == "" {
+		fmt.Fprint(conn, "HTTP/1.0 400 Bad Request\r\n\r\nClient sent an HTTP request to an HTTPS server.\n")
+		return
+	}
+	location := "https://" + req.Host + req.URL.RequestURI()
+	l.logf(LOG_DEBUG, "redirecting plaintext request from %s to %s", conn.RemoteAddr(), location)
+	fmt.Fprintf(conn, "HTTP/1.1 301 Moved Permanently\r\nLocation: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", location)
+}
+
+// bufferedConn reads through the bufio.Reader that was used to peek at the
+// start of the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -38,10 +38,18 @@ func basicAuthUser(req *http.Request) string {
 	return pair[0]
 }
 
-func (s *httpServer) notifyAdminAction(action, topic, channel, node string, req *http.Request) {
-	if s.ctx.nsqadmin.getOpts().NotificationHTTPEndpoint == "" {
-		return
+// 优先使用--acl-http-header 指定的header (与isAuthorizedAdminRequest 一致),
+// 没有时退回到basic auth 的用户名
+func (s *httpServer) requestUser(req *http.Request) string {
+	if user := req.Header.Get(s.ctx.nsqadmin.getOpts().AclHttpHeader); user != "" {
+		return user
 	}
+	return basicAuthUser(req)
+}
+
+// 每个action 都会记录到actionLog (GET /admin_actions), 配置了
+// --notification-http-endpoint 时还会POST 到该地址
+func (s *httpServer) notifyAdminAction(action, topic, channel, node string, req *http.Request) {
 	via, _ := os.Hostname()
 
 	u := url.URL{
@@ -60,12 +68,16 @@ func (s *httpServer) notifyAdminAction(action, topic, channel, node string, req
 		Channel:   channel,
 		Node:      node,
 		Timestamp: time.Now().Unix(),
-		User:      basicAuthUser(req),
+		User:      s.requestUser(req),
 		RemoteIP:  req.RemoteAddr,
 		UserAgent: req.UserAgent(),
 		URL:       u.String(),
 		Via:       via,
 	}
-	// Perform all work in a new goroutine so this never blocks
-	go func() { s.ctx.nsqadmin.notifications <- a }()
+	s.ctx.nsqadmin.actionLog.add(a)
+
+	if s.ctx.nsqadmin.getOpts().NotificationHTTPEndpoint == "" {
+		return
+	}
+	s.ctx.nsqadmin.notify(a)
 }
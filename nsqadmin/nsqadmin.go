@@ -5,6 +5,8 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
@@ -13,6 +15,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/lg"
@@ -20,6 +23,9 @@ import (
 	"github.com/nsqio/nsq/internal/version"
 )
 
+// how long Exit waits for queued admin action notifications to be sent
+const notificationDrainTimeout = 5 * time.Second
+
 type NSQAdmin struct {
 	sync.RWMutex
 
@@ -29,19 +35,37 @@ type NSQAdmin struct {
 	httpListener        net.Listener
 	waitGroup           util.WaitGroupWrapper
 	notifications       chan *AdminAction
+	actionLog           *actionLog
 	graphiteURL         *url.URL
 	httpClientTLSConfig *tls.Config
+	graphiteTLSConfig   *tls.Config
+	httpsTLSConfig      *tls.Config
+
+	// 对外的HTTP 请求复用这些transport/client, 以复用空闲连接
+	httpClientTransport *http.Transport
+	graphiteTransport   *http.Transport
+	notificationClient  *http.Client
+	dnsCache            *dnsCache
+
+	// 退出时先停止新的通知入队(exiting), 等待已入队的通知被接收,
+	// 超时后关闭exitChan 放弃剩下的
+	notifyLock sync.RWMutex
+	exiting    bool
+	notifyWG   sync.WaitGroup
+	exitChan   chan struct{}
 }
 
 // 调用该方法之前，需要先New一个Options, opt := NewOptions()
 // 这个函数就是配置好nsqadmin的运行环境
-func New(opts *Options) *NSQAdmin {
+func New(opts *Options) (*NSQAdmin, error) {
 	if opts.Logger == nil {
 		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
 	}
 
 	n := &NSQAdmin{
 		notifications: make(chan *AdminAction),
+		actionLog:     newActionLog(opts.AdminActionLogSize),
+		exitChan:      make(chan struct{}),
 	}
 	//这里是把Options 的配置信息储存到n.opts中
 	n.swapOpts(opts)
@@ -51,98 +75,167 @@ func New(opts *Options) *NSQAdmin {
 	// LogLevel是日志级别的string, logLevel是封装过的int,内部使用的，注意大小写,不要以为是同一个
 	opts.logLevel, err = lg.ParseLogLevel(opts.LogLevel, opts.Verbose)
 	if err != nil {
-		n.logf(LOG_FATAL, "%s", err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	// nsqd 不能与lookupd地址同时指定
 	if len(opts.NSQDHTTPAddresses) == 0 && len(opts.NSQLookupdHTTPAddresses) == 0 {
-		n.logf(LOG_FATAL, "--nsqd-http-address or --lookupd-http-address required.")
-		os.Exit(1)
+		return nil, errors.New("--nsqd-http-address or --lookupd-http-address required")
 	}
 
 	if len(opts.NSQDHTTPAddresses) != 0 && len(opts.NSQLookupdHTTPAddresses) != 0 {
-		n.logf(LOG_FATAL, "use --nsqd-http-address or --lookupd-http-address not both")
-		os.Exit(1)
+		return nil, errors.New("use --nsqd-http-address or --lookupd-http-address not both")
 	}
 
 	// verify that the supplied address is valid
-	verifyAddress := func(arg string, address string) *net.TCPAddr {
-		addr, err := net.ResolveTCPAddr("tcp", address)
+	verifyAddress := func(arg string, address string) error {
+		_, err := net.ResolveTCPAddr("tcp", address)
 		if err != nil {
-			n.logf(LOG_FATAL, "failed to resolve %s address (%s) - %s", arg, address, err)
-			os.Exit(1)
+			return fmt.Errorf("failed to resolve %s address (%s) - %s", arg, address, err)
 		}
-		return addr
+		return nil
 	}
 
 	// 如果指定了https证书，使用它们
 	if opts.HTTPClientTLSCert != "" && opts.HTTPClientTLSKey == "" {
-		n.logf(LOG_FATAL, "--http-client-tls-key must be specified with --http-client-tls-cert")
-		os.Exit(1)
+		return nil, errors.New("--http-client-tls-key must be specified with --http-client-tls-cert")
 	}
 
 	if opts.HTTPClientTLSKey != "" && opts.HTTPClientTLSCert == "" {
-		n.logf(LOG_FATAL, "--http-client-tls-cert must be specified with --http-client-tls-key")
-		os.Exit(1)
+		return nil, errors.New("--http-client-tls-cert must be specified with --http-client-tls-key")
 	}
 
-	n.httpClientTLSConfig = &tls.Config{
-		InsecureSkipVerify: opts.HTTPClientTLSInsecureSkipVerify,
+	n.httpClientTLSConfig, err = buildTLSConfig(opts.HTTPClientTLSInsecureSkipVerify,
+		opts.HTTPClientTLSCert, opts.HTTPClientTLSKey, opts.HTTPClientTLSRootCAFile)
+	if err != nil {
+		return nil, err
 	}
-	if opts.HTTPClientTLSCert != "" && opts.HTTPClientTLSKey != "" {
-		cert, err := tls.LoadX509KeyPair(opts.HTTPClientTLSCert, opts.HTTPClientTLSKey)
+
+	// 配置了--tls-cert/--tls-key 时nsqadmin 自身通过HTTPS 提供服务
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		if opts.TLSCert == "" || opts.TLSKey == "" {
+			return nil, errors.New("--tls-cert and --tls-key must be specified together")
+		}
+		n.httpsTLSConfig, err = buildTLSConfig(false, opts.TLSCert, opts.TLSKey, "")
 		if err != nil {
-			n.logf(LOG_FATAL, "failed to LoadX509KeyPair %s, %s - %s",
-				opts.HTTPClientTLSCert, opts.HTTPClientTLSKey, err)
-			os.Exit(1)
+			return nil, err
 		}
-		n.httpClientTLSConfig.Certificates = []tls.Certificate{cert}
 	}
-	if opts.HTTPClientTLSRootCAFile != "" {
-		tlsCertPool := x509.NewCertPool()
-		caCertFile, err := ioutil.ReadFile(opts.HTTPClientTLSRootCAFile)
+
+	// graphite 可以单独配置TLS证书，没有配置时使用上面的http client 配置
+	if opts.GraphiteTLSCert != "" && opts.GraphiteTLSKey == "" {
+		return nil, errors.New("--graphite-tls-key must be specified with --graphite-tls-cert")
+	}
+
+	if opts.GraphiteTLSKey != "" && opts.GraphiteTLSCert == "" {
+		return nil, errors.New("--graphite-tls-cert must be specified with --graphite-tls-key")
+	}
+
+	n.graphiteTLSConfig = n.httpClientTLSConfig
+	if opts.GraphiteTLSCert != "" || opts.GraphiteTLSRootCAFile != "" {
+		n.graphiteTLSConfig, err = buildTLSConfig(opts.HTTPClientTLSInsecureSkipVerify,
+			opts.GraphiteTLSCert, opts.GraphiteTLSKey, opts.GraphiteTLSRootCAFile)
 		if err != nil {
-			n.logf(LOG_FATAL, "failed to read TLS root CA file %s - %s",
-				opts.HTTPClientTLSRootCAFile, err)
-			os.Exit(1)
+			return nil, err
 		}
-		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
-			n.logf(LOG_FATAL, "failed to AppendCertsFromPEM %s", opts.HTTPClientTLSRootCAFile)
-			os.Exit(1)
-		}
-		n.httpClientTLSConfig.RootCAs = tlsCertPool
+	}
+
+	if opts.DNSCacheTTL > 0 {
+		n.dnsCache = newDNSCache(opts.DNSCacheTTL)
+	}
+	n.httpClientTransport = n.newTransport(n.httpClientTLSConfig)
+	n.graphiteTransport = n.newTransport(n.graphiteTLSConfig)
+	n.notificationClient = &http.Client{
+		Transport: n.newTransport(nil),
 	}
 
 	// require that both the hostname and port be specified
 	for _, address := range opts.NSQLookupdHTTPAddresses {
-		verifyAddress("--lookupd-http-address", address)
+		if err := verifyAddress("--lookupd-http-address", address); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, address := range opts.NSQDHTTPAddresses {
-		verifyAddress("--nsqd-http-address", address)
+		if err := verifyAddress("--nsqd-http-address", address); err != nil {
+			return nil, err
+		}
 	}
 
 	if opts.ProxyGraphite {
-		url, err := url.Parse(opts.GraphiteURL)
+		u, err := url.Parse(opts.GraphiteURL)
 		if err != nil {
-			n.logf(LOG_FATAL, "failed to parse --graphite-url='%s' - %s", opts.GraphiteURL, err)
-			os.Exit(1)
+			return nil, fmt.Errorf("failed to parse --graphite-url='%s' - %s", opts.GraphiteURL, err)
 		}
-		n.graphiteURL = url
+		if opts.GraphiteUsername != "" {
+			u.User = url.UserPassword(opts.GraphiteUsername, opts.GraphitePassword)
+		}
+		n.graphiteURL = u
 	}
 
 	if opts.AllowConfigFromCIDR != "" {
 		_, _, err := net.ParseCIDR(opts.AllowConfigFromCIDR)
 		if err != nil {
-			n.logf(LOG_FATAL, "failed to parse --allow-config-from-cidr='%s' - %s", opts.AllowConfigFromCIDR, err)
-			os.Exit(1)
+			return nil, fmt.Errorf("failed to parse --allow-config-from-cidr='%s' - %s", opts.AllowConfigFromCIDR, err)
 		}
 	}
 
 	n.logf(LOG_INFO, version.String("nsqadmin"))
 
-	return n
+	return n, nil
+}
+
+func buildTLSConfig(insecureSkipVerify bool, certFile string, keyFile string, rootCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to LoadX509KeyPair %s, %s - %s", certFile, keyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if rootCAFile != "" {
+		tlsCertPool := x509.NewCertPool()
+		caCertFile, err := ioutil.ReadFile(rootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS root CA file %s - %s", rootCAFile, err)
+		}
+		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+			return nil, fmt.Errorf("failed to AppendCertsFromPEM %s", rootCAFile)
+		}
+		tlsConfig.RootCAs = tlsCertPool
+	}
+	return tlsConfig, nil
+}
+
+// graphiteRequestURL adds the configured graphite credentials to rawurl
+func (n *NSQAdmin) graphiteRequestURL(rawurl string) string {
+	opts := n.getOpts()
+	if opts.GraphiteUsername == "" {
+		return rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	u.User = url.UserPassword(opts.GraphiteUsername, opts.GraphitePassword)
+	return u.String()
+}
+
+// newTransport returns a deadline transport limited to the configured
+// number of idle connections, dialing through the DNS cache if enabled
+func (n *NSQAdmin) newTransport(tlsConfig *tls.Config) *http.Transport {
+	opts := n.getOpts()
+	transport := http_api.NewDeadlineTransport(opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConns = opts.HTTPClientMaxIdleConns
+	transport.IdleConnTimeout = opts.HTTPClientIdleConnTimeout
+	if n.dnsCache != nil {
+		transport.DialContext = n.dnsCache.dialContext(transport.DialContext)
+	}
+	return transport
 }
 
 func (n *NSQAdmin) getOpts() *Options {
@@ -167,29 +260,49 @@ func (n *NSQAdmin) handleAdminActions() {
 		content, err := json.Marshal(action)
 		if err != nil {
 			n.logf(LOG_ERROR, "failed to serialize admin action - %s", err)
-		}
-		httpclient := &http.Client{
-			Transport: http_api.NewDeadlineTransport(n.getOpts().HTTPClientConnectTimeout, n.getOpts().HTTPClientRequestTimeout),
+			continue
 		}
 		n.logf(LOG_INFO, "POSTing notification to %s", n.getOpts().NotificationHTTPEndpoint)
-		resp, err := httpclient.Post(n.getOpts().NotificationHTTPEndpoint,
+		resp, err := n.notificationClient.Post(n.getOpts().NotificationHTTPEndpoint,
 			"application/json", bytes.NewBuffer(content))
 		if err != nil {
 			n.logf(LOG_ERROR, "failed to POST notification - %s", err)
+			continue
 		}
 		resp.Body.Close()
 	}
 }
 
+// notify queues a for handleAdminActions without blocking the caller,
+// it is dropped once Exit has started
+func (n *NSQAdmin) notify(a *AdminAction) {
+	n.notifyLock.RLock()
+	defer n.notifyLock.RUnlock()
+	if n.exiting {
+		return
+	}
+	n.notifyWG.Add(1)
+	go func() {
+		defer n.notifyWG.Done()
+		select {
+		case n.notifications <- a:
+		case <-n.exitChan:
+		}
+	}()
+}
+
 // 首先开启监听tcp端口，然后把获得的socket给Serve,
 // 当然，Serve还需要hander和接口路由等信息，在NewHTTPServer中获取。Serve是对http包的Server封装了一层, 所以至此服务起来了
 // handle 使用了Gorilla的压缩代码，对内容执行压缩
 // 至于handleAdminActions,就是等待httpServer中的handlers推送消息到chan中，然后handleAdminActions 把相关消息推送到启动服务时注册的notification-http-endpoint中
-func (n *NSQAdmin) Main() {
+func (n *NSQAdmin) Main() error {
+	var httpListener net.Listener
 	httpListener, err := net.Listen("tcp", n.getOpts().HTTPAddress)
 	if err != nil {
-		n.logf(LOG_FATAL, "listen (%s) failed - %s", n.getOpts().HTTPAddress, err)
-		os.Exit(1)
+		return fmt.Errorf("listen (%s) failed - %s", n.getOpts().HTTPAddress, err)
+	}
+	if n.httpsTLSConfig != nil {
+		httpListener = newHTTPSListener(httpListener, n.httpsTLSConfig, n.logf)
 	}
 	n.Lock()
 	n.httpListener = httpListener
@@ -199,10 +312,32 @@ func (n *NSQAdmin) Main() {
 		http_api.Serve(n.httpListener, http_api.CompressHandler(httpServer), "HTTP", n.logf)
 	})
 	n.waitGroup.Wrap(func() { n.handleAdminActions() })
+	return nil
 }
 
+// Exit stops accepting notifications and waits up to
+// notificationDrainTimeout for the queued ones to be sent before closing
+// the notifications channel, so that no handler can send on it once closed
 func (n *NSQAdmin) Exit() {
 	n.httpListener.Close()
+
+	n.notifyLock.Lock()
+	n.exiting = true
+	n.notifyLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.notifyWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(notificationDrainTimeout):
+		n.logf(LOG_WARN, "notifications not sent within %s, dropping them", notificationDrainTimeout)
+	}
+	close(n.exitChan)
+	<-done
 	close(n.notifications)
+
 	n.waitGroup.Wait()
 }
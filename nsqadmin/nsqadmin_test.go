@@ -1,14 +1,18 @@
 package nsqadmin
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
-	"os/exec"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/test"
@@ -16,41 +20,23 @@ import (
 )
 
 func TestNeitherNSQDAndNSQLookup(t *testing.T) {
-	if os.Getenv("BE_CRASHER") == "1" {
-		opts := NewOptions()
-		opts.Logger = lg.NilLogger{}
-		opts.HTTPAddress = "127.0.0.1:0"
-		New(opts)
-		return
-	}
-	cmd := exec.Command(os.Args[0], "-test.run=TestNeitherNSQDAndNSQLookup")
-	cmd.Env = append(os.Environ(), "BE_CRASHER=1")
-	err := cmd.Run()
-	test.Equal(t, "exit status 1", fmt.Sprintf("%v", err))
-	if e, ok := err.(*exec.ExitError); ok && !e.Success() {
-		return
-	}
-	t.Fatalf("process ran with err %v, want exit status 1", err)
+	opts := NewOptions()
+	opts.Logger = lg.NilLogger{}
+	opts.HTTPAddress = "127.0.0.1:0"
+	_, err := New(opts)
+	test.NotNil(t, err)
+	test.Equal(t, "--nsqd-http-address or --lookupd-http-address required", err.Error())
 }
 
 func TestBothNSQDAndNSQLookup(t *testing.T) {
-	if os.Getenv("BE_CRASHER") == "1" {
-		opts := NewOptions()
-		opts.Logger = lg.NilLogger{}
-		opts.HTTPAddress = "127.0.0.1:0"
-		opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
-		opts.NSQDHTTPAddresses = []string{"127.0.0.1:4151"}
-		New(opts)
-		return
-	}
-	cmd := exec.Command(os.Args[0], "-test.run=TestBothNSQDAndNSQLookup")
-	cmd.Env = append(os.Environ(), "BE_CRASHER=1")
-	err := cmd.Run()
-	test.Equal(t, "exit status 1", fmt.Sprintf("%v", err))
-	if e, ok := err.(*exec.ExitError); ok && !e.Success() {
-		return
-	}
-	t.Fatalf("process ran with err %v, want exit status 1", err)
+	opts := NewOptions()
+	opts.Logger = lg.NilLogger{}
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.NSQDHTTPAddresses = []string{"127.0.0.1:4151"}
+	_, err := New(opts)
+	test.NotNil(t, err)
+	test.Equal(t, "use --nsqd-http-address or --lookupd-http-address not both", err.Error())
 }
 
 func TestTLSHTTPClient(t *testing.T) {
@@ -73,8 +59,10 @@ func TestTLSHTTPClient(t *testing.T) {
 	opts.HTTPClientTLSCert = "./test/client.pem"
 	opts.HTTPClientTLSKey = "./test/client.key"
 	opts.Logger = lgr
-	nsqadmin := New(opts)
-	nsqadmin.Main()
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
 	defer nsqadmin.Exit()
 
 	httpAddr := nsqadmin.RealHTTPAddr()
@@ -91,6 +79,55 @@ func TestTLSHTTPClient(t *testing.T) {
 	test.Equal(t, resp.StatusCode < 500, true)
 }
 
+func TestHTTPSServer(t *testing.T) {
+	opts := NewOptions()
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.TLSCert = "./test/server.pem"
+	opts.TLSKey = "./test/server.key"
+	opts.Logger = test.NewTestLogger(t)
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
+	defer nsqadmin.Exit()
+
+	httpAddr := nsqadmin.RealHTTPAddr().String()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get("https://" + httpAddr + "/ping")
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, []byte("OK"), body)
+	test.NotNil(t, resp.TLS)
+
+	resp, err = client.Get("http://" + httpAddr + "/ping?x=1")
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 301, resp.StatusCode)
+	test.Equal(t, "https://"+httpAddr+"/ping?x=1", resp.Header.Get("Location"))
+}
+
+func TestHTTPSServerCertWithoutKey(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = lg.NilLogger{}
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.TLSCert = "./test/server.pem"
+	_, err := New(opts)
+	test.NotNil(t, err)
+	test.Equal(t, "--tls-cert and --tls-key must be specified together", err.Error())
+}
+
 func mustStartNSQD(opts *nsqd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqd.NSQD) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
@@ -107,20 +144,161 @@ func mustStartNSQD(opts *nsqd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqd.NSQD)
 	return nsqd.RealTCPAddr(), nsqd.RealHTTPAddr(), nsqd
 }
 
-func TestCrashingLogger(t *testing.T) {
-	if os.Getenv("BE_CRASHER") == "1" {
-		// Test invalid log level causes error
-		opts := NewOptions()
-		opts.LogLevel = "bad"
-		opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
-		_ = New(opts)
-		return
+func TestInvalidLogLevel(t *testing.T) {
+	opts := NewOptions()
+	opts.LogLevel = "bad"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	_, err := New(opts)
+	test.NotNil(t, err)
+}
+
+func TestListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+
+	opts := NewOptions()
+	opts.Logger = lg.NilLogger{}
+	opts.HTTPAddress = listener.Addr().String()
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.NotNil(t, err)
+}
+
+func TestExitWithNotifications(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+
+	opts := NewOptions()
+	opts.Logger = lg.NilLogger{}
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	opts.NotificationHTTPEndpoint = endpoint.URL
+	nsqadmin, err := New(opts)
+	test.Nil(t, err)
+	err = nsqadmin.Main()
+	test.Nil(t, err)
+
+	// actions keep being performed while exiting
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				nsqadmin.notify(&AdminAction{Action: "create_topic", Topic: "exit"})
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	nsqadmin.Exit()
+	close(stop)
+	wg.Wait()
+
+	// and after
+	nsqadmin.notify(&AdminAction{Action: "create_topic", Topic: "exit"})
+}
+
+func TestActionLog(t *testing.T) {
+	l := newActionLog(3)
+	test.Equal(t, 0, len(l.list()))
+
+	for i := 1; i <= 2; i++ {
+		l.add(&AdminAction{Timestamp: int64(i)})
+	}
+	actions := l.list()
+	test.Equal(t, 2, len(actions))
+	test.Equal(t, int64(2), actions[0].Timestamp)
+	test.Equal(t, int64(1), actions[1].Timestamp)
+
+	// the oldest are overwritten
+	for i := 3; i <= 5; i++ {
+		l.add(&AdminAction{Timestamp: int64(i)})
 	}
-	cmd := exec.Command(os.Args[0], "-test.run=TestCrashingLogger")
-	cmd.Env = append(os.Environ(), "BE_CRASHER=1")
-	err := cmd.Run()
-	if e, ok := err.(*exec.ExitError); ok && !e.Success() {
-		return
+	actions = l.list()
+	test.Equal(t, 3, len(actions))
+	test.Equal(t, int64(5), actions[0].Timestamp)
+	test.Equal(t, int64(4), actions[1].Timestamp)
+	test.Equal(t, int64(3), actions[2].Timestamp)
+
+	l = newActionLog(0)
+	l.add(&AdminAction{})
+	test.Equal(t, 0, len(l.list()))
+}
+
+func TestDNSCache(t *testing.T) {
+	var lookups int
+	c := newDNSCache(50 * time.Millisecond)
+	c.lookupHost = func(host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, nil
 	}
-	t.Fatalf("process ran with err %v, want exit status 1", err)
+
+	for i := 0; i < 3; i++ {
+		addrs, _, err := c.resolve("nsqlookupd.local")
+		test.Nil(t, err)
+		test.Equal(t, []string{"127.0.0.1"}, addrs)
+	}
+	test.Equal(t, 1, lookups)
+	hits, misses := c.stats()
+	test.Equal(t, int64(2), hits)
+	test.Equal(t, int64(1), misses)
+
+	// IP literals aren't looked up
+	_, _, err := c.resolve("10.0.0.1")
+	test.Nil(t, err)
+	test.Equal(t, 1, lookups)
+
+	time.Sleep(60 * time.Millisecond)
+	_, cached, err := c.resolve("nsqlookupd.local")
+	test.Nil(t, err)
+	test.Equal(t, false, cached)
+	test.Equal(t, 2, lookups)
+}
+
+func TestDNSCacheReresolve(t *testing.T) {
+	var lookups int
+	c := newDNSCache(time.Minute)
+	c.lookupHost = func(host string) ([]string, error) {
+		lookups++
+		if lookups == 1 {
+			return []string{"10.0.0.1"}, nil
+		}
+		return []string{"10.0.0.2"}, nil
+	}
+
+	var dialed []string
+	dial := c.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.1:4161" && len(dialed) > 1 {
+			return nil, errors.New("connection refused")
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+
+	conn, err := dial(context.Background(), "tcp", "nsqlookupd.local:4161")
+	test.Nil(t, err)
+	conn.Close()
+	test.Equal(t, 1, lookups)
+
+	// the cached address fails, the host is resolved again
+	conn, err = dial(context.Background(), "tcp", "nsqlookupd.local:4161")
+	test.Nil(t, err)
+	conn.Close()
+	test.Equal(t, 2, lookups)
+	test.Equal(t, []string{"10.0.0.1:4161", "10.0.0.1:4161", "10.0.0.2:4161"}, dialed)
+
+	conn, err = dial(context.Background(), "tcp", "nsqlookupd.local:4161")
+	test.Nil(t, err)
+	conn.Close()
+	test.Equal(t, 2, lookups)
 }
@@ -15,9 +15,23 @@ type Options struct {
 
 	HTTPAddress string `flag:"http-address"`
 
+	// when set the UI/API is served over TLS, plaintext requests are
+	// redirected to https
+	TLSCert string `flag:"tls-cert"`
+	TLSKey  string `flag:"tls-key"`
+
 	GraphiteURL   string `flag:"graphite-url"`
 	ProxyGraphite bool   `flag:"proxy-graphite"`
 
+	GraphiteCacheTTL  time.Duration `flag:"graphite-cache-ttl"`
+	GraphiteCacheSize int           `flag:"graphite-cache-size"`
+
+	GraphiteTLSRootCAFile string `flag:"graphite-tls-root-ca-file"`
+	GraphiteTLSCert       string `flag:"graphite-tls-cert"`
+	GraphiteTLSKey        string `flag:"graphite-tls-key"`
+	GraphiteUsername      string `flag:"graphite-username"`
+	GraphitePassword      string `flag:"graphite-password"`
+
 	StatsdPrefix        string `flag:"statsd-prefix"`
 	StatsdCounterFormat string `flag:"statsd-counter-format"`
 	StatsdGaugeFormat   string `flag:"statsd-gauge-format"`
@@ -30,6 +44,14 @@ type Options struct {
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout"`
 
+	// limits of the idle connection pool shared by all outbound HTTP requests
+	HTTPClientMaxIdleConns    int           `flag:"http-client-max-idle-conns"`
+	HTTPClientIdleConnTimeout time.Duration `flag:"http-client-idle-conn-timeout"`
+
+	// how long the addresses of nsqlookupd/nsqd hosts are cached for
+	// outbound HTTP requests, 0 resolves them on every new connection
+	DNSCacheTTL time.Duration `flag:"dns-cache-ttl"`
+
 	HTTPClientTLSInsecureSkipVerify bool   `flag:"http-client-tls-insecure-skip-verify"`
 	HTTPClientTLSRootCAFile         string `flag:"http-client-tls-root-ca-file"`
 	HTTPClientTLSCert               string `flag:"http-client-tls-cert"`
@@ -39,23 +61,44 @@ type Options struct {
 
 	NotificationHTTPEndpoint string `flag:"notification-http-endpoint"`
 
+	// how many of the most recent admin actions GET /admin_actions returns
+	AdminActionLogSize int `flag:"admin-action-log-size"`
+
 	AclHttpHeader string   `flag:"acl-http-header"`
 	AdminUsers    []string `flag:"admin-user" cfg:"admin_users"`
+
+	// security headers set on responses (an empty value isn't set),
+	// X-Content-Type-Options is always nosniff
+	ContentSecurityPolicy string `flag:"content-security-policy"`
+	XFrameOptions         string `flag:"x-frame-options"`
 }
 
+// DefaultContentSecurityPolicy only allows the UI's own scripts and styles
+// (and the inline script index.html is configured with). Images may come
+// from anywhere as graphite graphs are loaded from --graphite-url unless
+// --proxy-graphite is set, its scripts (JSONP) are allowed at runtime.
+const DefaultContentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline'; img-src * data:; frame-ancestors 'none'"
+
 func NewOptions() *Options {
 	return &Options{
-		LogPrefix:                "[nsqadmin] ",
-		LogLevel:                 "info",
-		HTTPAddress:              "0.0.0.0:4171",
-		StatsdPrefix:             "nsq.%s",
-		StatsdCounterFormat:      "stats.counters.%s.count",
-		StatsdGaugeFormat:        "stats.gauges.%s",
-		StatsdInterval:           60 * time.Second,
-		HTTPClientConnectTimeout: 2 * time.Second,
-		HTTPClientRequestTimeout: 5 * time.Second,
-		AllowConfigFromCIDR:      "127.0.0.1/8",
-		AclHttpHeader:            "X-Forwarded-User",
-		AdminUsers:               []string{},
+		LogPrefix:                 "[nsqadmin] ",
+		LogLevel:                  "info",
+		HTTPAddress:               "0.0.0.0:4171",
+		GraphiteCacheSize:         1000,
+		StatsdPrefix:              "nsq.%s",
+		StatsdCounterFormat:       "stats.counters.%s.count",
+		StatsdGaugeFormat:         "stats.gauges.%s",
+		StatsdInterval:            60 * time.Second,
+		HTTPClientConnectTimeout:  2 * time.Second,
+		HTTPClientRequestTimeout:  5 * time.Second,
+		HTTPClientMaxIdleConns:    100,
+		HTTPClientIdleConnTimeout: 90 * time.Second,
+		AllowConfigFromCIDR:       "127.0.0.1/8",
+		AdminActionLogSize:        100,
+		AclHttpHeader:             "X-Forwarded-User",
+		AdminUsers:                []string{},
+		ContentSecurityPolicy:     DefaultContentSecurityPolicy,
+		XFrameOptions:             "DENY",
 	}
 }
@@ -343,8 +343,14 @@ func TestPauseMetadata(t *testing.T) {
 func mustStartNSQLookupd(opts *nsqlookupd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqlookupd.NSQLookupd) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
-	lookupd := nsqlookupd.New(opts)
-	lookupd.Main()
+	lookupd, err := nsqlookupd.New(opts)
+	if err != nil {
+		panic(err)
+	}
+	err = lookupd.Main()
+	if err != nil {
+		panic(err)
+	}
 	return lookupd.RealTCPAddr(), lookupd.RealHTTPAddr(), lookupd
 }
 
@@ -0,0 +1,82 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// broadcastAddressChecker rejects the broadcast addresses producers
+// IDENTIFY with that consumers can't connect to: loopback, unspecified
+// and link-local IPs (and "localhost"). Hostnames aren't resolved.
+type broadcastAddressChecker struct {
+	allow *net.IPNet // accepted even if it would be rejected
+	deny  *net.IPNet // rejected as well
+}
+
+func newBroadcastAddressChecker(allowCIDR string, denyCIDR string) (*broadcastAddressChecker, error) {
+	c := &broadcastAddressChecker{}
+	var err error
+	if allowCIDR != "" {
+		_, c.allow, err = net.ParseCIDR(allowCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --broadcast-address-allow-cidr='%s' - %s", allowCIDR, err)
+		}
+	}
+	if denyCIDR != "" {
+		_, c.deny, err = net.ParseCIDR(denyCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --broadcast-address-deny-cidr='%s' - %s", denyCIDR, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *broadcastAddressChecker) check(addr string) error {
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if !strings.EqualFold(host, "localhost") {
+			return nil
+		}
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+
+	if c.allow != nil && c.allow.Contains(ip) {
+		return nil
+	}
+	switch {
+	case c.deny != nil && c.deny.Contains(ip):
+		return fmt.Errorf("broadcast_address %q is denied", addr)
+	case ip.IsUnspecified():
+		return fmt.Errorf("broadcast_address %q is unspecified", addr)
+	case ip.IsLoopback():
+		return fmt.Errorf("broadcast_address %q is a loopback address", addr)
+	case ip.IsLinkLocalUnicast():
+		return fmt.Errorf("broadcast_address %q is a link-local address", addr)
+	}
+	return nil
+}
+
+// checkBroadcastAddress checks the broadcast address of peerInfo, which
+// IDENTIFY on client, per --broadcast-address-check: a rejected address
+// is an error or, with "replace", is replaced by the IP client connected
+// from (which must pass the check)
+func (p *LookupProtocolV1) checkBroadcastAddress(client *ClientV1, peerInfo *PeerInfo) error {
+	checker := p.ctx.nsqlookupd.broadcastChecker
+	if checker == nil {
+		return nil
+	}
+	err := checker.check(peerInfo.BroadcastAddress)
+	if err == nil || p.ctx.nsqlookupd.getOpts().BroadcastAddressCheck != "replace" {
+		return err
+	}
+
+	ip := remoteIP(client)
+	if checker.check(ip) != nil {
+		return err
+	}
+	p.ctx.nsqlookupd.logf(LOG_WARN, "CLIENT(%s): IDENTIFY %s, using %s", client, err, ip)
+	peerInfo.BroadcastAddress = ip
+	return nil
+}
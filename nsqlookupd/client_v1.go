@@ -1,12 +1,25 @@
 package nsqlookupd
 
 import (
+	"crypto/tls"
 	"net"
 )
 
 type ClientV1 struct {
 	net.Conn
 	peerInfo *PeerInfo
+
+	// unique for the lifetime of the process, correlates the log lines of
+	// a connection
+	id int64
+
+	// set when the TCP listener is a TLS listener (see Options.TCPListener),
+	// tlsCommonName is the CN of the client certificate, if one was sent
+	tls           bool
+	tlsCommonName string
+
+	// limits (M)REGISTER/UNREGISTER, nil when --command-rate-limit is 0
+	limiter *tokenBucket
 }
 
 func NewClientV1(conn net.Conn) *ClientV1 {
@@ -15,6 +28,25 @@ func NewClientV1(conn net.Conn) *ClientV1 {
 	}
 }
 
+// readTLSState records the TLS metadata of the connection, when it is one
+func (c *ClientV1) readTLSState() error {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	// a no-op unless reading the protocol magic didn't already complete it
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	c.tls = true
+	if len(state.PeerCertificates) > 0 {
+		c.tlsCommonName = state.PeerCertificates[0].Subject.CommonName
+	}
+	return nil
+}
+
 func (c *ClientV1) String() string {
 	return c.RemoteAddr().String()
 }
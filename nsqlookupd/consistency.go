@@ -0,0 +1,49 @@
+package nsqlookupd
+
+import (
+	"time"
+)
+
+// findOrphanedChannels returns the channel registrations whose topic has no
+// "topic" registration, e.g. after a topic's registration was removed while
+// one of its channels was created with /channel/create. With repair the
+// missing topic registrations are added.
+func (l *NSQLookupd) findOrphanedChannels(repair bool) Registrations {
+	topics := make(map[string]bool)
+	for _, r := range l.DB.FindRegistrations("topic", "*", "") {
+		topics[r.Key] = true
+	}
+
+	orphans := Registrations{}
+	for _, r := range l.DB.FindRegistrations("channel", "*", "*") {
+		if topics[r.Key] {
+			continue
+		}
+		orphans = append(orphans, r)
+		l.logf(LOG_WARN, "DB: channel(%s) has no topic(%s) registration", r.SubKey, r.Key)
+	}
+
+	if repair {
+		for _, r := range orphans {
+			key := Registration{"topic", r.Key, ""}
+			if l.DB.AddRegistration(key) {
+				l.logf(LOG_INFO, "DB: adding topic(%s)", r.Key)
+			}
+		}
+	}
+	return orphans
+}
+
+// 每ConsistencyCheckInterval 检查一次没有topic 注册的channel, 直到Exit
+func (l *NSQLookupd) consistencyCheckLoop() {
+	ticker := time.NewTicker(l.getOpts().ConsistencyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.findOrphanedChannels(l.getOpts().ConsistencyCheckRepair)
+		case <-l.exitChan:
+			return
+		}
+	}
+}
@@ -1,5 +1,63 @@
 package nsqlookupd
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 type Context struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	pingCount              int64
+	identifyCount          int64
+	registerCount          int64
+	unregisterCount        int64
+	clientCount            int64
+	sendFailureCount       int64
+	lastRegistrationChange int64
+	lastClientID           int64
+
 	nsqlookupd *NSQLookupd
 }
+
+// 记录注册信息最后一次变化的时间
+func (c *Context) registrationChanged() {
+	atomic.StoreInt64(&c.lastRegistrationChange, time.Now().UnixNano())
+}
+
+type CommandStats struct {
+	Ping       int64 `json:"ping"`
+	Identify   int64 `json:"identify"`
+	Register   int64 `json:"register"`
+	Unregister int64 `json:"unregister"`
+}
+
+type Stats struct {
+	Commands               CommandStats   `json:"commands"`
+	Clients                int64          `json:"clients"`
+	SendFailures           int64          `json:"send_failures"`
+	LastRegistrationChange int64          `json:"last_registration_change"`
+	TCPConnections         int64          `json:"tcp_connections"`
+	TCPHandlers            int64          `json:"tcp_handlers"`
+	LookupCacheHits        int64          `json:"lookup_cache_hits"`
+	LookupCacheMisses      int64          `json:"lookup_cache_misses"`
+	DBLockWait             *LockWaitStats `json:"db_lock_wait,omitempty"`
+}
+
+// 返回自启动以来各命令的处理次数、当前连接数、回复发送失败的次数以及最后一次注册变化的时间(unix秒, 0表示没有变化)
+func (c *Context) Stats() Stats {
+	var lastChange int64
+	if ns := atomic.LoadInt64(&c.lastRegistrationChange); ns != 0 {
+		lastChange = time.Unix(0, ns).Unix()
+	}
+	return Stats{
+		Commands: CommandStats{
+			Ping:       atomic.LoadInt64(&c.pingCount),
+			Identify:   atomic.LoadInt64(&c.identifyCount),
+			Register:   atomic.LoadInt64(&c.registerCount),
+			Unregister: atomic.LoadInt64(&c.unregisterCount),
+		},
+		Clients:                atomic.LoadInt64(&c.clientCount),
+		SendFailures:           atomic.LoadInt64(&c.sendFailureCount),
+		LastRegistrationChange: lastChange,
+	}
+}
@@ -1,10 +1,19 @@
 package nsqlookupd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nsqio/nsq/internal/http_api"
@@ -12,15 +21,56 @@ import (
 	"github.com/nsqio/nsq/internal/version"
 )
 
+// the most topics a /lookup?prefix= request returns
+const maxLookupPrefixTopics = 100
+
+// the most topics a /topics?include_channels=true request returns
+const maxTopicsWithChannels = 1000
+
+// the most topics a /channels request can ask for
+const maxChannelsTopics = 100
+
+// how long /ping?deep=true waits for the DB
+const deepPingTimeout = time.Second
+
+// the endpoints served before startup has finished
+var notReadyPaths = map[string]bool{
+	"/ping":   true,
+	"/health": true,
+	"/info":   true,
+}
+
+// options whose flag name contains one of these are left out of /config
+var sensitiveOptions = []string{"tls", "key", "token", "secret", "password"}
+
 type httpServer struct {
 	ctx    *Context
 	router http.Handler
+
+	// when set, only these addresses may use the endpoints that change the DB
+	configCIDR *net.IPNet
+
+	nodesCache struct {
+		sync.Mutex
+		data      map[string]interface{}
+		fetchedAt time.Time
+	}
+
+	// for /nodes?probe=true
+	prober *nodeProber
 }
 
 func newHTTPServer(ctx *Context) *httpServer {
+	opts := ctx.nsqlookupd.getOpts()
+
 	// log 是通过nslookupd.logf 生成的一个decorator, decorator 接收 “接口处理函数”APIHandler类型作为参数
 	// 它的作用是把接口处理函数包装一边，返回一个包装后的接口处理函数
-	log := http_api.Log(ctx.nsqlookupd.logf)
+	log := http_api.LogWithOptions(ctx.nsqlookupd.logf, http_api.LogOptions{
+		MinStatus:  opts.HTTPLogMinStatus,
+		SampleRate: opts.HTTPLogSampleRate,
+		Format:     opts.HTTPLogFormat,
+	})
+	maxBody := http_api.MaxBodySize(opts.HTTPMaxBodySize)
 
 	router := httprouter.New()
 	router.HandleMethodNotAllowed = true
@@ -30,26 +80,47 @@ func newHTTPServer(ctx *Context) *httpServer {
 	s := &httpServer{
 		ctx:    ctx,
 		router: router,
+		prober: newNodeProber(nodeProbeTTL, nodeProbeTimeout),
+	}
+	if opts.AllowConfigFromCIDR != "" {
+		// validated in New()
+		_, s.configCIDR, _ = net.ParseCIDR(opts.AllowConfigFromCIDR)
 	}
 
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
-	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))
+	router.Handle("GET", "/health", http_api.Decorate(s.healthHandler, log, http_api.PlainText))
+	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, maxBody, log, http_api.V1, http_api.ETag))
 
 	// v1 negotiate
-	router.Handle("GET", "/debug", http_api.Decorate(s.doDebug, log, http_api.V1))
-	router.Handle("GET", "/lookup", http_api.Decorate(s.doLookup, log, http_api.V1))
-	router.Handle("GET", "/topics", http_api.Decorate(s.doTopics, log, http_api.V1))
-	router.Handle("GET", "/channels", http_api.Decorate(s.doChannels, log, http_api.V1))
-	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, log, http_api.V1))
+	router.Handle("GET", "/debug", http_api.Decorate(s.doDebug, maxBody, log, http_api.V1, http_api.ETag))
+	router.Handle("GET", "/lookup", http_api.Decorate(s.doLookup, maxBody, log, http_api.V1, http_api.ETag))
+	router.Handle("GET", "/lookup/preview", http_api.Decorate(s.doLookupPreview, maxBody, log, http_api.V1))
+	router.Handle("GET", "/topics", http_api.Decorate(s.doTopics, maxBody, log, http_api.V1, http_api.ETag))
+	router.Handle("GET", "/topics/staleness", http_api.Decorate(s.doTopicsStaleness, maxBody, log, http_api.V1))
+	router.Handle("GET", "/channels", http_api.Decorate(s.doChannels, maxBody, log, http_api.V1, http_api.ETag))
+	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, maxBody, log, http_api.V1, http_api.ETag))
+	router.Handle("GET", "/registrations", http_api.Decorate(s.doRegistrations, maxBody, log, http_api.V1, http_api.ETag))
+	router.Handle("GET", "/topology.dot", http_api.Decorate(s.doTopologyDOT, maxBody, log, http_api.PlainText))
+	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, maxBody, log, http_api.V1))
+	router.Handle("GET", "/config", http_api.Decorate(s.doConfig, maxBody, log, http_api.V1))
+	router.Handle("GET", "/events", http_api.Decorate(s.doEvents, log))
 
 	// only v1
-	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
-	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
-	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
+	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/topic/rename", http_api.Decorate(s.doRenameTopic, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/channel/rename", http_api.Decorate(s.doRenameChannel, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/node/unregister", http_api.Decorate(s.doUnregisterNode, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/node/touch", http_api.Decorate(s.doTouchNode, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
+	router.Handle("POST", "/read_only", http_api.Decorate(s.doReadOnly, s.checkConfigCIDR, maxBody, log, http_api.V1))
+	router.Handle("PUT", "/config", http_api.Decorate(s.doUpdateConfig, s.checkConfigCIDR, maxBody, log, http_api.V1))
 
 	// debug
+	router.Handle("POST", "/debug/gc", http_api.Decorate(s.doGC, s.checkConfigCIDR, s.checkReadOnly, maxBody, log, http_api.V1))
 	router.HandlerFunc("GET", "/debug/pprof", pprof.Index)
 	router.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
 	router.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
@@ -64,49 +135,308 @@ func newHTTPServer(ctx *Context) *httpServer {
 }
 
 // 实现该方式是为了实现http.Handler
+// 启动时DB 还在恢复(见Options.Restore)的话, 除了notReadyPaths 都返回503, 以免返回一个空的DB
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.ctx.nsqlookupd.IsReady() && !notReadyPaths[req.URL.Path] {
+		http_api.RespondV1(w, 503, http_api.Err{Code: 503, Text: "NOT_READY"})
+		return
+	}
 	s.router.ServeHTTP(w, req)
 }
 
+// 修改DB的接口只允许AllowConfigFromCIDR 范围内的地址访问，没有配置时不限制
+func (s *httpServer) checkConfigCIDR(f http_api.APIHandler) http_api.APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		if s.configCIDR == nil {
+			return f(w, req, ps)
+		}
+		addr, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			s.ctx.nsqlookupd.logf(LOG_ERROR, "failed to parse RemoteAddr %s", req.RemoteAddr)
+			return nil, http_api.Err{Code: 400, Text: "INVALID_REMOTE_ADDR", Key: "INVALID_REMOTE_ADDR"}
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			s.ctx.nsqlookupd.logf(LOG_ERROR, "failed to parse RemoteAddr %s", req.RemoteAddr)
+			return nil, http_api.Err{Code: 400, Text: "INVALID_REMOTE_ADDR", Key: "INVALID_REMOTE_ADDR"}
+		}
+		if !s.configCIDR.Contains(ip) {
+			return nil, http_api.ErrForbidden
+		}
+		return f(w, req, ps)
+	}
+}
+
+// 只读模式下拒绝所有修改DB的请求
+func (s *httpServer) checkReadOnly(f http_api.APIHandler) http_api.APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		if s.ctx.nsqlookupd.IsReadOnly() {
+			return nil, http_api.Err{Code: 403, Text: "READ_ONLY", Key: "READ_ONLY"}
+		}
+		return f(w, req, ps)
+	}
+}
+
 // 以下接口都是APIHandler 类型：接口处理函数, 所有的函数都被包装了两层，所有不用担心返回与日志的问题
 
+// ?deep=true 时还会检查DB 的锁能否及时获取以及监听是否已建立
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	deep, _ := strconv.ParseBool(req.URL.Query().Get("deep"))
+	if !deep {
+		return "OK", nil
+	}
+
+	l := s.ctx.nsqlookupd
+	l.RLock()
+	listening := l.tcpListener != nil && l.httpListener != nil
+	l.RUnlock()
+	if !listening {
+		return nil, http_api.Err{Code: 503, Text: "NOT_LISTENING"}
+	}
+
+	err := l.DB.Ping(deepPingTimeout)
+	if err != nil {
+		l.logf(LOG_WARN, "deep ping - DB %s", err)
+		return nil, http_api.Err{Code: 503, Text: "DB_UNAVAILABLE"}
+	}
 	return "OK", nil
 }
 
+// 启动(包括DB 的恢复)完成之前返回503, 可以用作readiness 检查
+func (s *httpServer) healthHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if !s.ctx.nsqlookupd.IsReady() {
+		return nil, http_api.Err{Code: 503, Text: "NOT_READY"}
+	}
+	return "OK", nil
+}
 
 func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	return struct {
-		Version string `json:"version"`
+		Version     string `json:"version"`
+		BuildCommit string `json:"build_commit"`
+		BuildDate   string `json:"build_date"`
 	}{
-		Version: version.Binary,
+		Version:     version.Binary,
+		BuildCommit: version.Commit,
+		BuildDate:   version.BuildDate,
 	}, nil
 }
 
+// 返回各命令的处理计数、当前连接的client数量以及最后一次注册变化的时间
+func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.nsqlookupd.Stats(), nil
+}
+
+// 返回当前生效的配置(不包括敏感的配置项)
+func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return optsConfig(s.ctx.nsqlookupd.getOpts()), nil
+}
+
+// 修改inactive_producer_timeout 和tombstone_lifetime, 不需要重启
+// 新的配置对之后的请求立即生效
+func (s *httpServer) doUpdateConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	opts := *s.ctx.nsqlookupd.getOpts()
+	updated := false
+	for _, o := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"inactive_producer_timeout", &opts.InactiveProducerTimeout},
+		{"tombstone_lifetime", &opts.TombstoneLifetime},
+	} {
+		v, err := reqParams.Get(o.name)
+		if err != nil {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, http_api.ErrInvalidArg(o.name)
+		}
+		*o.d = d
+		updated = true
+	}
+	if !updated {
+		return nil, http_api.ErrMissingArg("config")
+	}
+
+	s.ctx.nsqlookupd.logf(LOG_INFO, "updating config inactive_producer_timeout(%s) tombstone_lifetime(%s)",
+		opts.InactiveProducerTimeout, opts.TombstoneLifetime)
+	s.ctx.nsqlookupd.swapOpts(&opts)
+
+	// /nodes 的缓存是用旧的配置过滤的
+	s.nodesCache.Lock()
+	s.nodesCache.data = nil
+	s.nodesCache.Unlock()
+
+	return optsConfig(&opts), nil
+}
+
+// 以Server-Sent Events 的方式推送注册信息的变化，每个事件是一行JSON
+// 客户端断开连接后取消订阅
+func (s *httpServer) doEvents(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	events, cancel := s.ctx.nsqlookupd.DB.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil, nil
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			if err != nil {
+				return nil, nil
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 // 搜索该topic所有key, subkey 
+// ?include_channels=true 时返回每个topic 的channel 列表 {"topics": {topic: [channels...]}}
 func (s *httpServer) doTopics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	if v, err := reqParams.Get("include_channels"); err == nil {
+		includeChannels, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, http_api.ErrInvalidArg("include_channels")
+		}
+		if includeChannels {
+			topics, truncated := s.ctx.nsqlookupd.DB.TopicChannels(maxTopicsWithChannels)
+			return map[string]interface{}{
+				"topics":    topics,
+				"truncated": truncated,
+			}, nil
+		}
+	}
+
+	// 逐个写出, 不需要先把整个响应序列化
 	topics := s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys()
+	i := 0
+	return &http_api.StreamedArray{Key: "topics", Next: func() (interface{}, bool) {
+		if i >= len(topics) {
+			return nil, false
+		}
+		i++
+		return topics[i-1], true
+	}}, nil
+}
+
+// 返回最新的producer 也超过threshold 没有更新的topic, threshold 默认为 InactiveProducerTimeout
+func (s *httpServer) doTopicsStaleness(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	threshold := s.ctx.nsqlookupd.getOpts().InactiveProducerTimeout
+	if v, err := reqParams.Get("threshold"); err == nil {
+		threshold, err = time.ParseDuration(v)
+		if err != nil || threshold < 0 {
+			return nil, http_api.ErrInvalidArg("threshold")
+		}
+	}
+
+	type staleTopic struct {
+		Topic     string  `json:"topic"`
+		Staleness float64 `json:"staleness_seconds"`
+	}
+	topics := []staleTopic{}
+	for _, topic := range s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys() {
+		staleness, ok := s.ctx.nsqlookupd.DB.TopicStaleness(topic)
+		if ok && staleness > threshold {
+			topics = append(topics, staleTopic{topic, staleness.Seconds()})
+		}
+	}
+
 	return map[string]interface{}{
-		"topics": topics,
+		"threshold_seconds": threshold.Seconds(),
+		"topics":            topics,
 	}, nil
 }
 
-// 找到特定topicname中的所有channelsname,即 subkey 
+// 找到特定topicname中的所有channelsname,即 subkey
 func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
-	topicName, err := reqParams.Get("topic")
+	topicNames, err := reqParams.GetAll("topic")
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.ErrMissingArg("topic")
+	}
+	if len(topicNames) > maxChannelsTopics {
+		return nil, http_api.ErrInvalidArg("topic").WithCause(fmt.Errorf("more than %d topics", maxChannelsTopics))
 	}
 
-	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
-	return map[string]interface{}{
-		"channels": channels,
-	}, nil
+	activeOnly := false
+	if v, err := reqParams.Get("active_only"); err == nil {
+		activeOnly, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, http_api.ErrInvalidArg("active_only")
+		}
+	}
+
+	if len(topicNames) == 1 {
+		topicName, _ := s.ctx.nsqlookupd.normalizeTopicChannel(topicNames[0], "")
+		return map[string]interface{}{
+			"channels": s.topicChannels(topicName, activeOnly),
+		}, nil
+	}
+
+	// 多个topic 时返回 {topic: [channels...]}, 不存在的topic 不返回
+	channels := make(map[string][]string, len(topicNames))
+	for _, topicName := range topicNames {
+		topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
+		if len(s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")) == 0 {
+			continue
+		}
+		channels[topicName] = s.topicChannels(topicName, activeOnly)
+	}
+	return channels, nil
+}
+
+// topicChannels returns the (sorted) channels of topicName, with activeOnly
+// only those with an active producer
+func (s *httpServer) topicChannels(topicName string, activeOnly bool) []string {
+	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
+	if activeOnly {
+		// 只保留至少有一个active producer 的channel
+		opts := s.ctx.nsqlookupd.getOpts()
+		active := Registrations{}
+		for _, r := range registrations {
+			producers := s.ctx.nsqlookupd.DB.FindProducers(r.Category, r.Key, r.SubKey)
+			if len(producers.FilterByActive(opts.InactiveProducerTimeout, opts.TombstoneLifetime)) > 0 {
+				active = append(active, r)
+			}
+		}
+		registrations = active
+	}
+	return registrations.SubKeys()
 }
 
 // 类型为"topic"时，key是 topic name,subkey 是为空的，有待日后确定 .   --> 已确定，在下面的doCreateTopic 函数
@@ -115,26 +445,179 @@ func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request, ps htt
 func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		if prefix, err := reqParams.Get("prefix"); err == nil {
+			prefix, _ = s.ctx.nsqlookupd.normalizeTopicChannel(prefix, "")
+			return s.lookupPrefix(prefix)
+		}
+		return nil, http_api.ErrMissingArg("topic")
+	}
+	topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
+
+	exists, channels, producers := s.lookupRegistrations(topicName)
+	if !exists {
+		return nil, http_api.ErrResourceNotFound("topic")
+	}
+
+	// ?limit=N 只返回N 个producer, 配合?sort=freshness 返回lastUpdate 最新的N 个
+	limit := 0
+	if v, err := reqParams.Get("limit"); err == nil {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, http_api.ErrInvalidArg("limit")
+		}
+	}
+	sortBy, _ := reqParams.Get("sort")
+	if sortBy != "" && sortBy != "freshness" {
+		return nil, http_api.ErrInvalidArg("sort")
+	}
+	// ?format=addresses 时额外返回可以直接连接的 host:port 列表
+	format, _ := reqParams.Get("format")
+	if format != "" && format != "addresses" {
+		return nil, http_api.ErrInvalidArg("format")
+	}
+	// ?group_by=dc 时额外返回按producer metadata 中的dc 分组的producers,
+	// 没有该key 的producer 在"unknown" 组
+	groupBy, _ := reqParams.Get("group_by")
+
+	opts := s.ctx.nsqlookupd.getOpts()
+	producers = producers.FilterByActive(opts.InactiveProducerTimeout, opts.TombstoneLifetime)
+	if sortBy == "freshness" {
+		producers.SortByFreshness()
+	}
+	if limit > 0 && len(producers) > limit {
+		producers = producers[:limit]
+	}
+	data := map[string]interface{}{
+		"channels":  channels,
+		"producers": producers.PeerInfo(),
+	}
+	if format == "addresses" {
+		addresses := make([]string, len(producers))
+		for i, p := range producers {
+			addresses[i] = net.JoinHostPort(p.peerInfo.BroadcastAddress, strconv.Itoa(p.peerInfo.TCPPort))
+		}
+		data["addresses"] = addresses
+	}
+	if groupBy != "" {
+		data["groups"] = producers.GroupByMetadata(groupBy)
+	}
+	return data, nil
+}
+
+// 返回topic 是否存在, 它的channel 和producers, 开启了--lookup-cache-size 时从缓存读取
+func (s *httpServer) lookupRegistrations(topicName string) (bool, []string, Producers) {
+	fill := func() (bool, []string, Producers) {
+		db := s.ctx.nsqlookupd.DB
+		if len(db.FindRegistrations("topic", topicName, "")) == 0 {
+			return false, nil, nil
+		}
+		channels := db.FindRegistrations("channel", topicName, "*").SubKeys()
+		return true, channels, db.FindProducers("topic", topicName, "")
+	}
+
+	s.ctx.nsqlookupd.RLock()
+	cache := s.ctx.nsqlookupd.lookupCache
+	s.ctx.nsqlookupd.RUnlock()
+	if cache == nil {
+		return fill()
+	}
+	return cache.get(topicName, fill)
+}
+
+// 预览使用指定的inactivity(默认为 InactiveProducerTimeout) 时，/lookup 会保留和过滤掉哪些producer
+func (s *httpServer) doLookupPreview(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
 	topicName, err := reqParams.Get("topic")
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.ErrMissingArg("topic")
+	}
+	topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
+
+	inactivity := s.ctx.nsqlookupd.getOpts().InactiveProducerTimeout
+	if v, err := reqParams.Get("inactivity"); err == nil {
+		inactivity, err = time.ParseDuration(v)
+		if err != nil || inactivity < 0 {
+			return nil, http_api.ErrInvalidArg("inactivity")
+		}
 	}
 
 	registration := s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
 	if len(registration) == 0 {
-		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+		return nil, http_api.ErrResourceNotFound("topic")
 	}
 
-	channels := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*").SubKeys()
+	type previewProducer struct {
+		*PeerInfo
+		Lag    int64  `json:"lag_ms"`
+		Status string `json:"status"`
+	}
+
+	tombstoneLifetime := s.ctx.nsqlookupd.getOpts().TombstoneLifetime
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
-	producers = producers.FilterByActive(s.ctx.nsqlookupd.opts.InactiveProducerTimeout,
-		s.ctx.nsqlookupd.opts.TombstoneLifetime)
+	active := make(map[*Producer]bool)
+	for _, p := range producers.FilterByActive(inactivity, tombstoneLifetime) {
+		active[p] = true
+	}
+
+	now := time.Now()
+	kept := []previewProducer{}
+	dropped := []previewProducer{}
+	for _, p := range producers {
+		lag := now.Sub(time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate)))
+		pp := previewProducer{
+			PeerInfo: p.peerInfo,
+			Lag:      lag.Nanoseconds() / int64(time.Millisecond),
+			Status:   p.Status(inactivity, tombstoneLifetime),
+		}
+		if active[p] {
+			kept = append(kept, pp)
+		} else {
+			dropped = append(dropped, pp)
+		}
+	}
+
 	return map[string]interface{}{
-		"channels":  channels,
-		"producers": producers.PeerInfo(),
+		"inactivity_ms": inactivity.Nanoseconds() / int64(time.Millisecond),
+		"kept":          kept,
+		"dropped":       dropped,
+	}, nil
+}
+
+// /lookup?prefix= 返回所有以prefix 开头的topic 的producers,
+// 最多返回maxLookupPrefixTopics 个topic(按名字排序), 超过时 truncated 为true
+func (s *httpServer) lookupPrefix(prefix string) (interface{}, error) {
+	if prefix == "" {
+		return nil, http_api.ErrInvalidArg("prefix")
+	}
+
+	topics := make(map[string][]*PeerInfo)
+	truncated := false
+	opts := s.ctx.nsqlookupd.getOpts()
+	for _, topicName := range s.ctx.nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys() {
+		if !strings.HasPrefix(topicName, prefix) {
+			continue
+		}
+		if len(topics) == maxLookupPrefixTopics {
+			truncated = true
+			break
+		}
+		producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
+		producers = producers.FilterByActive(opts.InactiveProducerTimeout, opts.TombstoneLifetime)
+		topics[topicName] = producers.PeerInfo()
+	}
+
+	return map[string]interface{}{
+		"topics":    topics,
+		"truncated": truncated,
 	}, nil
 }
 
@@ -142,37 +625,88 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
 	topicName, err := reqParams.Get("topic")
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.ErrMissingArg("topic")
 	}
+	topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
 
 	if !protocol.IsValidTopicName(topicName) {
-		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+		return nil, http_api.ErrInvalidArg("topic")
+	}
+
+	// ephemeral topic 只在有producer 时存在，手动创建的没有producer, 永远不会被清理
+	if strings.HasSuffix(topicName, "#ephemeral") {
+		return nil, http_api.ErrInvalidArg("topic")
+	}
+
+	// 默认是幂等的，?fail_if_exists=true 时topic 已存在返回409
+	failIfExists := false
+	if v, err := reqParams.Get("fail_if_exists"); err == nil {
+		failIfExists, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, http_api.ErrInvalidArg("fail_if_exists")
+		}
+	}
+
+	// 可以用重复的channel 参数同时创建channel, 先全部校验, 有一个不合法就都不创建
+	channelNames, _ := reqParams.GetAll("channel")
+	for i, channelName := range channelNames {
+		_, channelName = s.ctx.nsqlookupd.normalizeTopicChannel("", channelName)
+		if !protocol.IsValidChannelName(channelName) {
+			return nil, http_api.ErrInvalidArg("channel")
+		}
+		channelNames[i] = channelName
+	}
+
+	regs := []Registration{{"topic", topicName, ""}}
+	for _, channelName := range channelNames {
+		regs = append(regs, Registration{"channel", topicName, channelName})
+	}
+	if err := s.ctx.nsqlookupd.checkLimits(regs); err != nil {
+		return nil, http_api.ErrLimitExceeded.WithCause(err)
 	}
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
 	key := Registration{"topic", topicName, ""}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	created := s.ctx.nsqlookupd.DB.AddRegistration(key)
+	if !created && failIfExists {
+		return http_api.Status{Code: 409, Data: map[string]interface{}{
+			"created": false,
+		}}, nil
+	}
 
-	return nil, nil
-}
+	changed := created
+	for _, channelName := range channelNames {
+		s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
+		if s.ctx.nsqlookupd.DB.AddRegistration(Registration{"channel", topicName, channelName}) {
+			changed = true
+		}
+	}
+	if changed {
+		s.ctx.registrationChanged()
+	}
 
+	return map[string]interface{}{
+		"created": created,
+	}, nil
+}
 
 // 删除topic 时，把类别channel 和 topic 中的的都删除，包括Registrations 中的Producer 
 func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
 	topicName, err := reqParams.Get("topic")
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.ErrMissingArg("topic")
 	}
+	topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
 
 	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
 	for _, registration := range registrations {
@@ -180,11 +714,87 @@ func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps
 		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
 	}
 
-	registrations = s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
-	for _, registration := range registrations {
+	topicRegistrations := s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
+	for _, registration := range topicRegistrations {
 		s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removing topic(%s)", topicName)
 		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
 	}
+	if len(registrations) > 0 || len(topicRegistrations) > 0 {
+		s.ctx.registrationChanged()
+	}
+
+	return nil, nil
+}
+
+// 重命名topic, topic分类和channel分类中的Registration 在同一把写锁下换成新名字，Producers 和 tombstone 状态保持不变
+func (s *httpServer) doRenameTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.ErrMissingArg("topic")
+	}
+	topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
+
+	newTopicName, err := reqParams.Get("new_topic")
+	if err != nil {
+		return nil, http_api.ErrMissingArg("new_topic")
+	}
+
+	if !protocol.IsValidTopicName(newTopicName) {
+		return nil, http_api.ErrInvalidArg("new_topic")
+	}
+	newTopicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(newTopicName, "")
+
+	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: renaming topic(%s) to topic(%s)", topicName, newTopicName)
+	err = s.ctx.nsqlookupd.DB.RenameTopic(topicName, newTopicName)
+	switch err {
+	case errRegistrationNotFound:
+		return nil, http_api.ErrResourceNotFound("topic")
+	case errRegistrationExists:
+		return nil, http_api.ErrResourceExists("topic")
+	}
+	s.ctx.registrationChanged()
+
+	return nil, nil
+}
+
+// 重命名某个topic下的channel
+func (s *httpServer) doRenameChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	topicName, channelName = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, channelName)
+
+	newChannelName, err := reqParams.Get("new_channel")
+	if err != nil {
+		return nil, http_api.ErrMissingArg("new_channel")
+	}
+
+	if !protocol.IsValidChannelName(newChannelName) {
+		return nil, http_api.ErrInvalidArg("new_channel")
+	}
+	_, newChannelName = s.ctx.nsqlookupd.normalizeTopicChannel("", newChannelName)
+
+	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: renaming channel(%s) to channel(%s) in topic(%s)",
+		channelName, newChannelName, topicName)
+	err = s.ctx.nsqlookupd.DB.RenameChannel(topicName, channelName, newChannelName)
+	switch err {
+	case errRegistrationNotFound:
+		return nil, http_api.ErrResourceNotFound("channel")
+	case errRegistrationExists:
+		return nil, http_api.ErrResourceExists("channel")
+	}
+	s.ctx.registrationChanged()
 
 	return nil, nil
 }
@@ -193,50 +803,172 @@ func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps
 func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
 	topicName, err := reqParams.Get("topic")
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, http_api.ErrMissingArg("topic")
 	}
+	topicName, _ = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, "")
 
 	node, err := reqParams.Get("node")
 	if err != nil {
-		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+		return nil, http_api.ErrMissingArg("node")
 	}
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
+	tombstoned := false
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	for _, p := range producers {
 		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
 		if thisNode == node {
 			p.Tombstone()
+			tombstoned = true
 		}
 	}
+	if tombstoned {
+		s.ctx.registrationChanged()
+	}
 
 	return nil, nil
 }
 
+// 强制注销一个节点(比如nsqd进程卡死但TCP连接没有断开)
+// node 为 broadcast_address:http_port, 或者使用 remote_address 指定
+// 返回被删除的注册数量
+func (s *httpServer) doUnregisterNode(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	node, _ := reqParams.Get("node")
+	remoteAddress, _ := reqParams.Get("remote_address")
+	if node == "" && remoteAddress == "" {
+		return nil, http_api.ErrMissingArg("node")
+	}
+
+	var ids []string
+	producers := s.ctx.nsqlookupd.DB.FindProducers("client", "", "")
+	for _, p := range producers {
+		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
+		if (node != "" && thisNode == node) ||
+			(remoteAddress != "" && p.peerInfo.RemoteAddress == remoteAddress) {
+			ids = append(ids, p.peerInfo.id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, http_api.ErrResourceNotFound("node")
+	}
+
+	count := 0
+	for _, id := range ids {
+		registrations := s.ctx.nsqlookupd.DB.RemoveAllProducersByID(id)
+		for _, r := range registrations {
+			s.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+				id, r.Category, r.Key, r.SubKey)
+		}
+		count += len(registrations)
+	}
+	if count > 0 {
+		s.ctx.registrationChanged()
+	}
+
+	return map[string]interface{}{
+		"count": count,
+	}, nil
+}
+
+// 把节点的lastUpdate 设为现在, 就像它刚刚PING 过一样 (比如故障切换时PING 被延迟),
+// node 为 broadcast_address:http_port, 或者使用 id 指定. 返回被更新的节点数量
+func (s *httpServer) doTouchNode(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	node, _ := reqParams.Get("node")
+	id, _ := reqParams.Get("id")
+	if node == "" && id == "" {
+		return nil, http_api.ErrMissingArg("node")
+	}
+
+	// 同一个id 的PeerInfo 在DB 中是共享的, 更新client 分类中的就更新了所有的
+	now := time.Now().UnixNano()
+	count := 0
+	producers := s.ctx.nsqlookupd.DB.FindProducers("client", "", "")
+	for _, p := range producers {
+		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
+		if (node != "" && thisNode == node) || (id != "" && p.peerInfo.id == id) {
+			atomic.StoreInt64(&p.peerInfo.lastUpdate, now)
+			s.ctx.nsqlookupd.logf(LOG_INFO, "DB: touched client(%s)", p.peerInfo.id)
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, http_api.ErrResourceNotFound("node")
+	}
+
+	return map[string]interface{}{
+		"count": count,
+	}, nil
+}
+
+// 开启或关闭只读模式, enabled=true|false
+func (s *httpServer) doReadOnly(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	enabled, err := reqParams.Get("enabled")
+	if err != nil {
+		return nil, http_api.ErrMissingArg("enabled")
+	}
+
+	readOnly, err := strconv.ParseBool(enabled)
+	if err != nil {
+		return nil, http_api.ErrInvalidArg("enabled")
+	}
+
+	s.ctx.nsqlookupd.logf(LOG_INFO, "setting read-only mode to %t", readOnly)
+	s.ctx.nsqlookupd.SetReadOnly(readOnly)
+
+	return map[string]interface{}{
+		"read_only": readOnly,
+	}, nil
+}
+
 // 添加一个Channel， 即要添加到channel分类，也要添加到topic分类
 func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
 	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
 	if err != nil {
-		return nil, http_api.Err{400, err.Error()}
+		return nil, err
 	}
+	topicName, channelName = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, channelName)
 
-	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
 	key := Registration{"channel", topicName, channelName}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	if err := s.ctx.nsqlookupd.checkLimits([]Registration{key}); err != nil {
+		return nil, http_api.ErrLimitExceeded.WithCause(err)
+	}
+
+	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
+	changed := s.ctx.nsqlookupd.DB.AddRegistration(key)
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
 	key = Registration{"topic", topicName, ""}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	if s.ctx.nsqlookupd.DB.AddRegistration(key) {
+		changed = true
+	}
+	if changed {
+		s.ctx.registrationChanged()
+	}
 
 	return nil, nil
 }
@@ -246,27 +978,79 @@ func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, p
 func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
 	}
 
 	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
 	if err != nil {
-		return nil, http_api.Err{400, err.Error()}
+		return nil, err
 	}
+	topicName, channelName = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, channelName)
 
 	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, channelName)
 	if len(registrations) == 0 {
-		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		return nil, http_api.ErrResourceNotFound("channel")
 	}
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", channelName, topicName)
 	for _, registration := range registrations {
 		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
 	}
+	s.ctx.registrationChanged()
 
 	return nil, nil
 }
 
+// 删除channel 的所有producer, 但保留channel (例如迁移的时候), 返回删除的producer 数量
+func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	topicName, channelName = s.ctx.nsqlookupd.normalizeTopicChannel(topicName, channelName)
+
+	key := Registration{"channel", topicName, channelName}
+	if len(s.ctx.nsqlookupd.DB.FindRegistrations(key.Category, key.Key, key.SubKey)) == 0 {
+		return nil, http_api.ErrResourceNotFound("channel")
+	}
+
+	removed := s.ctx.nsqlookupd.DB.RemoveAllProducersFromRegistration(key)
+	if removed > 0 {
+		s.ctx.registrationChanged()
+	}
+	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removed %d producers from channel(%s) of topic(%s)",
+		removed, channelName, topicName)
+
+	return map[string]interface{}{
+		"removed": removed,
+	}, nil
+}
+
+// 删除没有producer 的topic/channel 注册信息, 返回删除的数量
+func (s *httpServer) doGC(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	removed := s.ctx.nsqlookupd.DB.RemoveEmptyRegistrations()
+	if removed > 0 {
+		s.ctx.registrationChanged()
+	}
+	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removed %d empty registrations", removed)
+
+	return map[string]interface{}{
+		"removed": removed,
+	}, nil
+}
+
+// a producer left out of /nodes because its PeerInfo is malformed
+type nodeError struct {
+	ID            string `json:"id"`
+	RemoteAddress string `json:"remote_address"`
+	Error         string `json:"error"`
+}
+
 type node struct {
 	RemoteAddress    string   `json:"remote_address"`
 	Hostname         string   `json:"hostname"`
@@ -274,83 +1058,254 @@ type node struct {
 	TCPPort          int      `json:"tcp_port"`
 	HTTPPort         int      `json:"http_port"`
 	Version          string   `json:"version"`
+	Status           string   `json:"status"`
 	Tombstones       []bool   `json:"tombstones"`
 	Topics           []string `json:"topics"`
-}
+	TopicCount       int      `json:"topic_count"`
+	ChannelCount     int      `json:"channel_count"`
 
+	// whether the HTTP port accepts connections, only with probe=true
+	Reachable *bool `json:"reachable,omitempty"`
+}
 
 // 找到所有client类型中的Producers,
 // 再找到topic类型中的所有key,再根据这些key,找到所有的Producers,然后做一些查询，最后返回
-// 下面有一些我自作聪明的优化，由于对整个项目还不是很了解，不知道会不会产生其他问题，优化的也并不好，急着敢末班车，先闪了
+// 结果会缓存NodesCacheTTL 时间，nocache=true 时跳过缓存
+// probe=true 时尝试连接每个节点的HTTP 端口, 返回reachable
 func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	// dont filter out tombstoned nodes
-	producers := s.ctx.nsqlookupd.DB.FindProducers("client", "", "").FilterByActive(
-		s.ctx.nsqlookupd.opts.InactiveProducerTimeout, 0)
-	nodes := make([]*node, len(producers))
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
 
-	topics     := s.ctx.nsqlookupd.DB.LookupRegistrations(p.peerInfo.id).Filter("topic", "*", "").Keys()
-	tombstones := make([]bool, len(topics))
-	topicProducers := Producers{}
-	for j, t := range topics {
-		topicProducers = append(topicProduers, s.ctx.nsqlookupd.DB.FindProducers("topic", t, "")...)
+	data := s.findNodes(reqParams)
+	if probe, _ := reqParams.Get("probe"); probe == "true" {
+		data = s.probeNodes(data)
 	}
+	return data, nil
+}
 
-	for i, p := range producers {
-		//topics := s.ctx.nsqlookupd.DB.LookupRegistrations(p.peerInfo.id).Filter("topic", "*", "").Keys()
+func (s *httpServer) findNodes(reqParams *http_api.ReqParams) map[string]interface{} {
+	// broadcast_address 只返回该地址的节点 (可能有多个id), 不缓存
+	broadcastAddress, _ := reqParams.Get("broadcast_address")
+	if broadcastAddress != "" {
+		return s.nodes(s.ctx.nsqlookupd.DB.FindProducersByBroadcastAddress(broadcastAddress))
+	}
+
+	ttl := s.ctx.nsqlookupd.getOpts().NodesCacheTTL
+	noCache, _ := reqParams.Get("nocache")
+	if ttl <= 0 || noCache == "true" {
+		return s.nodes(s.ctx.nsqlookupd.DB.FindProducers("client", "", ""))
+	}
+
+	// hold the lock while computing so that a burst of requests
+	// results in a single scan of the DB
+	s.nodesCache.Lock()
+	defer s.nodesCache.Unlock()
+	now := time.Now()
+	if s.nodesCache.data == nil || now.Sub(s.nodesCache.fetchedAt) >= ttl {
+		s.nodesCache.data = s.nodes(s.ctx.nsqlookupd.DB.FindProducers("client", "", ""))
+		s.nodesCache.fetchedAt = now
+	}
+	return s.nodesCache.data
+}
+
+func (s *httpServer) nodes(producers Producers) map[string]interface{} {
+	// dont filter out tombstoned nodes
+	producers = producers.FilterByActive(s.ctx.nsqlookupd.getOpts().InactiveProducerTimeout, 0)
+	nodes := make([]*node, 0, len(producers))
+	nodeErrors := []nodeError{}
+	for _, p := range producers {
+		// 不合法的peerInfo 不返回给client, 单独列在errors 里
+		if err := p.peerInfo.check(); err != nil {
+			nodeErrors = append(nodeErrors, nodeError{p.peerInfo.id, p.peerInfo.RemoteAddress, err.Error()})
+			continue
+		}
+
+		// only the "topic" category, a topic is listed once however many of
+		// its channels the producer has registered too
+		registrations := s.ctx.nsqlookupd.DB.LookupRegistrations(p.peerInfo.id)
+		topics := registrations.Filter("topic", "*", "").Keys()
+		channelCount := len(registrations.Filter("channel", "*", "*"))
 
 		// for each topic find the producer that matches this peer
 		// to add tombstone information
-		//tombstones := make([]bool, len(topics))
+		tombstones := make([]bool, len(topics))
 		for j, t := range topics {
-			//topicProducers := s.ctx.nsqlookupd.DB.FindProducers("topic", t, "")
+			topicProducers := s.ctx.nsqlookupd.DB.FindProducers("topic", t, "")
 			for _, tp := range topicProducers {
 				if tp.peerInfo == p.peerInfo {
-					tombstones[j] = tp.IsTombstoned(s.ctx.nsqlookupd.opts.TombstoneLifetime)
+					tombstones[j] = s.producerStatus(tp) == ProducerTombstoned
 				}
 			}
 		}
 
-		nodes[i] = &node{
+		nodes = append(nodes, &node{
 			RemoteAddress:    p.peerInfo.RemoteAddress,
 			Hostname:         p.peerInfo.Hostname,
 			BroadcastAddress: p.peerInfo.BroadcastAddress,
 			TCPPort:          p.peerInfo.TCPPort,
 			HTTPPort:         p.peerInfo.HTTPPort,
 			Version:          p.peerInfo.Version,
+			Status:           s.producerStatus(p),
 			Tombstones:       tombstones,
 			Topics:           topics,
-		}
+			TopicCount:       len(topics),
+			ChannelCount:     channelCount,
+		})
 	}
 
 	return map[string]interface{}{
 		"producers": nodes,
-	}, nil
+		"errors":    nodeErrors,
+	}
 }
 
+// 以Graphviz DOT 格式返回所有topic, channel 和注册了topic 的producer(以broadcast_address:tcp_port 区分),
+// producer -> topic, topic -> channel, 用于画拓扑图
+func (s *httpServer) doTopologyDOT(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	db := s.ctx.nsqlookupd.DB
+	nodes := make(map[string]string) // quoted id -> attributes
+	edges := make(map[string]bool)
+	for _, r := range db.FindRegistrations("topic", "*", "") {
+		topic := strconv.Quote("topic:" + r.Key)
+		nodes[topic] = fmt.Sprintf("[shape=ellipse, label=%s]", strconv.Quote(r.Key))
+		for _, p := range db.FindProducers("topic", r.Key, "") {
+			addr := net.JoinHostPort(p.peerInfo.BroadcastAddress, strconv.Itoa(p.peerInfo.TCPPort))
+			producer := strconv.Quote("producer:" + addr)
+			nodes[producer] = fmt.Sprintf("[shape=box, label=%s]", strconv.Quote(addr))
+			edges[producer+" -> "+topic] = true
+		}
+	}
+	for _, r := range db.FindRegistrations("channel", "*", "*") {
+		topic := strconv.Quote("topic:" + r.Key)
+		if _, ok := nodes[topic]; !ok {
+			nodes[topic] = fmt.Sprintf("[shape=ellipse, label=%s]", strconv.Quote(r.Key))
+		}
+		channel := strconv.Quote("channel:" + r.Key + "/" + r.SubKey)
+		nodes[channel] = fmt.Sprintf("[shape=note, label=%s]", strconv.Quote(r.SubKey))
+		edges[topic+" -> "+channel] = true
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	lines := make([]string, 0, len(edges))
+	for e := range edges {
+		lines = append(lines, e)
+	}
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph nsq {\n")
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "\t%s %s;\n", id, nodes[id])
+	}
+	for _, e := range lines {
+		fmt.Fprintf(&buf, "\t%s;\n", e)
+	}
+	buf.WriteString("}\n")
+
+	w.Header().Set("Content-Type", "text/vnd.graphviz")
+	return buf.Bytes(), nil
+}
 
 // 返回DB中所有内容，一般用于调试
 func (s *httpServer) doDebug(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	s.ctx.nsqlookupd.DB.RLock()
-	defer s.ctx.nsqlookupd.DB.RUnlock()
-
 	data := make(map[string][]map[string]interface{})
-	for r, producers := range s.ctx.nsqlookupd.DB.registrationMap {
+	for r, producers := range s.ctx.nsqlookupd.DB.Snapshot() {
 		key := r.Category + ":" + r.Key + ":" + r.SubKey
 		for _, p := range producers {
-			m := map[string]interface{}{
-				"id":                p.peerInfo.id,
-				"hostname":          p.peerInfo.Hostname,
-				"broadcast_address": p.peerInfo.BroadcastAddress,
-				"tcp_port":          p.peerInfo.TCPPort,
-				"http_port":         p.peerInfo.HTTPPort,
-				"version":           p.peerInfo.Version,
-				"last_update":       atomic.LoadInt64(&p.peerInfo.lastUpdate),
-				"tombstoned":        p.tombstoned,
-				"tombstoned_at":     p.tombstonedAt.UnixNano(),
-			}
-			data[key] = append(data[key], m)
+			data[key] = append(data[key], s.debugProducer(p))
 		}
 	}
 
 	return data, nil
 }
+
+// 和doDebug 一样的输出格式，但只返回匹配category, key, subkey 的Registrations, key和subkey 支持通配符*
+func (s *httpServer) doRegistrations(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.ErrInvalidRequest.WithCause(err)
+	}
+
+	category, err := reqParams.Get("category")
+	if err != nil {
+		return nil, http_api.ErrMissingArg("category")
+	}
+	key, err := reqParams.Get("key")
+	if err != nil {
+		key = "*"
+	}
+	subkey, err := reqParams.Get("subkey")
+	if err != nil {
+		subkey = "*"
+	}
+
+	data := make(map[string][]map[string]interface{})
+	registrations := s.ctx.nsqlookupd.DB.FindRegistrations(category, key, subkey)
+	for _, r := range registrations {
+		k := r.Category + ":" + r.Key + ":" + r.SubKey
+		data[k] = []map[string]interface{}{}
+		for _, p := range s.ctx.nsqlookupd.DB.FindProducers(r.Category, r.Key, r.SubKey) {
+			data[k] = append(data[k], s.debugProducer(p))
+		}
+	}
+
+	return data, nil
+}
+
+func (s *httpServer) producerStatus(p *Producer) string {
+	opts := s.ctx.nsqlookupd.getOpts()
+	return p.Status(opts.InactiveProducerTimeout, opts.TombstoneLifetime)
+}
+
+func (s *httpServer) debugProducer(p *Producer) map[string]interface{} {
+	lastUpdate := atomic.LoadInt64(&p.peerInfo.lastUpdate)
+	tombstoned, tombstonedAt := p.tombstoneState()
+	data := map[string]interface{}{
+		"id":                p.peerInfo.id,
+		"hostname":          p.peerInfo.Hostname,
+		"broadcast_address": p.peerInfo.BroadcastAddress,
+		"tcp_port":          p.peerInfo.TCPPort,
+		"http_port":         p.peerInfo.HTTPPort,
+		"version":           p.peerInfo.Version,
+		"last_update":       lastUpdate,
+		"last_ping_ago_ms":  time.Since(time.Unix(0, lastUpdate)).Nanoseconds() / int64(time.Millisecond),
+		"connected_at":      p.peerInfo.connectedAt,
+		"tombstoned":        tombstoned,
+		"tombstoned_at":     tombstonedAt.UnixNano(),
+		"status":            s.producerStatus(p),
+	}
+	if p.peerInfo.tls {
+		data["tls"] = true
+		data["tls_common_name"] = p.peerInfo.tlsCommonName
+	}
+	return data
+}
+
+// optsConfig returns the options that have a flag, keyed by the flag name
+// with "-" replaced by "_", except for the sensitiveOptions
+func optsConfig(opts interface{}) map[string]interface{} {
+	cfg := make(map[string]interface{})
+	val := reflect.ValueOf(opts).Elem()
+	typ := val.Type()
+fields:
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		for _, s := range sensitiveOptions {
+			if strings.Contains(flagName, s) {
+				continue fields
+			}
+		}
+		cfg[strings.Replace(flagName, "-", "_", -1)] = val.Field(i).Interface()
+	}
+	return cfg
+}
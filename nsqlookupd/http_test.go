@@ -5,18 +5,25 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/test"
 	"github.com/nsqio/nsq/internal/version"
 	"github.com/nsqio/nsq/nsqd"
 )
 
 type InfoDoc struct {
-	Version string `json:"version"`
+	Version     string `json:"version"`
+	BuildCommit string `json:"build_commit"`
+	BuildDate   string `json:"build_date"`
 }
 
 type ChannelsDoc struct {
@@ -25,6 +32,7 @@ type ChannelsDoc struct {
 
 type ErrMessage struct {
 	Message string `json:"message"`
+	Error   string `json:"error"`
 }
 
 func bootstrapNSQCluster(t *testing.T) (string, []*nsqd.NSQD, *NSQLookupd) {
@@ -35,8 +43,14 @@ func bootstrapNSQCluster(t *testing.T) (string, []*nsqd.NSQD, *NSQLookupd) {
 	nsqlookupdOpts.HTTPAddress = "127.0.0.1:0"
 	nsqlookupdOpts.BroadcastAddress = "127.0.0.1"
 	nsqlookupdOpts.Logger = lgr
-	nsqlookupd1 := New(nsqlookupdOpts)
-	go nsqlookupd1.Main()
+	nsqlookupd1, err := New(nsqlookupdOpts)
+	if err != nil {
+		panic(err)
+	}
+	err = nsqlookupd1.Main()
+	if err != nil {
+		panic(err)
+	}
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -88,6 +102,32 @@ func TestPing(t *testing.T) {
 	test.Equal(t, []byte("OK"), body)
 }
 
+func TestPingDeep(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	url := fmt.Sprintf("http://%s/ping?deep=true", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, []byte("OK"), body)
+
+	// a DB that can't be read from fails the deep check
+	db := nsqlookupd1.DB.(*RegistrationDB)
+	db.Lock()
+	resp, err = http.Get(url)
+	db.Unlock()
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 503, resp.StatusCode)
+	test.Equal(t, []byte("DB_UNAVAILABLE"), body)
+}
+
 func TestInfo(t *testing.T) {
 	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -108,6 +148,17 @@ func TestInfo(t *testing.T) {
 	err = json.Unmarshal(body, &info)
 	test.Nil(t, err)
 	test.Equal(t, version.Binary, info.Version)
+	test.Equal(t, version.Commit, info.BuildCommit)
+	test.Equal(t, version.BuildDate, info.BuildDate)
+
+	// the build fields are present even when empty in development builds
+	var doc map[string]interface{}
+	err = json.Unmarshal(body, &doc)
+	test.Nil(t, err)
+	_, ok := doc["build_commit"]
+	test.Equal(t, true, ok)
+	_, ok = doc["build_date"]
+	test.Equal(t, true, ok)
 }
 
 func TestCreateTopic(t *testing.T) {
@@ -160,7 +211,74 @@ func TestCreateTopic(t *testing.T) {
 	resp.Body.Close()
 
 	t.Logf("%s", body)
-	test.Equal(t, []byte(""), body)
+	test.Equal(t, `{"created":true}`, string(body))
+
+	// creating it again is still a 200 by default
+	req, _ = http.NewRequest("POST", url, nil)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	test.Equal(t, `{"created":false}`, string(body))
+
+	req, _ = http.NewRequest("POST", url+"&fail_if_exists=true", nil)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 409, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	test.Equal(t, `{"created":false}`, string(body))
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&fail_if_exists=true", nsqlookupd1.RealHTTPAddr(), topicName+"B")
+	req, _ = http.NewRequest("POST", url, nil)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	test.Equal(t, `{"created":true}`, string(body))
+}
+
+func TestCreateTopicWithChannels(t *testing.T) {
+	nsqlookupd1, exit := startLookupd(t, NewOptions())
+	defer exit()
+	httpAddr := nsqlookupd1.RealHTTPAddr()
+
+	topicName := "create_topic_with_channels"
+
+	// nothing is created when a channel name is invalid
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&channel=ch1&channel=bad$", httpAddr, topicName)
+	resp, err := http.Post(url, "", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	em := ErrMessage{}
+	err = json.Unmarshal(body, &em)
+	test.Nil(t, err)
+	test.Equal(t, "INVALID_ARG_CHANNEL", em.Message)
+	test.Equal(t, 0, len(nsqlookupd1.DB.FindRegistrations("topic", topicName, "")))
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&channel=ch1&channel=ch2", httpAddr, topicName)
+	resp, err = http.Post(url, "", nil)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"created":true}`, string(body))
+
+	ch := ChannelsDoc{}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err = client.GETV1(fmt.Sprintf("http://%s/channels?topic=%s", httpAddr, topicName), &ch)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{"ch1", "ch2"}, ch.Channels)
 }
 
 func TestDeleteTopic(t *testing.T) {
@@ -282,6 +400,38 @@ func TestGetChannels(t *testing.T) {
 	test.Equal(t, channelName, ch.Channels[0])
 }
 
+func TestGetChannelsActiveOnly(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	now := time.Now()
+	topicName := "channels_active_only"
+	active := &PeerInfo{id: "1", lastUpdate: now.UnixNano()}
+	inactive := &PeerInfo{id: "2", lastUpdate: now.Add(-time.Hour).UnixNano()}
+	nsqlookupd1.DB.AddProducer(Registration{"channel", topicName, "active"}, &Producer{peerInfo: active})
+	nsqlookupd1.DB.AddProducer(Registration{"channel", topicName, "active"}, &Producer{peerInfo: inactive})
+	nsqlookupd1.DB.AddProducer(Registration{"channel", topicName, "inactive"}, &Producer{peerInfo: inactive})
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	ch := ChannelsDoc{}
+	err := client.GETV1(fmt.Sprintf("http://%s/channels?topic=%s", httpAddr, topicName), &ch)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{"active", "inactive"}, ch.Channels)
+
+	ch = ChannelsDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/channels?topic=%s&active_only=true", httpAddr, topicName), &ch)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{"active"}, ch.Channels)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/channels?topic=%s&active_only=x", httpAddr, topicName))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
 func TestCreateChannel(t *testing.T) {
 	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -466,3 +616,773 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	test.Equal(t, []byte(""), body)
 }
+
+func TestConfigCIDR(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AllowConfigFromCIDR = "10.0.0.0/8"
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	em := ErrMessage{}
+	url := fmt.Sprintf("http://%s/topic/create?topic=cidr_topic", httpAddr)
+	resp, err := http.Post(url, "", nil)
+	test.Nil(t, err)
+	test.Equal(t, 403, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	err = json.Unmarshal(body, &em)
+	test.Nil(t, err)
+	test.Equal(t, "FORBIDDEN", em.Message)
+	test.Equal(t, 0, len(nsqlookupd1.DB.FindRegistrations("topic", "cidr_topic", "")))
+
+	// read only endpoints are not restricted
+	resp, err = http.Get(fmt.Sprintf("http://%s/topics", httpAddr))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AllowConfigFromCIDR = "127.0.0.1/8"
+	_, httpAddr, nsqlookupd2 := mustStartLookupd(opts)
+	defer nsqlookupd2.Exit()
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=cidr_topic", httpAddr)
+	resp, err = http.Post(url, "", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, 1, len(nsqlookupd2.DB.FindRegistrations("topic", "cidr_topic", "")))
+}
+
+func TestReadOnly(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReadOnly = true
+	tcpAddr, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	topicName := "read_only"
+	makeTopic(nsqlookupd1, topicName)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	nsq.Register(topicName, "ch1").WriteTo(conn)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, true, strings.HasPrefix(string(v), "E_READONLY"))
+
+	nsq.UnRegister(topicName, "").WriteTo(conn)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, true, strings.HasPrefix(string(v), "E_READONLY"))
+
+	em := ErrMessage{}
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch1", httpAddr, topicName)
+	resp, err := http.Post(url, "", nil)
+	test.Nil(t, err)
+	test.Equal(t, 403, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	err = json.Unmarshal(body, &em)
+	test.Nil(t, err)
+	test.Equal(t, "READ_ONLY", em.Message)
+
+	// every route that changes the DB is refused
+	for _, path := range []string{
+		"/topic/create?topic=read_only2",
+		"/topic/delete?topic=" + topicName,
+		"/channel/delete?topic=" + topicName + "&channel=ch1",
+		"/channel/empty?topic=" + topicName + "&channel=ch1",
+		"/topic/tombstone?topic=" + topicName + "&node=127.0.0.1:4151",
+		"/topic/rename?topic=" + topicName + "&new_topic=read_only3",
+		"/channel/rename?topic=" + topicName + "&channel=ch1&new_channel=ch2",
+		"/node/unregister?node=127.0.0.1:4151",
+		"/node/touch?node=127.0.0.1:4151",
+		"/debug/gc",
+	} {
+		resp, err = http.Post(fmt.Sprintf("http://%s%s", httpAddr, path), "", nil)
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 403, resp.StatusCode)
+	}
+
+	// reads are still served
+	resp, err = http.Get(fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, 1, len(nsqlookupd1.DB.FindRegistrations("topic", topicName, "")))
+	test.Equal(t, 0, len(nsqlookupd1.DB.FindRegistrations("channel", topicName, "*")))
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/read_only?enabled=false", httpAddr), "", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, false, nsqlookupd1.IsReadOnly())
+
+	nsq.Register(topicName, "ch1").WriteTo(conn)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+	test.Equal(t, 1, len(nsqlookupd1.DB.FindRegistrations("channel", topicName, "*")))
+}
+
+func TestTopicsETag(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	makeTopic(nsqlookupd1, "etag_topic")
+
+	// plain /topics is streamed and has no ETag
+	url := fmt.Sprintf("http://%s/topics?include_channels=true", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	test.NotEqual(t, "", etag)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 304, resp.StatusCode)
+	test.Equal(t, 0, len(body))
+
+	makeTopic(nsqlookupd1, "etag_topic2")
+
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	// the ETag doesn't depend on the order topics are stored in
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	for i := 0; i < 10; i++ {
+		resp, err = http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 304, resp.StatusCode)
+	}
+}
+
+// writeCounter is a ResponseWriter that counts the writes of the body
+type writeCounter struct {
+	header http.Header
+	writes int
+	body   []byte
+}
+
+func (c *writeCounter) Header() http.Header { return c.header }
+func (c *writeCounter) WriteHeader(int)     {}
+func (c *writeCounter) Write(b []byte) (int, error) {
+	c.writes++
+	c.body = append(c.body, b...)
+	return len(b), nil
+}
+
+func TestTopicsStreamed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		makeTopic(nsqlookupd1, fmt.Sprintf("streamed_topic%d", i))
+	}
+
+	s := newHTTPServer(&Context{nsqlookupd: nsqlookupd1})
+	w := &writeCounter{header: make(http.Header)}
+	s.router.ServeHTTP(w, httptest.NewRequest("GET", "/topics", nil))
+
+	// written as the topics are produced, not buffered whole for an ETag
+	test.Equal(t, "", w.Header().Get("ETag"))
+	test.Equal(t, true, w.writes > n)
+	var doc struct {
+		Topics []string `json:"topics"`
+	}
+	err := json.Unmarshal(w.body, &doc)
+	test.Nil(t, err)
+	test.Equal(t, n, len(doc.Topics))
+}
+
+func TestTopicsStaleness(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	now := time.Now()
+	nsqlookupd1.DB.AddProducer(Registration{"topic", "fresh", ""},
+		&Producer{peerInfo: &PeerInfo{id: "1", lastUpdate: now.UnixNano()}})
+	nsqlookupd1.DB.AddProducer(Registration{"topic", "stale", ""},
+		&Producer{peerInfo: &PeerInfo{id: "2", lastUpdate: now.Add(-10 * time.Minute).UnixNano()}})
+	nsqlookupd1.DB.AddProducer(Registration{"topic", "stale", ""},
+		&Producer{peerInfo: &PeerInfo{id: "3", lastUpdate: now.Add(-2 * time.Minute).UnixNano()}})
+
+	type staleTopicsDoc struct {
+		Topics []struct {
+			Topic     string  `json:"topic"`
+			Staleness float64 `json:"staleness_seconds"`
+		} `json:"topics"`
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	doc := staleTopicsDoc{}
+	err := client.GETV1(fmt.Sprintf("http://%s/topics/staleness?threshold=1m", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Topics))
+	test.Equal(t, "stale", doc.Topics[0].Topic)
+	test.Equal(t, true, doc.Topics[0].Staleness >= 120 && doc.Topics[0].Staleness < 600)
+
+	// with the default threshold (--inactive-producer-timeout) nothing is stale
+	doc = staleTopicsDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/topics/staleness", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(doc.Topics))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topics/staleness?threshold=abc", httpAddr))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestLookupPrefix(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	pi := &PeerInfo{id: "1", BroadcastAddress: "host1", TCPPort: 4150, lastUpdate: time.Now().UnixNano()}
+	for _, topicName := range []string{"events.a", "events.b", "eventsx", "other.events.c"} {
+		nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""}, &Producer{peerInfo: pi})
+	}
+	makeTopic(nsqlookupd1, "events.c")
+
+	type prefixDoc struct {
+		Topics    map[string][]*PeerInfo `json:"topics"`
+		Truncated bool                   `json:"truncated"`
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	doc := prefixDoc{}
+	err := client.GETV1(fmt.Sprintf("http://%s/lookup?prefix=events.", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, false, doc.Truncated)
+	test.Equal(t, 3, len(doc.Topics))
+	test.Equal(t, 1, len(doc.Topics["events.a"]))
+	test.Equal(t, "host1", doc.Topics["events.a"][0].BroadcastAddress)
+	test.Equal(t, 1, len(doc.Topics["events.b"]))
+	test.Equal(t, 0, len(doc.Topics["events.c"]))
+
+	doc = prefixDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?prefix=nomatch", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(doc.Topics))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/lookup?prefix=", httpAddr))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	// the number of topics returned is capped
+	for i := 0; i < maxLookupPrefixTopics+5; i++ {
+		makeTopic(nsqlookupd1, fmt.Sprintf("many.%03d", i))
+	}
+	doc = prefixDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?prefix=many.", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, true, doc.Truncated)
+	test.Equal(t, maxLookupPrefixTopics, len(doc.Topics))
+	_, ok := doc.Topics["many.000"]
+	test.Equal(t, true, ok)
+}
+
+func TestLookupPreview(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	now := time.Now()
+	topicName := "lookup_preview"
+	nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""},
+		&Producer{peerInfo: &PeerInfo{id: "1", BroadcastAddress: "fresh", lastUpdate: now.UnixNano()}})
+	nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""},
+		&Producer{peerInfo: &PeerInfo{id: "2", BroadcastAddress: "lagging", lastUpdate: now.Add(-2 * time.Minute).UnixNano()}})
+
+	type previewDoc struct {
+		Kept []struct {
+			BroadcastAddress string `json:"broadcast_address"`
+			Lag              int64  `json:"lag_ms"`
+			Status           string `json:"status"`
+		} `json:"kept"`
+		Dropped []struct {
+			BroadcastAddress string `json:"broadcast_address"`
+			Lag              int64  `json:"lag_ms"`
+			Status           string `json:"status"`
+		} `json:"dropped"`
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	// the configured --inactive-producer-timeout (5m) keeps both
+	doc := previewDoc{}
+	err := client.GETV1(fmt.Sprintf("http://%s/lookup/preview?topic=%s", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Kept))
+	test.Equal(t, 0, len(doc.Dropped))
+
+	// a shorter timeout drops the lagging producer
+	doc = previewDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup/preview?topic=%s&inactivity=1m", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Kept))
+	test.Equal(t, "fresh", doc.Kept[0].BroadcastAddress)
+	test.Equal(t, ProducerActive, doc.Kept[0].Status)
+	test.Equal(t, 1, len(doc.Dropped))
+	test.Equal(t, "lagging", doc.Dropped[0].BroadcastAddress)
+	test.Equal(t, ProducerInactive, doc.Dropped[0].Status)
+	test.Equal(t, true, doc.Dropped[0].Lag >= int64(2*time.Minute/time.Millisecond))
+
+	// the server's configuration is unchanged
+	pr := ProducersDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName), &pr)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(pr.Producers))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/lookup/preview?topic=missing", httpAddr))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+}
+
+func TestLookupFreshness(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	now := time.Now()
+	topicName := "lookup_freshness"
+	for i, age := range []time.Duration{30 * time.Second, 0, 10 * time.Minute, 10 * time.Second} {
+		nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""},
+			&Producer{peerInfo: &PeerInfo{
+				id:               strconv.Itoa(i),
+				BroadcastAddress: fmt.Sprintf("host%d", i),
+				lastUpdate:       now.Add(-age).UnixNano(),
+			}})
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	// no params returns every active producer (host2 is inactive)
+	doc := LookupDoc{}
+	err := client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(doc.Producers))
+
+	doc = LookupDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s&sort=freshness", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(doc.Producers))
+	test.Equal(t, "host1", doc.Producers[0].BroadcastAddress)
+	test.Equal(t, "host3", doc.Producers[1].BroadcastAddress)
+	test.Equal(t, "host0", doc.Producers[2].BroadcastAddress)
+
+	doc = LookupDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s&sort=freshness&limit=2", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Producers))
+	test.Equal(t, "host1", doc.Producers[0].BroadcastAddress)
+	test.Equal(t, "host3", doc.Producers[1].BroadcastAddress)
+
+	for _, q := range []string{"limit=0", "limit=x", "sort=name"} {
+		resp, err := http.Get(fmt.Sprintf("http://%s/lookup?topic=%s&%s", httpAddr, topicName, q))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 400, resp.StatusCode)
+	}
+}
+
+func TestLookupAddresses(t *testing.T) {
+	nsqlookupd1, exit := startLookupd(t, NewOptions())
+	defer exit()
+	httpAddr := nsqlookupd1.RealHTTPAddr()
+
+	now := time.Now()
+	topicName := "lookup_addresses"
+	for i, addr := range []string{"host1", "10.0.0.2", "fd00::3"} {
+		nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""},
+			&Producer{peerInfo: &PeerInfo{
+				id:               strconv.Itoa(i),
+				BroadcastAddress: addr,
+				TCPPort:          4150 + i,
+				lastUpdate:       now.Add(-time.Duration(i) * time.Second).UnixNano(),
+			}})
+	}
+
+	var doc struct {
+		Producers []*PeerInfo `json:"producers"`
+		Addresses []string    `json:"addresses"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s&format=addresses&sort=freshness", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(doc.Producers))
+	test.Equal(t, []string{"host1:4150", "10.0.0.2:4151", "[fd00::3]:4152"}, doc.Addresses)
+
+	// not returned by default
+	doc.Addresses = nil
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(doc.Addresses))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/lookup?topic=%s&format=x", httpAddr, topicName))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestTopologyDOT(t *testing.T) {
+	nsqlookupd1, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	for i, addr := range []string{"host1", "host2"} {
+		nsqlookupd1.DB.AddProducer(Registration{"topic", "topology", ""},
+			&Producer{peerInfo: &PeerInfo{id: strconv.Itoa(i), BroadcastAddress: addr, TCPPort: 4150}})
+	}
+	nsqlookupd1.DB.AddRegistration(Registration{"channel", "topology", "ch"})
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topology.dot", nsqlookupd1.RealHTTPAddr()))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "text/vnd.graphviz", resp.Header.Get("Content-Type"))
+	test.Equal(t, `digraph nsq {
+	"channel:topology/ch" [shape=note, label="ch"];
+	"producer:host1:4150" [shape=box, label="host1:4150"];
+	"producer:host2:4150" [shape=box, label="host2:4150"];
+	"topic:topology" [shape=ellipse, label="topology"];
+	"producer:host1:4150" -> "topic:topology";
+	"producer:host2:4150" -> "topic:topology";
+	"topic:topology" -> "channel:topology/ch";
+}
+`, string(body))
+}
+
+func TestChannelsMultipleTopics(t *testing.T) {
+	nsqlookupd1, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	db := nsqlookupd1.DB
+	db.AddRegistration(Registration{"topic", "t1", ""})
+	db.AddRegistration(Registration{"channel", "t1", "ch1"})
+	db.AddRegistration(Registration{"channel", "t1", "ch2"})
+	db.AddRegistration(Registration{"topic", "t2", ""})
+	db.AddRegistration(Registration{"channel", "t2", "ch3"})
+	db.AddRegistration(Registration{"topic", "t3", ""})
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/channels?topic=t1&topic=t2&topic=t3&topic=unknown",
+		nsqlookupd1.RealHTTPAddr())
+	var channels map[string][]string
+	err := client.GETV1(endpoint, &channels)
+	test.Nil(t, err)
+	test.Equal(t, map[string][]string{
+		"t1": {"ch1", "ch2"},
+		"t2": {"ch3"},
+		"t3": {},
+	}, channels)
+
+	// 单个topic 时返回格式不变
+	ch := ChannelsDoc{}
+	endpoint = fmt.Sprintf("http://%s/channels?topic=t1", nsqlookupd1.RealHTTPAddr())
+	err = client.GETV1(endpoint, &ch)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{"ch1", "ch2"}, ch.Channels)
+
+	params := url.Values{}
+	for i := 0; i <= maxChannelsTopics; i++ {
+		params.Add("topic", fmt.Sprintf("t%d", i))
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/channels?%s", nsqlookupd1.RealHTTPAddr(), params.Encode()))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestConfig(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.InactiveProducerTimeout = 42 * time.Second
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	var cfg map[string]interface{}
+	err := client.GETV1(fmt.Sprintf("http://%s/config", httpAddr), &cfg)
+	test.Nil(t, err)
+	test.Equal(t, float64(42*time.Second), cfg["inactive_producer_timeout"])
+	test.Equal(t, float64(opts.TombstoneLifetime), cfg["tombstone_lifetime"])
+	test.Equal(t, opts.BroadcastAddress, cfg["broadcast_address"])
+	_, ok := cfg["tcp_listener"]
+	test.Equal(t, false, ok)
+
+	type secretOptions struct {
+		TLSKey      string `flag:"tls-key"`
+		AuthToken   string `flag:"auth-token"`
+		HTTPAddress string `flag:"http-address"`
+		Logger      Logger
+	}
+	cfg = optsConfig(&secretOptions{"/etc/key.pem", "hunter2", "127.0.0.1:4161", nil})
+	test.Equal(t, map[string]interface{}{"http_address": "127.0.0.1:4161"}, cfg)
+}
+
+func TestUpdateConfig(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	now := time.Now()
+	topicName := "update_config"
+	nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""},
+		&Producer{peerInfo: &PeerInfo{id: "1", BroadcastAddress: "fresh", lastUpdate: now.UnixNano()}})
+	nsqlookupd1.DB.AddProducer(Registration{"topic", topicName, ""},
+		&Producer{peerInfo: &PeerInfo{id: "2", BroadcastAddress: "lagging", lastUpdate: now.Add(-2 * time.Minute).UnixNano()}})
+
+	put := func(query string) int {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("http://%s/config?%s", httpAddr, query), nil)
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	lookup := func() []*PeerInfo {
+		var doc struct {
+			Producers []*PeerInfo `json:"producers"`
+		}
+		err := client.GETV1(fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName), &doc)
+		test.Nil(t, err)
+		return doc.Producers
+	}
+
+	test.Equal(t, 2, len(lookup()))
+
+	test.Equal(t, 400, put(""))
+	test.Equal(t, 400, put("inactive_producer_timeout=soon"))
+	test.Equal(t, 400, put("tombstone_lifetime=-1s"))
+	test.Equal(t, 2, len(lookup()))
+
+	test.Equal(t, 200, put("inactive_producer_timeout=1m&tombstone_lifetime=10s"))
+	producers := lookup()
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, "fresh", producers[0].BroadcastAddress)
+
+	var cfg map[string]interface{}
+	err := client.GETV1(fmt.Sprintf("http://%s/config", httpAddr), &cfg)
+	test.Nil(t, err)
+	test.Equal(t, float64(time.Minute), cfg["inactive_producer_timeout"])
+	test.Equal(t, float64(10*time.Second), cfg["tombstone_lifetime"])
+}
+
+func TestTopicsIncludeChannels(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	makeChannel(nsqlookupd1, "topic_a", "ch2")
+	makeChannel(nsqlookupd1, "topic_a", "ch1")
+	makeTopic(nsqlookupd1, "topic_b")
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	var flat struct {
+		Topics []string `json:"topics"`
+	}
+	err := client.GETV1(fmt.Sprintf("http://%s/topics", httpAddr), &flat)
+	test.Nil(t, err)
+	test.Equal(t, []string{"topic_a", "topic_b"}, flat.Topics)
+
+	flat.Topics = nil
+	err = client.GETV1(fmt.Sprintf("http://%s/topics?include_channels=false", httpAddr), &flat)
+	test.Nil(t, err)
+	test.Equal(t, []string{"topic_a", "topic_b"}, flat.Topics)
+
+	var nested struct {
+		Topics    map[string][]string `json:"topics"`
+		Truncated bool                `json:"truncated"`
+	}
+	err = client.GETV1(fmt.Sprintf("http://%s/topics?include_channels=true", httpAddr), &nested)
+	test.Nil(t, err)
+	test.Equal(t, map[string][]string{
+		"topic_a": {"ch1", "ch2"},
+		"topic_b": {},
+	}, nested.Topics)
+	test.Equal(t, false, nested.Truncated)
+
+	topics, truncated := nsqlookupd1.DB.TopicChannels(1)
+	test.Equal(t, map[string][]string{"topic_a": {"ch1", "ch2"}}, topics)
+	test.Equal(t, true, truncated)
+
+	err = client.GETV1(fmt.Sprintf("http://%s/topics?include_channels=maybe", httpAddr), &nested)
+	test.NotNil(t, err)
+}
+
+func TestEmptyChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	topicName := "empty_channel"
+	for _, id := range []string{"1", "2"} {
+		nsqlookupd1.DB.AddProducer(Registration{"channel", topicName, "ch"},
+			&Producer{peerInfo: &PeerInfo{id: id}})
+	}
+
+	post := func(channel string) (int, []byte) {
+		url := fmt.Sprintf("http://%s/channel/empty?topic=%s&channel=%s", httpAddr, topicName, channel)
+		resp, err := http.Post(url, "", nil)
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, body
+	}
+
+	code, body := post("missing")
+	test.Equal(t, 404, code)
+
+	code, body = post("ch")
+	test.Equal(t, 200, code)
+	test.Equal(t, `{"removed":2}`, string(body))
+	test.Equal(t, 1, len(nsqlookupd1.DB.FindRegistrations("channel", topicName, "ch")))
+	test.Equal(t, 0, len(nsqlookupd1.DB.FindProducers("channel", topicName, "ch")))
+
+	code, body = post("ch")
+	test.Equal(t, 200, code)
+	test.Equal(t, `{"removed":0}`, string(body))
+}
+
+func TestDebugGC(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	topicName := "debug_gc"
+	peerInfo := &PeerInfo{id: "1"}
+	for _, k := range []Registration{
+		{"client", "", ""},
+		{"topic", topicName, ""},
+		{"channel", topicName, "ch1"},
+		{"channel", topicName, "ch2"},
+	} {
+		nsqlookupd1.DB.AddProducer(k, &Producer{peerInfo: peerInfo})
+	}
+	// leaves empty keys behind
+	nsqlookupd1.DB.RemoveProducer(Registration{"topic", topicName, ""}, "1")
+	nsqlookupd1.DB.RemoveProducer(Registration{"channel", topicName, "ch1"}, "1")
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/debug/gc", httpAddr), "", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"removed":2}`, string(body))
+
+	test.Equal(t, 0, len(nsqlookupd1.DB.FindRegistrations("topic", topicName, "")))
+	test.Equal(t, []string{"ch2"}, nsqlookupd1.DB.FindRegistrations("channel", topicName, "*").SubKeys())
+	test.Equal(t, 1, len(nsqlookupd1.DB.FindProducers("client", "", "")))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPMaxBodySize = 64
+	_, httpAddr, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	url := fmt.Sprintf("http://%s/topic/create?topic=max_body_size", httpAddr)
+
+	resp, err := http.Post(url, "text/plain", strings.NewReader(strings.Repeat("a", 65)))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 413, resp.StatusCode)
+	em := ErrMessage{}
+	err = json.Unmarshal(body, &em)
+	test.Nil(t, err)
+	test.Equal(t, "BODY_TOO_LARGE", em.Message)
+	test.Equal(t, 0, len(nsqlookupd1.DB.FindRegistrations("topic", "max_body_size", "")))
+
+	resp, err = http.Post(url, "text/plain", strings.NewReader(strings.Repeat("a", 64)))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+}
+
+func benchmarkDebugServer(b *testing.B) *httpServer {
+	opts := NewOptions()
+	opts.LogWriter = ioutil.Discard
+	nsqlookupd, err := New(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 10; j++ {
+			peerInfo := &PeerInfo{id: fmt.Sprintf("node%d:4150", j), lastUpdate: time.Now().UnixNano()}
+			nsqlookupd.DB.AddProducer(Registration{"topic", fmt.Sprintf("topic%d", i), ""},
+				&Producer{peerInfo: peerInfo})
+		}
+	}
+	return &httpServer{ctx: &Context{nsqlookupd: nsqlookupd}}
+}
+
+// BenchmarkDebugLockHeld builds the /debug output while holding the read
+// lock, ns/op is how long writers are blocked
+func BenchmarkDebugLockHeld(b *testing.B) {
+	s := benchmarkDebugServer(b)
+	db := s.ctx.nsqlookupd.DB.(*RegistrationDB)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.RLock()
+		data := make(map[string][]map[string]interface{})
+		for r, producers := range db.registrationMap {
+			key := r.Category + ":" + r.Key + ":" + r.SubKey
+			for _, p := range producers {
+				data[key] = append(data[key], s.debugProducer(p))
+			}
+		}
+		db.RUnlock()
+	}
+}
+
+// BenchmarkDebugSnapshot is the part of /debug done under the read lock now
+// that the output is built from a Snapshot()
+func BenchmarkDebugSnapshot(b *testing.B) {
+	s := benchmarkDebugServer(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ctx.nsqlookupd.DB.Snapshot()
+	}
+}
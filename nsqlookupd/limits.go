@@ -0,0 +1,49 @@
+package nsqlookupd
+
+import (
+	"fmt"
+)
+
+// checkLimits returns an error if adding regs (topic and channel
+// registrations, a channel implies its topic) would take the DB past
+// MaxTopics or MaxChannelsPerTopic. Registrations that already exist don't
+// count. Checking and adding aren't atomic, so concurrent requests can
+// overshoot a limit slightly.
+func (l *NSQLookupd) checkLimits(regs []Registration) error {
+	opts := l.getOpts()
+	if opts.MaxTopics <= 0 && opts.MaxChannelsPerTopic <= 0 {
+		return nil
+	}
+
+	newTopics := make(map[string]bool)
+	newChannels := make(map[string]map[string]bool)
+	for _, r := range regs {
+		if opts.MaxTopics > 0 && !newTopics[r.Key] &&
+			len(l.DB.FindRegistrations("topic", r.Key, "")) == 0 {
+			newTopics[r.Key] = true
+		}
+		if r.Category != "channel" || opts.MaxChannelsPerTopic <= 0 {
+			continue
+		}
+		if len(l.DB.FindRegistrations("channel", r.Key, r.SubKey)) == 0 {
+			if newChannels[r.Key] == nil {
+				newChannels[r.Key] = make(map[string]bool)
+			}
+			newChannels[r.Key][r.SubKey] = true
+		}
+	}
+
+	if len(newTopics) > 0 {
+		n := len(l.DB.FindRegistrations("topic", "*", ""))
+		if n+len(newTopics) > opts.MaxTopics {
+			return fmt.Errorf("too many topics (max %d)", opts.MaxTopics)
+		}
+	}
+	for topic, channels := range newChannels {
+		n := len(l.DB.FindRegistrations("channel", topic, "*"))
+		if n+len(channels) > opts.MaxChannelsPerTopic {
+			return fmt.Errorf("too many channels for topic %s (max %d)", topic, opts.MaxChannelsPerTopic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package nsqlookupd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// the upper bounds of the lock wait histogram buckets, waits longer than
+// the last one are counted in a final +Inf bucket
+var lockWaitBuckets = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// waitHistogram counts lock waits by duration, it is safe for concurrent use
+type waitHistogram struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	count int64
+	sum   int64 // nanoseconds
+
+	buckets []int64
+}
+
+func newWaitHistogram() *waitHistogram {
+	return &waitHistogram{
+		buckets: make([]int64, len(lockWaitBuckets)+1),
+	}
+}
+
+func (h *waitHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(lockWaitBuckets) && d > lockWaitBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+type LockWaitBucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// LockWaitStats is how long AddProducer and RemoveProducer waited for the
+// RegistrationDB write lock, Buckets aren't cumulative
+type LockWaitStats struct {
+	Count   int64            `json:"count"`
+	TotalMs float64          `json:"total_ms"`
+	Buckets []LockWaitBucket `json:"buckets"`
+}
+
+func (h *waitHistogram) stats() LockWaitStats {
+	s := LockWaitStats{
+		Count:   atomic.LoadInt64(&h.count),
+		TotalMs: float64(atomic.LoadInt64(&h.sum)) / float64(time.Millisecond),
+		Buckets: make([]LockWaitBucket, len(h.buckets)),
+	}
+	for i := range h.buckets {
+		le := "+Inf"
+		if i < len(lockWaitBuckets) {
+			le = lockWaitBuckets[i].String()
+		}
+		s.Buckets[i] = LockWaitBucket{le, atomic.LoadInt64(&h.buckets[i])}
+	}
+	return s
+}
@@ -0,0 +1,123 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// the most distinct messages a repeatLogger tracks at once, further
+// messages are logged as is
+const repeatLoggerMaxEntries = 1024
+
+// repeatLogger collapses a message logged again, under the same key, within
+// window of its first occurrence: the first is logged, the repeats are only
+// counted and, once the window has passed, logged as a single
+// "(repeated N times)" line with the most recent of them.
+type repeatLogger struct {
+	sync.Mutex
+	window  time.Duration
+	logf    lg.AppLogFunc
+	entries map[string]*repeatEntry
+}
+
+type repeatEntry struct {
+	level    lg.LogLevel
+	msg      string // the most recent
+	start    time.Time
+	repeated int
+}
+
+func newRepeatLogger(window time.Duration, logf lg.AppLogFunc) *repeatLogger {
+	return &repeatLogger{
+		window:  window,
+		logf:    logf,
+		entries: make(map[string]*repeatEntry),
+	}
+}
+
+// log logs msg unless a message with key was logged within the window
+func (r *repeatLogger) log(level lg.LogLevel, key string, msg string) {
+	now := time.Now()
+	r.Lock()
+	expired := r.expire(now)
+	e, repeat := r.entries[key]
+	if repeat {
+		e.msg = msg
+		e.repeated++
+	} else if len(r.entries) < repeatLoggerMaxEntries {
+		r.entries[key] = &repeatEntry{level: level, msg: msg, start: now}
+	}
+	r.Unlock()
+
+	r.logRepeated(expired)
+	if !repeat {
+		r.logf(level, "%s", msg)
+	}
+}
+
+// flush logs the repeats of messages whose window has passed
+func (r *repeatLogger) flush() {
+	r.Lock()
+	expired := r.expire(time.Now())
+	r.Unlock()
+	r.logRepeated(expired)
+}
+
+// expire removes the entries whose window has passed before now, returning
+// those that were repeated. It must be called with the lock held.
+func (r *repeatLogger) expire(now time.Time) []*repeatEntry {
+	var expired []*repeatEntry
+	for key, e := range r.entries {
+		if now.Sub(e.start) < r.window {
+			continue
+		}
+		delete(r.entries, key)
+		if e.repeated > 0 {
+			expired = append(expired, e)
+		}
+	}
+	return expired
+}
+
+func (r *repeatLogger) logRepeated(entries []*repeatEntry) {
+	for _, e := range entries {
+		r.logf(e.level, "%s (repeated %d times)", e.msg, e.repeated)
+	}
+}
+
+// flushLoop logs repeats every window until exitChan is closed, then
+// logs those left
+func (r *repeatLogger) flushLoop(exitChan chan struct{}) {
+	ticker := time.NewTicker(r.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-exitChan:
+			r.Lock()
+			entries := r.expire(time.Now().Add(r.window))
+			r.Unlock()
+			r.logRepeated(entries)
+			return
+		}
+	}
+}
+
+// logClientErrf logs an error caused by the client on conn, identical
+// errors from the same IP (e.g. a client reconnecting in a loop) within
+// LogRepeatWindow are collapsed
+func (l *NSQLookupd) logClientErrf(level lg.LogLevel, conn net.Conn, f string, args ...interface{}) {
+	text := fmt.Sprintf(f, args...)
+	msg := fmt.Sprintf("[%s] - %s", conn.RemoteAddr(), text)
+	if l.repeatLog == nil {
+		l.logf(level, "%s", msg)
+		return
+	}
+	key := fmt.Sprintf("%s %s %s", level, remoteIP(conn), text)
+	l.repeatLog.log(level, key, msg)
+}
@@ -15,5 +15,6 @@ const (
 )
 
 func (n *NSQLookupd) logf(level lg.LogLevel, f string, args ...interface{}) {
-	lg.Logf(n.opts.Logger, n.opts.logLevel, level, f, args...)
+	opts := n.getOpts()
+	lg.Logf(opts.Logger, opts.logLevel, level, f, args...)
 }
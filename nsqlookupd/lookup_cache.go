@@ -0,0 +1,102 @@
+package nsqlookupd
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lookupCache caches, per topic, the registrations /lookup reads from the
+// DB. Entries are invalidated by the DB's change events for the topic and
+// its channels, so what is cached is always what the DB would return.
+// Filtering by activity is still done on every lookup as it depends on the
+// current time.
+type lookupCache struct {
+	sync.Mutex
+	size    int
+	ll      *list.List // most recently used at the front
+	entries map[string]*list.Element
+
+	hits   int64
+	misses int64
+}
+
+type lookupCacheEntry struct {
+	topic     string
+	ready     bool
+	exists    bool
+	channels  []string
+	producers Producers
+}
+
+// changeNotifier is implemented by stores that can call back synchronously
+// on every change, see RegistrationDB.OnChange
+type changeNotifier interface {
+	OnChange(f func(RegistrationEvent))
+}
+
+func newLookupCache(size int) *lookupCache {
+	return &lookupCache{
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// invalidate is called for every change to the DB
+func (c *lookupCache) invalidate(e RegistrationEvent) {
+	if e.Category != "topic" && e.Category != "channel" {
+		return
+	}
+	c.Lock()
+	if el, ok := c.entries[e.Key]; ok {
+		c.ll.Remove(el)
+		delete(c.entries, e.Key)
+	}
+	c.Unlock()
+}
+
+// get returns the cached registrations of topic, calling fill to read them
+// from the DB on a miss. What is returned is shared and must not be modified.
+func (c *lookupCache) get(topic string, fill func() (bool, []string, Producers)) (bool, []string, Producers) {
+	c.Lock()
+	if el, ok := c.entries[topic]; ok && el.Value.(*lookupCacheEntry).ready {
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*lookupCacheEntry)
+		c.hits++
+		c.Unlock()
+		return entry.exists, entry.channels, entry.producers
+	}
+	c.misses++
+	// a pending entry, if it is invalidated (or evicted) while the DB is
+	// read the result may already be stale and isn't stored
+	entry := &lookupCacheEntry{topic: topic}
+	if el, ok := c.entries[topic]; ok {
+		c.ll.Remove(el)
+	}
+	c.entries[topic] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupCacheEntry).topic)
+	}
+	c.Unlock()
+
+	exists, channels, producers := fill()
+
+	c.Lock()
+	if el, ok := c.entries[topic]; ok && el.Value == entry {
+		entry.exists = exists
+		entry.channels = channels
+		entry.producers = producers
+		entry.ready = true
+	}
+	c.Unlock()
+	return exists, channels, producers
+}
+
+// stats returns the number of hits and misses
+func (c *lookupCache) stats() (int64, int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses
+}
@@ -2,13 +2,16 @@ package nsqlookupd
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -19,24 +22,90 @@ import (
 
 type LookupProtocolV1 struct {
 	ctx *Context
+
+	// the version the client negotiated, 0 for V1, see LookupProtocolV2
+	protocolVersion int
 }
 
 // V1 的TCP服务请求处理函数，由tcpServer.Handle调用
 func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
+	return p.IOLoopContext(context.Background(), conn)
+}
+
+// IOLoopContext 与IOLoop 相同, ctx 被cancel 时读超时会打断等待中的读取,
+// 正在执行的命令会先完成
+func (p *LookupProtocolV1) IOLoopContext(ctx context.Context, conn net.Conn) error {
 	var err error
 	var line string
 
+	exitCh := make(chan struct{})
+	defer close(exitCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-exitCh:
+		}
+	}()
+
 	client := NewClientV1(conn)
-	reader := bufio.NewReader(client)
+	client.id = atomic.AddInt64(&p.ctx.lastClientID, 1)
+	err = client.readTLSState()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("TLS handshake failed - %s", err)
+	}
+	if rate := p.ctx.nsqlookupd.getOpts().CommandRateLimit; rate > 0 {
+		client.limiter = newTokenBucket(rate, p.ctx.nsqlookupd.getOpts().CommandRateBurst)
+	}
+	atomic.AddInt64(&p.ctx.clientCount, 1)
+	defer atomic.AddInt64(&p.ctx.clientCount, -1)
+
+	// deferred so that the client's registrations are also removed when a
+	// command panics
+	defer func() {
+		conn.Close()
+		p.ctx.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): closing", client)
+		// tcp连接关闭后，该连接的资源也要释放，如果有的话，
+		// 资源应该是在Exec方法里面 "REGISTER" 方注册的
+		if client.peerInfo != nil {
+			registrations := p.ctx.nsqlookupd.DB.RemoveAllProducersOwnedBy(client.peerInfo)
+			if len(registrations) > 0 {
+				p.ctx.registrationChanged()
+			}
+			for _, r := range registrations {
+				p.logRegistration(client, "UNREGISTER", r)
+			}
+		}
+	}()
+
+	// the reader's buffer bounds the length of a command line
+	reader := bufio.NewReaderSize(client, p.ctx.nsqlookupd.getOpts().MaxLineLength)
 	// 每行是一条命令，'\n' 作为命令分隔符
 	for {
-		line, err = reader.ReadString('\n')
+		var lineBytes []byte
+		lineBytes, err = reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = protocol.NewFatalClientErr(nil, "E_BAD_LINE",
+				fmt.Sprintf("line exceeds max length %d", p.ctx.nsqlookupd.getOpts().MaxLineLength))
+			p.ctx.nsqlookupd.logClientErrf(LOG_ERROR, client, "%s", err)
+			p.sendResponse(client, "", []byte(err.Error()))
+			break
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				// cancelled, not a client error
+				err = nil
+			}
 			break
 		}
 
-		line = strings.TrimSpace(line)
-		params := strings.Split(line, " ")
+		line = strings.TrimSpace(string(lineBytes))
+		// 空行忽略，命令和参数之间多余的空白也忽略
+		params := strings.Fields(line)
+		if len(params) == 0 {
+			continue
+		}
 
 		var response []byte
 
@@ -48,11 +117,9 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 			if parentErr := err.(protocol.ChildErr).Parent(); parentErr != nil {
 				ctx = " - " + parentErr.Error()
 			}
-			p.ctx.nsqlookupd.logf(LOG_ERROR, "[%s] - %s%s", client, err, ctx)
+			p.ctx.nsqlookupd.logClientErrf(LOG_ERROR, client, "%s%s", err, ctx)
 
-			_, sendErr := protocol.SendResponse(client, []byte(err.Error()))
-			if sendErr != nil {
-				p.ctx.nsqlookupd.logf(LOG_ERROR, "[%s] - %s%s", client, sendErr, ctx)
+			if sendErr := p.sendResponse(client, params[0], []byte(err.Error())); sendErr != nil {
 				break
 			}
 
@@ -69,46 +136,102 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 		// 回复请求处理结果
 		if response != nil {
 			// SendResponse 将会先发送返回数据的长度，4字节，发送response, 总共是len(response) + sizeof(int32)
-			_, err = protocol.SendResponse(client, response)
+			// 发送失败时命令已经生效了，连接关闭后会清理该client 的注册信息,
+			// client 重连后重新注册即可
+			err = p.sendResponse(client, params[0], response)
 			if err != nil {
 				break
 			}
 		}
 	}
+	return err
+}
 
-	conn.Close()
-	p.ctx.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): closing", client)
-	// tcp连接关闭后，该连接的资源也要释放，如果有的话，
-	// 资源应该是在Exec方法里面 "REGISTER" 方注册的
-	if client.peerInfo != nil {
-		registrations := p.ctx.nsqlookupd.DB.LookupRegistrations(client.peerInfo.id)
-		for _, r := range registrations {
-			if removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
-				p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
-					client, r.Category, r.Key, r.SubKey)
-			}
+// sendResponse sends a response to command (empty when the line couldn't be
+// parsed), a failure is a write error on the connection rather than a
+// protocol error so it is logged and counted separately
+func (p *LookupProtocolV1) sendResponse(client *ClientV1, command string, response []byte) error {
+	_, err := protocol.SendResponseTimeout(client, response, p.ctx.nsqlookupd.getOpts().TCPWriteTimeout)
+	if err != nil {
+		atomic.AddInt64(&p.ctx.sendFailureCount, 1)
+		if command == "" {
+			command = "unparsed line"
 		}
+		p.ctx.nsqlookupd.logf(LOG_WARN, "[%s] - write error sending response to %s - %s", client, command, err)
 	}
 	return err
 }
 
-// 目前支持四种命令：PING， IDENTIFY， REGISTER， UNREFIGISTER，如果不是这4种，返回一个FatalClientErr,连接将被强制关闭
+// 目前支持的命令：PING， IDENTIFY， REGISTER， MREGISTER， UNREFIGISTER， LIST， STATS，如果不是这些，返回一个FatalClientErr,连接将被强制关闭
 func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if len(params) == 0 {
+		// 空行，没有需要回复的
+		return nil, nil
+	}
 	switch params[0] {
 	case "PING":
+		atomic.AddInt64(&p.ctx.pingCount, 1)
 		return p.PING(client, params)
 	case "IDENTIFY":
+		atomic.AddInt64(&p.ctx.identifyCount, 1)
 		return p.IDENTIFY(client, reader, params[1:])
 	case "REGISTER":
+		atomic.AddInt64(&p.ctx.registerCount, 1)
+		if err := p.checkRate(client, "REGISTER"); err != nil {
+			return nil, err
+		}
 		return p.REGISTER(client, reader, params[1:])
+	case "MREGISTER":
+		atomic.AddInt64(&p.ctx.registerCount, 1)
+		return p.MREGISTER(client, reader, params[1:])
 	case "UNREGISTER":
+		atomic.AddInt64(&p.ctx.unregisterCount, 1)
+		if err := p.checkRate(client, "UNREGISTER"); err != nil {
+			return nil, err
+		}
 		return p.UNREGISTER(client, reader, params[1:])
+	case "LIST":
+		return p.LIST(client, params[1:])
+	case "STATS":
+		return p.STATS(client, params[1:])
 	}
 	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
 
+// 限制REGISTER/UNREGISTER 的频率(PING, IDENTIFY 不受限制)，
+// 超过限制时暂停一会儿再返回E_RATE_LIMITED, 连接不会被关闭
+func (p *LookupProtocolV1) checkRate(client *ClientV1, command string) error {
+	if client.limiter == nil {
+		return nil
+	}
+	ok, wait := client.limiter.take(time.Now())
+	if ok {
+		return nil
+	}
+	if wait > maxRateLimitPause {
+		wait = maxRateLimitPause
+	}
+	time.Sleep(wait)
+	return protocol.NewClientErr(nil, "E_RATE_LIMITED", fmt.Sprintf("%s rate limit exceeded", command))
+}
+
+// IDENTIFY 时带了epoch 的client, 只有epoch 不低于该节点见过的最高epoch 时
+// 才能注册, 防止失去所有权的旧nsqd 覆盖新的注册信息 (不带epoch 不检查)
+func (p *LookupProtocolV1) checkEpoch(client *ClientV1, command string) error {
+	epoch := client.peerInfo.epoch
+	if epoch == 0 {
+		return nil
+	}
+	node := epochNode(client.peerInfo)
+	if !p.ctx.nsqlookupd.DB.FenceEpoch(node, epoch) {
+		return protocol.NewClientErr(nil, "E_STALE",
+			fmt.Sprintf("%s failed, epoch %d is stale for %s", command, epoch, node))
+	}
+	return nil
+}
+
 // params[0] 是 topicName, params[1]是channelName, 获取之前先检查有效性
-func getTopicChan(command string, params []string) (string, string, error) {
+func (p *LookupProtocolV1) getTopicChan(command string, params []string) (string, string, error) {
 	if len(params) == 0 {
 		return "", "", protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("%s insufficient number of params", command))
 	}
@@ -127,6 +250,7 @@ func getTopicChan(command string, params []string) (string, string, error) {
 		return "", "", protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL", fmt.Sprintf("%s channel name '%s' is not valid", command, channelName))
 	}
 
+	topicName, channelName = p.ctx.nsqlookupd.normalizeTopicChannel(topicName, channelName)
 	return topicName, channelName, nil
 }
 
@@ -137,27 +261,171 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
 	}
 
-	topic, channel, err := getTopicChan("REGISTER", params)
+	if p.ctx.nsqlookupd.IsReadOnly() {
+		return nil, protocol.NewClientErr(nil, "E_READONLY", "REGISTER failed, nsqlookupd is read-only")
+	}
+
+	topic, channel, err := p.getTopicChan("REGISTER", params)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := p.checkEpoch(client, "REGISTER"); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkTopicExists(client, "REGISTER", topic); err != nil {
+		return nil, err
+	}
+
+	if err := p.checkLimits(client, "REGISTER", []Registration{registrationFor(topic, channel)}); err != nil {
+		return nil, err
+	}
+
+	// any protocol activity counts as liveness, not just PING
+	atomic.StoreInt64(&client.peerInfo.lastUpdate, time.Now().UnixNano())
+
+	p.register(client, topic, channel)
+
+	return []byte("OK"), nil
+}
+
+// MREGISTER 一次注册多个topic/channel, body 每行一个 "topic [channel]"
+// 先检查所有条目，只要有一个无效就全部不注册并返回错误，全部有效才逐个注册
+func (p *LookupProtocolV1) MREGISTER(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	var bodyLen int32
+	err := binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MREGISTER failed to read body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MREGISTER invalid body size %d", bodyLen))
+	}
+	if max := p.ctx.nsqlookupd.getOpts().MaxBodySize; int(bodyLen) > max {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MREGISTER body too big %d > %d", bodyLen, max))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MREGISTER failed to read body")
+	}
+
+	if p.ctx.nsqlookupd.IsReadOnly() {
+		return nil, protocol.NewClientErr(nil, "E_READONLY", "MREGISTER failed, nsqlookupd is read-only")
+	}
+
+	// the body has to be read before rejecting, to stay in sync with the client
+	if err := p.checkRate(client, "MREGISTER"); err != nil {
+		return nil, err
+	}
+
+	type topicChan struct {
+		topic   string
+		channel string
+	}
+	var entries []topicChan
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		topic, channel, err := p.getTopicChan("MREGISTER", strings.Fields(line))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, topicChan{topic, channel})
+	}
+
+	if len(entries) == 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", "MREGISTER no topics in body")
+	}
+
+	if err := p.checkEpoch(client, "MREGISTER"); err != nil {
+		return nil, err
+	}
+
+	regs := make([]Registration, len(entries))
+	for i, e := range entries {
+		if err := p.checkTopicExists(client, "MREGISTER", e.topic); err != nil {
+			return nil, err
+		}
+		regs[i] = registrationFor(e.topic, e.channel)
+	}
+	if err := p.checkLimits(client, "MREGISTER", regs); err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt64(&client.peerInfo.lastUpdate, time.Now().UnixNano())
+
+	for _, e := range entries {
+		p.register(client, e.topic, e.channel)
+	}
+
+	return []byte("OK"), nil
+}
+
+// 开启了RequireExplicitTopics 时, topic 必须先通过/topic/create 创建, 否则返回E_TOPIC_NOT_FOUND,
+// 连接不会被关闭. ephemeral topic 不能被创建, 所以不受限制
+func (p *LookupProtocolV1) checkTopicExists(client *ClientV1, command string, topic string) error {
+	if !p.ctx.nsqlookupd.getOpts().RequireExplicitTopics || strings.HasSuffix(topic, "#ephemeral") {
+		return nil
+	}
+	if len(p.ctx.nsqlookupd.DB.FindRegistrations("topic", topic, "")) > 0 {
+		return nil
+	}
+	p.ctx.nsqlookupd.logClientErrf(LOG_WARN, client, "%s rejected, topic %s has not been created", command, topic)
+	return protocol.NewClientErr(nil, "E_TOPIC_NOT_FOUND",
+		fmt.Sprintf("%s failed, topic %s has not been created", command, topic))
+}
+
+// 超过MaxTopics/MaxChannelsPerTopic 时返回E_LIMIT, 连接不会被关闭
+func (p *LookupProtocolV1) checkLimits(client *ClientV1, command string, regs []Registration) error {
+	err := p.ctx.nsqlookupd.checkLimits(regs)
+	if err == nil {
+		return nil
+	}
+	p.ctx.nsqlookupd.logClientErrf(LOG_WARN, client, "%s rejected, %s", command, err)
+	return protocol.NewClientErr(nil, "E_LIMIT", fmt.Sprintf("%s failed, %s", command, err))
+}
+
+// registrationFor is the registration REGISTER topic [channel] adds
+func registrationFor(topic string, channel string) Registration {
+	if channel != "" {
+		return Registration{"channel", topic, channel}
+	}
+	return Registration{"topic", topic, ""}
+}
+
+func (p *LookupProtocolV1) register(client *ClientV1, topic string, channel string) {
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
 		if p.ctx.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
-			p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
-				client, "channel", topic, channel)
+			p.ctx.registrationChanged()
+			p.logRegistration(client, "REGISTER", key)
 		}
 	}
 	key := Registration{"topic", topic, ""}
 	if p.ctx.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
-		p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
-			client, "topic", topic, "")
+		p.ctx.registrationChanged()
+		p.logRegistration(client, "REGISTER", key)
 	}
-
-	return []byte("OK"), nil
 }
 
+// logRegistration logs a registration change made by client at
+// --registration-log-level, conn is the id of the connection that made it
+func (p *LookupProtocolV1) logRegistration(client *ClientV1, action string, r Registration) {
+	p.ctx.nsqlookupd.logf(p.ctx.nsqlookupd.getOpts().registrationLogLevel,
+		"DB: client(%s) %s category:%s key:%s subkey:%s id:%s conn:%d",
+		client, action, r.Category, r.Key, r.SubKey, client.peerInfo.id, client.id)
+}
 
 // 如果channel名称以“#ephemeral”结尾，Registration也将被删除
 // 如果没有指定channel 名称，则删除channel类型和topic下所有该topic名称下匹配ID的Producer,这部分需要理解注册时的操作
@@ -166,17 +434,24 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
 	}
 
-	topic, channel, err := getTopicChan("UNREGISTER", params)
+	if p.ctx.nsqlookupd.IsReadOnly() {
+		return nil, protocol.NewClientErr(nil, "E_READONLY", "UNREGISTER failed, nsqlookupd is read-only")
+	}
+
+	topic, channel, err := p.getTopicChan("UNREGISTER", params)
 	if err != nil {
 		return nil, err
 	}
 
+	// any protocol activity counts as liveness, not just PING
+	atomic.StoreInt64(&client.peerInfo.lastUpdate, time.Now().UnixNano())
+
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
-		removed, left := p.ctx.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id)
+		removed, left := p.ctx.nsqlookupd.DB.RemoveOwnedProducer(key, client.peerInfo)
 		if removed {
-			p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
-				client, "channel", topic, channel)
+			p.ctx.registrationChanged()
+			p.logRegistration(client, "UNREGISTER", key)
 		}
 		// for ephemeral channels, remove the channel as well if it has no producers
 		if left == 0 && strings.HasSuffix(channel, "#ephemeral") {
@@ -189,23 +464,33 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		// if anything is actually removed
 		registrations := p.ctx.nsqlookupd.DB.FindRegistrations("channel", topic, "*")
 		for _, r := range registrations {
-			if removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
-				p.ctx.nsqlookupd.logf(LOG_WARN, "client(%s) unexpected UNREGISTER category:%s key:%s subkey:%s",
-					client, "channel", topic, r.SubKey)
+			if removed, _ := p.ctx.nsqlookupd.DB.RemoveOwnedProducer(r, client.peerInfo); removed {
+				p.ctx.registrationChanged()
+				p.ctx.nsqlookupd.logf(LOG_WARN, "client(%s) unexpected UNREGISTER category:%s key:%s subkey:%s id:%s conn:%d",
+					client, "channel", topic, r.SubKey, client.peerInfo.id, client.id)
 			}
 		}
 
 		key := Registration{"topic", topic, ""}
-		if removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id); removed {
-			p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
-				client, "topic", topic, "")
+		removed, left := p.ctx.nsqlookupd.DB.RemoveOwnedProducer(key, client.peerInfo)
+		if removed {
+			p.ctx.registrationChanged()
+			p.logRegistration(client, "UNREGISTER", key)
+		}
+		// for ephemeral topics, remove the topic and any leftover channels
+		// once the last producer is gone
+		if left == 0 && strings.HasSuffix(topic, "#ephemeral") {
+			for _, r := range p.ctx.nsqlookupd.DB.FindRegistrations("channel", topic, "*") {
+				p.ctx.nsqlookupd.DB.RemoveRegistration(r)
+			}
+			p.ctx.nsqlookupd.DB.RemoveRegistration(key)
 		}
 	}
 
 	return []byte("OK"), nil
 }
 
-// 初始化PeerInfo,RemoteAddr(ip:port) 作为ID，peerInfo.BroadcastAddress == "" || peerInfo.TCPPort == 0 || peerInfo.HTTPPort == 0 || peerInfo.Version == "" 都会返回missing fields ,
+// 初始化PeerInfo,RemoteAddr(ip:port) 作为ID，未知的字段、类型错误以及缺少broadcast_address, tcp_port, http_port, version 都会返回E_BAD_BODY,
 // 一个Client只可以IDENTIFY一次,
 // 最后用client 给的数据生成一个perrInfo, 用peerInfo生成Producer,加入到client分类中
 func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
@@ -220,6 +505,14 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body size")
 	}
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("IDENTIFY invalid body size %d", bodyLen))
+	}
+	if max := p.ctx.nsqlookupd.getOpts().MaxBodySize; int(bodyLen) > max {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("IDENTIFY body too big %d > %d", bodyLen, max))
+	}
 
 	body := make([]byte, bodyLen)
 	_, err = io.ReadFull(reader, body)
@@ -228,27 +521,30 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	}
 
 	// body is a json structure with producer information
-	peerInfo := PeerInfo{id: client.RemoteAddr().String()}
-	err = json.Unmarshal(body, &peerInfo)
+	peerInfo := PeerInfo{id: client.RemoteAddr().String(), Weight: 1}
+	err = decodePeerInfo(body, &peerInfo)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY "+err.Error())
 	}
 
 	peerInfo.RemoteAddress = client.RemoteAddr().String()
-
-	// require all fields
-	if peerInfo.BroadcastAddress == "" || peerInfo.TCPPort == 0 || peerInfo.HTTPPort == 0 || peerInfo.Version == "" {
-		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", "IDENTIFY missing fields")
+	err = p.checkBroadcastAddress(client, &peerInfo)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY "+err.Error())
 	}
 
-	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&peerInfo.lastUpdate, now)
+	peerInfo.connectedAt = now
+	peerInfo.tls = client.tls
+	peerInfo.tlsCommonName = client.tlsCommonName
 
 	p.ctx.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
 		client, peerInfo.BroadcastAddress, peerInfo.TCPPort, peerInfo.HTTPPort, peerInfo.Version)
 
 	client.peerInfo = &peerInfo
 	if p.ctx.nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: client.peerInfo}) {
-		p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s", client, "client", "", "")
+		p.logRegistration(client, "REGISTER", Registration{"client", "", ""})
 	}
 
 	// build a response
@@ -256,11 +552,14 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	data["tcp_port"] = p.ctx.nsqlookupd.RealTCPAddr().Port
 	data["http_port"] = p.ctx.nsqlookupd.RealHTTPAddr().Port
 	data["version"] = version.Binary
+	if p.protocolVersion > 1 {
+		data["protocol_version"] = p.protocolVersion
+	}
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatalf("ERROR: unable to get hostname %s", err)
 	}
-	data["broadcast_address"] = p.ctx.nsqlookupd.opts.BroadcastAddress
+	data["broadcast_address"] = p.ctx.nsqlookupd.getOpts().BroadcastAddress
 	data["hostname"] = hostname
 
 	response, err := json.Marshal(data)
@@ -271,6 +570,155 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	return response, nil
 }
 
+// the largest weight a producer can IDENTIFY with
+const maxPeerWeight = 1000
+
+// the most metadata entries a producer can IDENTIFY with
+const maxPeerMetadata = 32
+
+// decodePeerInfo strictly decodes an IDENTIFY body, the error names the
+// first unknown, mistyped or missing field. The body is a JSON object or a
+// MessagePack map with the same fields, told apart by its first byte.
+func decodePeerInfo(body []byte, peerInfo *PeerInfo) error {
+	if isMsgpackMap(body) {
+		v, err := decodeMsgpack(body)
+		if err != nil {
+			return errors.New("failed to decode msgpack body")
+		}
+		body, err = json.Marshal(v)
+		if err != nil {
+			return errors.New("failed to decode msgpack body")
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return errors.New("failed to decode JSON body")
+	}
+
+	known := []struct {
+		name string
+		v    interface{}
+		typ  string
+	}{
+		{"remote_address", &peerInfo.RemoteAddress, "a string"},
+		{"hostname", &peerInfo.Hostname, "a string"},
+		{"broadcast_address", &peerInfo.BroadcastAddress, "a string"},
+		{"tcp_port", &peerInfo.TCPPort, "an integer"},
+		{"http_port", &peerInfo.HTTPPort, "an integer"},
+		{"version", &peerInfo.Version, "a string"},
+		{"epoch", &peerInfo.epoch, "an integer"},
+		{"weight", &peerInfo.Weight, "an integer"},
+		{"metadata", &peerInfo.Metadata, "an object of strings"},
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		found := false
+		for _, f := range known {
+			if f.name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	for _, f := range known {
+		raw, ok := fields[f.name]
+		if !ok {
+			continue
+		}
+		err := json.Unmarshal(raw, f.v)
+		if err != nil {
+			return fmt.Errorf("field %q must be %s", f.name, f.typ)
+		}
+	}
+
+	// required, a zero value is as good as missing
+	if peerInfo.BroadcastAddress == "" {
+		return errors.New(`missing field "broadcast_address"`)
+	}
+	if peerInfo.TCPPort == 0 {
+		return errors.New(`missing field "tcp_port"`)
+	}
+	if peerInfo.HTTPPort == 0 {
+		return errors.New(`missing field "http_port"`)
+	}
+	if peerInfo.Version == "" {
+		return errors.New(`missing field "version"`)
+	}
+	if peerInfo.Weight < 0 || peerInfo.Weight > maxPeerWeight {
+		return fmt.Errorf("field %q must be between 0 and %d", "weight", maxPeerWeight)
+	}
+	if len(peerInfo.Metadata) > maxPeerMetadata {
+		return fmt.Errorf("field %q must have at most %d entries", "metadata", maxPeerMetadata)
+	}
+	return nil
+}
+
+// 返回该client 自己注册的topic/channel (JSON), 用于nsqd 自检
+func (p *LookupProtocolV1) LIST(client *ClientV1, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+
+	registrations := listRegistrations{}
+	for _, r := range p.ctx.nsqlookupd.DB.LookupRegistrations(client.peerInfo.id) {
+		if r.Category == "client" {
+			continue
+		}
+		registrations = append(registrations, listRegistration{r.Key, r.SubKey})
+	}
+	sort.Sort(registrations)
+
+	response, err := json.Marshal(map[string]interface{}{
+		"registrations": registrations,
+	})
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_LIST_FAILED", "LIST failed to marshal response")
+	}
+	return response, nil
+}
+
+type listRegistration struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// listRegistrations sorts by topic then channel, a topic before its channels
+type listRegistrations []listRegistration
+
+func (l listRegistrations) Len() int      { return len(l) }
+func (l listRegistrations) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l listRegistrations) Less(i, j int) bool {
+	if l[i].Topic != l[j].Topic {
+		return l[i].Topic < l[j].Topic
+	}
+	return l[i].Channel < l[j].Channel
+}
+
+// 返回DB 中topic, channel 和producer 的数量 (JSON), 不需要IDENTIFY, 用于nsqd 监控所连接的lookupd
+func (p *LookupProtocolV1) STATS(client *ClientV1, params []string) ([]byte, error) {
+	db := p.ctx.nsqlookupd.DB
+	response, err := json.Marshal(map[string]interface{}{
+		"topics":    len(db.FindRegistrations("topic", "*", "")),
+		"channels":  len(db.FindRegistrations("channel", "*", "*")),
+		"producers": len(db.FindProducers("client", "", "")),
+	})
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_STATS_FAILED", "STATS failed to marshal response")
+	}
+	return response, nil
+}
+
 func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, error) {
 	if client.peerInfo != nil {
 		// we could get a PING before other commands on the same client connection
@@ -1,10 +1,18 @@
 package nsqlookupd
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/test"
 )
@@ -36,7 +44,9 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 	opts.Logger = test.NewTestLogger(t)
 	opts.LogLevel = "debug"
 
-	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: New(opts)}}
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
 
 	errChan := make(chan error)
 	testIOLoop := func() {
@@ -45,7 +55,6 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 	}
 	go testIOLoop()
 
-	var err error
 	var timeout bool
 
 	select {
@@ -60,3 +69,446 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 	test.Equal(t, "E_INVALID invalid command INVALID_COMMAND", err.Error())
 	test.NotNil(t, err.(*protocol.FatalClientErr))
 }
+
+func TestIOLoopLineTooLong(t *testing.T) {
+	fakeConn := test.NewFakeNetConn()
+	var read int
+	fakeConn.ReadFunc = func(b []byte) (int, error) {
+		// a client that never sends a newline
+		for i := range b {
+			b[i] = 'a'
+		}
+		read += len(b)
+		return len(b), nil
+	}
+	var written []byte
+	fakeConn.WriteFunc = func(b []byte) (int, error) {
+		written = append(written, b...)
+		return len(b), nil
+	}
+	closed := false
+	fakeConn.CloseFunc = func() error {
+		closed = true
+		return nil
+	}
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxLineLength = 64
+
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- prot.IOLoop(fakeConn)
+	}()
+
+	select {
+	case err = <-errChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("IOLoop did not return")
+	}
+
+	test.NotNil(t, err)
+	test.Equal(t, "E_BAD_LINE line exceeds max length 64", err.Error())
+	test.Equal(t, true, closed)
+	test.Equal(t, true, read <= 64)
+	test.Equal(t, "E_BAD_LINE line exceeds max length 64", string(written[4:]))
+}
+
+func TestIOLoopBlankLines(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	// 空行和只有空白的行被忽略，不会关闭连接
+	_, err := conn.Write([]byte("\n\r\n  \t \nPING\n"))
+	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+
+	// 命令和参数之间多余的空白也被忽略
+	_, err = conn.Write([]byte("  REGISTER   topic1 \t channel1  \n"))
+	test.Nil(t, err)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+
+	channels := nsqlookupd.DB.FindRegistrations("channel", "topic1", "*")
+	test.Equal(t, []string{"channel1"}, channels.SubKeys())
+
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+	response, err := prot.Exec(NewClientV1(test.NewFakeNetConn()), nil, nil)
+	test.Nil(t, err)
+	test.Nil(t, response)
+}
+
+func TestRegisterRefreshesLastUpdate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	client := NewClientV1(test.NewFakeNetConn())
+	client.peerInfo = &PeerInfo{
+		id:         "ip.address:1234",
+		lastUpdate: time.Now().Add(-2 * opts.InactiveProducerTimeout).UnixNano(),
+	}
+	before := client.peerInfo.lastUpdate
+
+	_, err = prot.REGISTER(client, nil, []string{"topic1"})
+	test.Nil(t, err)
+	test.Equal(t, true, client.peerInfo.lastUpdate > before)
+
+	producers := prot.ctx.nsqlookupd.DB.FindProducers("topic", "topic1", "")
+	producers = producers.FilterByActive(opts.InactiveProducerTimeout, 0)
+	test.Equal(t, 1, len(producers))
+
+	client.peerInfo.lastUpdate = before
+	_, err = prot.UNREGISTER(client, nil, []string{"topic1", "channel1"})
+	test.Nil(t, err)
+	test.Equal(t, true, client.peerInfo.lastUpdate > before)
+}
+
+func TestIdentifyBadBody(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	identify := func(body string) error {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, int32(len(body)))
+		buf.WriteString(body)
+		client := NewClientV1(test.NewFakeNetConn())
+		_, err := prot.IDENTIFY(client, bufio.NewReader(&buf), nil)
+		return err
+	}
+
+	valid := `"broadcast_address":"host","tcp_port":4150,"http_port":4151,"version":"1.0.0"`
+	test.Nil(t, identify(`{`+valid+`}`))
+	test.Nil(t, identify(`{"hostname":"host",`+valid+`}`))
+	test.Nil(t, identify(`{"weight":0,`+valid+`}`))
+
+	big := `{"hostname":"` + strings.Repeat("a", opts.MaxBodySize) + `",` + valid + `}`
+
+	for _, tc := range []struct {
+		body string
+		err  string
+	}{
+		{`{` + valid, `IDENTIFY failed to decode JSON body`},
+		{`[]`, `IDENTIFY failed to decode JSON body`},
+		{`{"role":"nsqd",` + valid + `}`, `IDENTIFY unknown field "role"`},
+		{`{"broadcast_address":"host","tcp_port":"4150","http_port":4151,"version":"1.0.0"}`,
+			`IDENTIFY field "tcp_port" must be an integer`},
+		{`{"broadcast_address":1,"tcp_port":4150,"http_port":4151,"version":"1.0.0"}`,
+			`IDENTIFY field "broadcast_address" must be a string`},
+		{`{"broadcast_address":"host","tcp_port":4150,"version":"1.0.0"}`,
+			`IDENTIFY missing field "http_port"`},
+		{`{"broadcast_address":"","tcp_port":4150,"http_port":4151,"version":"1.0.0"}`,
+			`IDENTIFY missing field "broadcast_address"`},
+		{`{"weight":-1,` + valid + `}`, `IDENTIFY field "weight" must be between 0 and 1000`},
+		{`{"weight":1001,` + valid + `}`, `IDENTIFY field "weight" must be between 0 and 1000`},
+		{`{"metadata":{"dc":1},` + valid + `}`, `IDENTIFY field "metadata" must be an object of strings`},
+		{big, fmt.Sprintf(`IDENTIFY body too big %d > %d`, len(big), opts.MaxBodySize)},
+	} {
+		err := identify(tc.body)
+		test.NotNil(t, err)
+		test.Equal(t, "E_BAD_BODY", err.(*protocol.FatalClientErr).Code)
+		test.Equal(t, tc.err, err.(*protocol.FatalClientErr).Desc)
+	}
+}
+
+func TestIdentifyBroadcastAddressCheck(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.BroadcastAddressCheck = "reject"
+	opts.BroadcastAddressAllowCIDR = "127.0.0.2/32"
+	opts.BroadcastAddressDenyCIDR = "10.0.0.0/8"
+	_, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	identify := func(broadcastAddress string, remoteAddr string) (*PeerInfo, error) {
+		body := fmt.Sprintf(`{"broadcast_address":%q,"tcp_port":4150,"http_port":4151,"version":"1.0.0"}`,
+			broadcastAddress)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, int32(len(body)))
+		buf.WriteString(body)
+		conn := test.NewFakeNetConn()
+		conn.RemoteAddrFunc = func() net.Addr {
+			addr, _ := net.ResolveTCPAddr("tcp", remoteAddr)
+			return addr
+		}
+		client := NewClientV1(conn)
+		_, err := prot.IDENTIFY(client, bufio.NewReader(&buf), nil)
+		return client.peerInfo, err
+	}
+
+	for _, addr := range []string{"192.168.1.10", "nsqd-1.example.com", "2001:db8::1", "127.0.0.2"} {
+		peerInfo, err := identify(addr, "192.168.1.10:50000")
+		test.Nil(t, err)
+		test.Equal(t, addr, peerInfo.BroadcastAddress)
+	}
+
+	for _, tc := range []struct {
+		addr string
+		err  string
+	}{
+		{"0.0.0.0", `IDENTIFY broadcast_address "0.0.0.0" is unspecified`},
+		{"::", `IDENTIFY broadcast_address "::" is unspecified`},
+		{"127.0.0.1", `IDENTIFY broadcast_address "127.0.0.1" is a loopback address`},
+		{"localhost", `IDENTIFY broadcast_address "localhost" is a loopback address`},
+		{"[::1]", `IDENTIFY broadcast_address "[::1]" is a loopback address`},
+		{"169.254.0.5", `IDENTIFY broadcast_address "169.254.0.5" is a link-local address`},
+		{"10.1.2.3", `IDENTIFY broadcast_address "10.1.2.3" is denied`},
+	} {
+		_, err := identify(tc.addr, "192.168.1.10:50000")
+		test.NotNil(t, err)
+		test.Equal(t, "E_BAD_BODY", err.(*protocol.FatalClientErr).Code)
+		test.Equal(t, tc.err, err.(*protocol.FatalClientErr).Desc)
+	}
+
+	// replace 时使用客户端的IP, 除非它也不通过检查
+	replaceOpts := *nsqlookupd.getOpts()
+	replaceOpts.BroadcastAddressCheck = "replace"
+	nsqlookupd.swapOpts(&replaceOpts)
+	peerInfo, err := identify("0.0.0.0", "192.168.1.10:50000")
+	test.Nil(t, err)
+	test.Equal(t, "192.168.1.10", peerInfo.BroadcastAddress)
+	_, err = identify("0.0.0.0", "127.0.0.1:50000")
+	test.NotNil(t, err)
+	test.Equal(t, `IDENTIFY broadcast_address "0.0.0.0" is unspecified`, err.(*protocol.FatalClientErr).Desc)
+
+	opts = NewOptions()
+	opts.BroadcastAddressCheck = "warn"
+	_, err = New(opts)
+	test.Equal(t, `invalid --broadcast-address-check "warn"`, err.Error())
+	opts.BroadcastAddressCheck = "reject"
+	opts.BroadcastAddressDenyCIDR = "10.0.0.0"
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
+
+// msgpackMap encodes fields, whose values are strings or ints, as a
+// MessagePack map
+func msgpackMap(fields [][2]interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | byte(len(fields)))
+	writeStr := func(s string) {
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(len(s)))
+		buf.WriteString(s)
+	}
+	for _, f := range fields {
+		writeStr(f[0].(string))
+		switch v := f[1].(type) {
+		case string:
+			writeStr(v)
+		case int:
+			buf.WriteByte(0xd3)
+			binary.Write(&buf, binary.BigEndian, int64(v))
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDecodePeerInfoMsgpack(t *testing.T) {
+	jsonBody := []byte(`{"hostname":"host","broadcast_address":"b_addr","tcp_port":4150,` +
+		`"http_port":4151,"version":"1.0.0","weight":3}`)
+	msgpackBody := msgpackMap([][2]interface{}{
+		{"hostname", "host"},
+		{"broadcast_address", "b_addr"},
+		{"tcp_port", 4150},
+		{"http_port", 4151},
+		{"version", "1.0.0"},
+		{"weight", 3},
+	})
+
+	var fromJSON, fromMsgpack PeerInfo
+	test.Nil(t, decodePeerInfo(jsonBody, &fromJSON))
+	test.Nil(t, decodePeerInfo(msgpackBody, &fromMsgpack))
+	test.Equal(t, fromJSON, fromMsgpack)
+	test.Equal(t, "b_addr", fromMsgpack.BroadcastAddress)
+	test.Equal(t, 4150, fromMsgpack.TCPPort)
+	test.Equal(t, 3, fromMsgpack.Weight)
+
+	// the same validation as JSON
+	var pi PeerInfo
+	err := decodePeerInfo(msgpackMap([][2]interface{}{{"broadcast_address", "b_addr"}, {"tcp_port", "4150"}}), &pi)
+	test.Equal(t, `field "tcp_port" must be an integer`, err.Error())
+	err = decodePeerInfo(msgpackMap([][2]interface{}{{"role", "nsqd"}}), &pi)
+	test.Equal(t, `unknown field "role"`, err.Error())
+	err = decodePeerInfo(msgpackBody[:len(msgpackBody)-1], &pi)
+	test.Equal(t, "failed to decode msgpack body", err.Error())
+	err = decodePeerInfo(append(msgpackBody, 0xc0), &pi)
+	test.Equal(t, "failed to decode msgpack body", err.Error())
+}
+
+func TestIdentifyMsgpack(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	body := msgpackMap([][2]interface{}{
+		{"broadcast_address", HostAddr},
+		{"tcp_port", TCPPort},
+		{"http_port", HTTPPort},
+		{"version", NSQDVersion},
+	})
+	cmd := &nsq.Command{Name: []byte("IDENTIFY"), Body: body}
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	producers := nsqlookupd.DB.FindProducers("client", "", "")
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, HostAddr, producers[0].peerInfo.BroadcastAddress)
+	test.Equal(t, TCPPort, producers[0].peerInfo.TCPPort)
+	test.Equal(t, 1, producers[0].peerInfo.Weight)
+}
+
+func TestIOLoopSendFailure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	body := `{"broadcast_address":"host","tcp_port":4150,"http_port":4151,"version":"1.0.0"}`
+	var in bytes.Buffer
+	in.WriteString("IDENTIFY\n")
+	binary.Write(&in, binary.BigEndian, int32(len(body)))
+	in.WriteString(body)
+	in.WriteString("REGISTER send_failure\n")
+
+	fakeConn := test.NewFakeNetConn()
+	fakeConn.ReadFunc = in.Read
+	writes := 0
+	fakeConn.WriteFunc = func(b []byte) (int, error) {
+		// the IDENTIFY response (size, then body) is sent, the REGISTER one isn't
+		writes++
+		if writes > 2 {
+			return 0, errors.New("write error")
+		}
+		return len(b), nil
+	}
+	closed := false
+	fakeConn.CloseFunc = func() error {
+		closed = true
+		return nil
+	}
+
+	err := prot.IOLoop(fakeConn)
+	test.NotNil(t, err)
+	test.Equal(t, "write error", err.Error())
+	test.Equal(t, true, closed)
+	stats := prot.ctx.Stats()
+	test.Equal(t, int64(1), stats.Commands.Register)
+	test.Equal(t, int64(1), stats.SendFailures)
+
+	// the REGISTER was applied but is cleaned up with the connection
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("topic", "send_failure", "")))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("client", "", "")))
+}
+
+func TestIOLoopContextCancel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	// a real connection, net.Pipe doesn't support deadlines before go1.10
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	test.Nil(t, err)
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	test.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- prot.IOLoopContext(ctx, serverConn)
+	}()
+
+	select {
+	case <-errCh:
+		t.Fatal("IOLoopContext returned before the context was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		test.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("IOLoopContext did not return after the context was cancelled")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIOLoopWriteTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPWriteTimeout = 50 * time.Millisecond
+	_, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+	prot := &LookupProtocolV1{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	var in bytes.Buffer
+	in.WriteString("PING\n")
+
+	// a client that never reads, writes block until the deadline
+	var deadline time.Time
+	fakeConn := test.NewFakeNetConn()
+	fakeConn.ReadFunc = in.Read
+	fakeConn.SetWriteDeadlineFunc = func(t time.Time) error {
+		deadline = t
+		return nil
+	}
+	fakeConn.WriteFunc = func(b []byte) (int, error) {
+		if deadline.IsZero() {
+			select {}
+		}
+		time.Sleep(deadline.Sub(time.Now()))
+		return 0, timeoutError{}
+	}
+	closed := false
+	fakeConn.CloseFunc = func() error {
+		closed = true
+		return nil
+	}
+
+	start := time.Now()
+	err := prot.IOLoop(fakeConn)
+	test.NotNil(t, err)
+	test.Equal(t, true, strings.HasPrefix(err.Error(), "write timed out after 50ms"))
+	test.Equal(t, true, time.Since(start) >= opts.TCPWriteTimeout)
+	test.Equal(t, true, closed)
+	test.Equal(t, int64(1), prot.ctx.Stats().SendFailures)
+}
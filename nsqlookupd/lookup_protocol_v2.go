@@ -0,0 +1,17 @@
+package nsqlookupd
+
+import (
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// LookupProtocolV2 is selected by clients that send the "  V2" magic. It is
+// where changes that V1 clients wouldn't understand (bulk registration,
+// auth, ...) will go, for now it handles the V1 commands and reports the
+// negotiated version in the IDENTIFY response.
+type LookupProtocolV2 struct {
+	*LookupProtocolV1
+}
+
+func newLookupProtocolV2(ctx *Context) protocol.ContextProtocol {
+	return &LookupProtocolV2{&LookupProtocolV1{ctx: ctx, protocolVersion: 2}}
+}
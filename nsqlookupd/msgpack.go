@@ -0,0 +1,201 @@
+package nsqlookupd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// isMsgpackMap reports whether body starts with a MessagePack map header,
+// a JSON object can't as it starts with '{' (or whitespace)
+func isMsgpackMap(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	b := body[0]
+	return b&0xf0 == 0x80 || b == 0xde || b == 0xdf
+}
+
+// decodeMsgpack decodes a single MessagePack (https://msgpack.org) value
+// into the types encoding/json decodes into an interface{}: nil, bool,
+// float64 (or int64 for integers), string, []interface{} and
+// map[string]interface{}. bin is decoded as a string, ext isn't supported.
+func decodeMsgpack(data []byte) (interface{}, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("msgpack: %d bytes after value", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+// the deepest nesting of arrays/maps decoded
+const msgpackMaxDepth = 32
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of size bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nested too deeply")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	op := b[0]
+
+	switch {
+	case op <= 0x7f:
+		return int64(op), nil
+	case op >= 0xe0:
+		return int64(int8(op)), nil
+	case op&0xe0 == 0xa0:
+		return d.str(int(op & 0x1f))
+	case op&0xf0 == 0x90:
+		return d.array(int(op&0x0f), depth)
+	case op&0xf0 == 0x80:
+		return d.mapping(int(op&0x0f), depth)
+	}
+
+	switch op {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (op - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return float64(v), nil
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (op - 0xd0)
+		v, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, nil
+	case 0xca:
+		v, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(v))), nil
+	case 0xcb:
+		v, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(v), nil
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := 1
+		switch op {
+		case 0xda, 0xc5:
+			size = 2
+		case 0xdb, 0xc6:
+			size = 4
+		}
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (op - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (op - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%x", op)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n int, depth int) (interface{}, error) {
+	// every element is at least a byte, don't allocate for what isn't there
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapping(n int, depth int) (interface{}, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key must be a string, not %T", k)
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,116 @@
+package nsqlookupd
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how long a /nodes?probe=true dial may take, and how long its result is
+// reused for the same address
+const (
+	nodeProbeTimeout = time.Second
+	nodeProbeTTL     = 10 * time.Second
+)
+
+// nodeProber reports whether the HTTP ports of nodes accept TCP
+// connections, caching the result of each address for ttl so that
+// repeated /nodes requests don't dial every node every time
+type nodeProber struct {
+	sync.Mutex
+	ttl     time.Duration
+	dial    func(addr string) error
+	entries map[string]nodeProbeEntry
+}
+
+type nodeProbeEntry struct {
+	reachable bool
+	expires   time.Time
+}
+
+func newNodeProber(ttl time.Duration, timeout time.Duration) *nodeProber {
+	return &nodeProber{
+		ttl: ttl,
+		dial: func(addr string) error {
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+		entries: make(map[string]nodeProbeEntry),
+	}
+}
+
+// probe returns whether each of addrs is reachable, the addresses without
+// a cached result are dialed concurrently
+func (p *nodeProber) probe(addrs []string) map[string]bool {
+	now := time.Now()
+	results := make(map[string]bool, len(addrs))
+	var stale []string
+	p.Lock()
+	for _, addr := range addrs {
+		e, ok := p.entries[addr]
+		if ok && now.Before(e.expires) {
+			results[addr] = e.reachable
+			continue
+		}
+		if _, ok := results[addr]; !ok {
+			stale = append(stale, addr)
+			results[addr] = false
+		}
+	}
+	for addr, e := range p.entries {
+		if !now.Before(e.expires) {
+			delete(p.entries, addr)
+		}
+	}
+	p.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, addr := range stale {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			reachable := p.dial(addr) == nil
+			mu.Lock()
+			results[addr] = reachable
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	expires := time.Now().Add(p.ttl)
+	p.Lock()
+	for _, addr := range stale {
+		p.entries[addr] = nodeProbeEntry{results[addr], expires}
+	}
+	p.Unlock()
+	return results
+}
+
+// probeNodes returns a copy of the /nodes response data with the
+// reachability of each producer's HTTP port, data (which may be cached)
+// is left as is
+func (s *httpServer) probeNodes(data map[string]interface{}) map[string]interface{} {
+	nodes := data["producers"].([]*node)
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = net.JoinHostPort(n.BroadcastAddress, strconv.Itoa(n.HTTPPort))
+	}
+	results := s.prober.probe(addrs)
+
+	probed := make([]*node, len(nodes))
+	for i, n := range nodes {
+		c := *n
+		reachable := results[addrs[i]]
+		c.Reachable = &reachable
+		probed[i] = &c
+	}
+	return map[string]interface{}{
+		"producers": probed,
+		"errors":    data["errors"],
+	}
+}
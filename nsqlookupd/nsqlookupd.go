@@ -1,10 +1,16 @@
 package nsqlookupd
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/lg"
@@ -15,65 +21,243 @@ import (
 
 type NSQLookupd struct {
 	sync.RWMutex
-	opts         *Options
+	opts         atomic.Value
 	tcpListener  net.Listener
 	httpListener net.Listener
 	waitGroup    util.WaitGroupWrapper
-	DB           *RegistrationDB
+	tcpServer    *tcpServer
+	cancelTCP    context.CancelFunc
+	lookupCache  *lookupCache
+	repeatLog    *repeatLogger
+	exitChan     chan struct{}
+	exitOnce     sync.Once
+	readOnly     int32
+	ready        int32
+	DB           RegistrationStore
+
+	// nil when --broadcast-address-check is off
+	broadcastChecker *broadcastAddressChecker
 }
 // 首先 New 一个Options, 保存了服务端的一些基本配置参数，然后在通该Options 去New 一个NSQLookupd
 // 然后调用NSQLookupd.Main() 启动服务
-func New(opts *Options) *NSQLookupd {
+// 配置错误和监听失败都以error 返回，由调用者决定是否退出
+func New(opts *Options) (*NSQLookupd, error) {
 	if opts.Logger == nil {
-		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		w := opts.LogWriter
+		if w == nil {
+			w = os.Stderr
+		}
+		switch opts.LogFormat {
+		case "", "text":
+			opts.Logger = log.New(w, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		case "json":
+			opts.Logger = lg.NewJSONLogger(w, "nsqlookupd")
+		default:
+			return nil, fmt.Errorf("invalid --log-format %q", opts.LogFormat)
+		}
+	}
+	db := NewRegistrationDB()
+	if opts.DBLockMetrics {
+		db.EnableLockWaitMetrics()
 	}
 	n := &NSQLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		DB:       db,
+		exitChan: make(chan struct{}),
+	}
+	n.swapOpts(opts)
+	n.SetReadOnly(opts.ReadOnly)
+	if opts.LogRepeatWindow > 0 {
+		n.repeatLog = newRepeatLogger(opts.LogRepeatWindow, n.logf)
 	}
 
 	var err error
 	opts.logLevel, err = lg.ParseLogLevel(opts.LogLevel, opts.Verbose)
 	if err != nil {
-		n.logf(LOG_FATAL, "%s", err)
-		os.Exit(1)
+		return nil, err
+	}
+	opts.registrationLogLevel, err = lg.ParseLogLevel(opts.RegistrationLogLevel, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --registration-log-level %q", opts.RegistrationLogLevel)
+	}
+
+	if opts.AllowConfigFromCIDR != "" {
+		_, _, err := net.ParseCIDR(opts.AllowConfigFromCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --allow-config-from-cidr='%s' - %s", opts.AllowConfigFromCIDR, err)
+		}
+	}
+
+	if opts.ProxyProtocol {
+		_, _, err := net.ParseCIDR(opts.ProxyProtocolTrustedCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse --proxy-protocol-trusted-cidr='%s' - %s", opts.ProxyProtocolTrustedCIDR, err)
+		}
+	}
+
+	switch opts.BroadcastAddressCheck {
+	case "":
+	case "reject", "replace":
+		n.broadcastChecker, err = newBroadcastAddressChecker(opts.BroadcastAddressAllowCIDR, opts.BroadcastAddressDenyCIDR)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid --broadcast-address-check %q", opts.BroadcastAddressCheck)
+	}
+
+	if opts.ProducerExpiry > 0 {
+		if opts.ProducerExpiry <= opts.InactiveProducerTimeout {
+			return nil, fmt.Errorf("--producer-expiry (%s) must be greater than --inactive-producer-timeout (%s)",
+				opts.ProducerExpiry, opts.InactiveProducerTimeout)
+		}
+	}
+	if opts.ProducerExpiryInterval <= 0 {
+		return nil, fmt.Errorf("invalid --producer-expiry-interval %s", opts.ProducerExpiryInterval)
+	}
+	if opts.ProducerTombstoneAfter > 0 && opts.ProducerExpiry > 0 &&
+		opts.ProducerTombstoneAfter >= opts.ProducerExpiry {
+		return nil, fmt.Errorf("--producer-tombstone-after (%s) must be less than --producer-expiry (%s)",
+			opts.ProducerTombstoneAfter, opts.ProducerExpiry)
+	}
+
+	if opts.TopicWebhookURL != "" {
+		u, err := url.Parse(opts.TopicWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid --topic-webhook-url %q", opts.TopicWebhookURL)
+		}
+	}
+
+	switch opts.HTTPLogFormat {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid --http-log-format %q", opts.HTTPLogFormat)
 	}
 
 	n.logf(LOG_INFO, version.String("nsqlookupd"))
-	return n
+	return n, nil
 }
 
-func (l *NSQLookupd) Main() {
-	ctx := &Context{l}
+// Main 返回时TCP 和HTTP 都已在监听, RealTCPAddr/RealHTTPAddr 可以直接使用,
+// 连接会在accept 之前排队, 不需要再等待
+func (l *NSQLookupd) Main() error {
+	ctx := &Context{nsqlookupd: l}
+	opts := l.getOpts()
 
-	tcpListener, err := net.Listen("tcp", l.opts.TCPAddress)
-	if err != nil {
-		l.logf(LOG_FATAL, "listen (%s) failed - %s", l.opts.TCPAddress, err)
-		os.Exit(1)
+	var err error
+	// 如果提供了已经创建好的listener(测试或者socket activation), 直接使用
+	tcpListener := opts.TCPListener
+	if tcpListener == nil {
+		tcpListener, err = net.Listen("tcp", opts.TCPAddress)
+		if err != nil {
+			return fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
+		}
+	}
+
+	httpListener := opts.HTTPListener
+	if httpListener == nil {
+		httpListener, err = net.Listen("tcp", opts.HTTPAddress)
+		if err != nil {
+			tcpListener.Close()
+			return fmt.Errorf("listen (%s) failed - %s", opts.HTTPAddress, err)
+		}
+	}
+
+	// /lookup 缓存需要DB 同步通知每一次变化
+	var cache *lookupCache
+	if opts.LookupCacheSize > 0 {
+		if notifier, ok := l.DB.(changeNotifier); ok {
+			cache = newLookupCache(opts.LookupCacheSize)
+			notifier.OnChange(cache.invalidate)
+		} else {
+			l.logf(LOG_WARN, "--lookup-cache-size ignored, %T does not support change notifications", l.DB)
+		}
 	}
+
+	// topic 有了第一个producer (或者失去最后一个) 时通知webhook
+	if opts.TopicWebhookURL != "" {
+		if notifier, ok := l.DB.(changeNotifier); ok {
+			webhook := newTopicWebhook(opts.TopicWebhookURL, opts.TopicWebhookOnEmpty, l.DB, l.logf)
+			notifier.OnChange(webhook.onChange)
+			l.waitGroup.Wrap(func() { webhook.loop(l.exitChan) })
+		} else {
+			l.logf(LOG_WARN, "--topic-webhook-url ignored, %T does not support change notifications", l.DB)
+		}
+	}
+
+	// tcpServer 实现了一个Handler 方法，该方法用来处理请求
+	tcpServer := newTCPServer(ctx)
+	// cancelled in Exit() so that connections stop waiting for commands
+	tcpCtx, cancelTCP := context.WithCancel(context.Background())
+
 	l.Lock()
 	l.tcpListener = tcpListener
+	l.httpListener = httpListener
+	l.tcpServer = tcpServer
+	l.cancelTCP = cancelTCP
+	l.lookupCache = cache
 	l.Unlock()
-	// tcpServer 实现了一个Handler 方法，该方法用来处理请求
-	tcpServer := &tcpServer{ctx: ctx}
 
 	// 启动子服务的时候使用goruntine,退出的时候等待子服务退出后在退出主程序
+	// 有Restore 时先恢复DB, 完成之前TCP 连接在排队, HTTP 只回答/ping /health /info
+	if opts.Restore == nil {
+		atomic.StoreInt32(&l.ready, 1)
+	}
 	l.waitGroup.Wrap(func() {
-		protocol.TCPServer(tcpListener, tcpServer, l.logf)
+		if opts.Restore != nil {
+			l.restore(opts.Restore)
+		}
+		protocol.TCPServerContext(tcpCtx, tcpListener, tcpServer, l.logf)
 	})
 
-	httpListener, err := net.Listen("tcp", l.opts.HTTPAddress)
-	if err != nil {
-		l.logf(LOG_FATAL, "listen (%s) failed - %s", l.opts.HTTPAddress, err)
-		os.Exit(1)
+	l.waitGroup.Wrap(func() { l.expireProducersLoop(ctx) })
+
+	if l.repeatLog != nil {
+		l.waitGroup.Wrap(func() { l.repeatLog.flushLoop(l.exitChan) })
 	}
-	l.Lock()
-	l.httpListener = httpListener
-	l.Unlock()
+
+	if opts.ConsistencyCheckInterval > 0 {
+		l.waitGroup.Wrap(l.consistencyCheckLoop)
+	}
+
 	httpServer := newHTTPServer(ctx)
 	l.waitGroup.Wrap(func() {
-		http_api.Serve(httpListener, httpServer, "HTTP", l.logf)
+		http_api.ServeWithConfig(httpListener, httpServer, http_api.ServerConfig{
+			ReadTimeout:    opts.HTTPReadTimeout,
+			WriteTimeout:   opts.HTTPWriteTimeout,
+			IdleTimeout:    opts.HTTPIdleTimeout,
+			MaxHeaderBytes: opts.HTTPMaxHeaderBytes,
+		}, "HTTP", l.logf)
 	})
+
+	return nil
+}
+
+// restore runs the Options.Restore function, a failure is logged and
+// startup continues with whatever was restored
+func (l *NSQLookupd) restore(restore func(RegistrationStore) error) {
+	start := time.Now()
+	err := restore(l.DB)
+	if err != nil {
+		l.logf(LOG_ERROR, "DB: restore failed - %s", err)
+	} else {
+		l.logf(LOG_INFO, "DB: restored in %s", time.Since(start))
+	}
+	atomic.StoreInt32(&l.ready, 1)
+}
+
+// IsReady reports whether startup, including any restore, has finished
+func (l *NSQLookupd) IsReady() bool {
+	return atomic.LoadInt32(&l.ready) == 1
+}
+
+func (l *NSQLookupd) getOpts() *Options {
+	return l.opts.Load().(*Options)
+}
+
+// swapOpts replaces the options, they are read on every use so changes
+// to e.g. InactiveProducerTimeout apply without a restart
+func (l *NSQLookupd) swapOpts(opts *Options) {
+	l.opts.Store(opts)
 }
 
 func (l *NSQLookupd) RealTCPAddr() *net.TCPAddr {
@@ -88,7 +272,107 @@ func (l *NSQLookupd) RealHTTPAddr() *net.TCPAddr {
 	return l.httpListener.Addr().(*net.TCPAddr)
 }
 
+// Stats returns the command counters along with the number of open TCP
+// connections and of goroutines handling them, which should both drop back
+// to zero once clients disconnect, the /lookup cache hits and misses and,
+// with --db-lock-metrics, the DB lock waits
+func (l *NSQLookupd) Stats() Stats {
+	l.RLock()
+	tcpServer := l.tcpServer
+	cache := l.lookupCache
+	l.RUnlock()
+	if tcpServer == nil {
+		return Stats{}
+	}
+	stats := tcpServer.ctx.Stats()
+	stats.TCPConnections = atomic.LoadInt64(&tcpServer.activeConns)
+	stats.TCPHandlers = atomic.LoadInt64(&tcpServer.activeHandlers)
+	if cache != nil {
+		stats.LookupCacheHits, stats.LookupCacheMisses = cache.stats()
+	}
+	if db, ok := l.DB.(*RegistrationDB); ok {
+		if lockWait, ok := db.LockWaitStats(); ok {
+			stats.DBLockWait = &lockWait
+		}
+	}
+	return stats
+}
+
+// IsReadOnly reports whether changes to the registration DB are currently rejected
+func (l *NSQLookupd) IsReadOnly() bool {
+	return atomic.LoadInt32(&l.readOnly) == 1
+}
+
+// SetReadOnly turns read-only mode on or off at runtime
+func (l *NSQLookupd) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&l.readOnly, v)
+}
+
+// normalizeTopicChannel returns the names topic and channel are stored
+// under, lowercased with CaseInsensitiveTopics/CaseInsensitiveChannels
+func (l *NSQLookupd) normalizeTopicChannel(topic string, channel string) (string, string) {
+	opts := l.getOpts()
+	if opts.CaseInsensitiveTopics {
+		topic = strings.ToLower(topic)
+	}
+	if opts.CaseInsensitiveChannels {
+		channel = strings.ToLower(channel)
+	}
+	return topic, channel
+}
+
+// 定期从DB 中删除超过ProducerExpiry 没有PING 的producer (比如崩溃的节点),
+// tombstone 超过ProducerTombstoneAfter 没有PING 的topic producer,
+// 并清除超过TombstoneLifetime 的tombstone 和离开超过TombstoneLifetime 的节点的epoch, 直到Exit
+func (l *NSQLookupd) expireProducersLoop(ctx *Context) {
+	opts := l.getOpts()
+	interval := opts.ProducerExpiryInterval
+	// 自动tombstone 每次都会被刷新, 检查间隔小于TombstoneLifetime 才不会中断
+	if opts.ProducerTombstoneAfter > 0 && opts.TombstoneLifetime/2 > 0 && interval > opts.TombstoneLifetime/2 {
+		interval = opts.TombstoneLifetime / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			opts := l.getOpts()
+			if expiry := opts.ProducerExpiry; expiry > 0 {
+				n := l.DB.RemoveExpiredProducers(time.Now().Add(-expiry))
+				if n > 0 {
+					ctx.registrationChanged()
+					l.logf(LOG_INFO, "DB: removed %d producers not seen for %s", n, expiry)
+				}
+			}
+			if after := opts.ProducerTombstoneAfter; after > 0 {
+				n := l.DB.TombstoneStaleProducers(time.Now().Add(-after))
+				if n > 0 {
+					l.logf(LOG_INFO, "DB: tombstoned %d producers not seen for %s", n, after)
+				}
+			}
+			lifetime := opts.TombstoneLifetime
+			if n := l.DB.ClearExpiredTombstones(lifetime); n > 0 {
+				l.logf(LOG_INFO, "DB: cleared %d tombstones older than %s", n, lifetime)
+			}
+			if n := l.DB.ClearExpiredEpochs(time.Now().Add(-lifetime)); n > 0 {
+				l.logf(LOG_INFO, "DB: cleared the epochs of %d nodes gone for %s", n, lifetime)
+			}
+		case <-l.exitChan:
+			return
+		}
+	}
+}
+
 func (l *NSQLookupd) Exit() {
+	// 可以多次调用，只有第一次生效
+	l.exitOnce.Do(l.exit)
+}
+
+func (l *NSQLookupd) exit() {
 	if l.tcpListener != nil {
 		l.tcpListener.Close()
 	}
@@ -96,5 +380,15 @@ func (l *NSQLookupd) Exit() {
 	if l.httpListener != nil {
 		l.httpListener.Close()
 	}
+	close(l.exitChan)
 	l.waitGroup.Wait()
+
+	if l.cancelTCP != nil {
+		l.cancelTCP()
+	}
+
+	// 等待已有连接处理完当前命令后退出，最多等待ShutdownTimeout
+	if l.tcpServer != nil {
+		l.tcpServer.drain(l.getOpts().ShutdownTimeout)
+	}
 }
@@ -1,10 +1,24 @@
 package nsqlookupd
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
-	"os"
-	"os/exec"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,11 +53,52 @@ type LookupDoc struct {
 func mustStartLookupd(opts *Options) (*net.TCPAddr, *net.TCPAddr, *NSQLookupd) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
-	nsqlookupd := New(opts)
-	nsqlookupd.Main()
+	nsqlookupd, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	err = nsqlookupd.Main()
+	if err != nil {
+		panic(err)
+	}
 	return nsqlookupd.RealTCPAddr(), nsqlookupd.RealHTTPAddr(), nsqlookupd
 }
 
+// startLookupd starts an nsqlookupd on random ports for black-box tests,
+// logging to t unless opts has a Logger, the returned func exits it
+func startLookupd(t *testing.T, opts *Options) (*NSQLookupd, func()) {
+	if opts.Logger == nil {
+		opts.Logger = test.NewTestLogger(t)
+	}
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	nsqlookupd, err := New(opts)
+	if err != nil {
+		t.Fatalf("failed to create nsqlookupd - %s", err)
+	}
+	err = nsqlookupd.Main()
+	if err != nil {
+		t.Fatalf("failed to start nsqlookupd - %s", err)
+	}
+	return nsqlookupd, nsqlookupd.Exit
+}
+
+func TestStartLookupd(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/ping", nsqlookupd.RealHTTPAddr()))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "OK", string(body))
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+	identify(t, conn)
+}
+
 func mustConnectLookupd(t *testing.T, tcpAddr *net.TCPAddr) net.Conn {
 	conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
 	if err != nil {
@@ -279,6 +334,298 @@ func TestTombstoneUnregister(t *testing.T) {
 	test.Equal(t, 0, len(pr.Producers))
 }
 
+func TestTopicRename(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "topic_rename"
+	newTopicName := "topic_renamed"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register(topicName, "channel1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	endpoint := fmt.Sprintf("http://%s/topic/rename?topic=%s&new_topic=%s",
+		httpAddr, topicName, newTopicName)
+	err = client.POSTV1(endpoint)
+	test.Nil(t, err)
+
+	lr := LookupDoc{}
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, newTopicName)
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Channels))
+	test.Equal(t, "channel1", lr.Channels[0])
+	test.Equal(t, 1, len(lr.Producers))
+	test.Equal(t, HostAddr, lr.Producers[0].BroadcastAddress)
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.NotNil(t, err)
+	test.Equal(t, 0, len(nsqlookupd.DB.FindRegistrations("channel", topicName, "*")))
+
+	// renaming onto an existing topic is a conflict
+	nsqlookupd.DB.AddRegistration(Registration{"topic", topicName, ""})
+	endpoint = fmt.Sprintf("http://%s/topic/rename?topic=%s&new_topic=%s",
+		httpAddr, topicName, newTopicName)
+	err = client.POSTV1(endpoint)
+	test.NotNil(t, err)
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("topic", newTopicName, "")))
+
+	endpoint = fmt.Sprintf("http://%s/channel/rename?topic=%s&channel=%s&new_channel=%s",
+		httpAddr, newTopicName, "channel1", "channel2")
+	err = client.POSTV1(endpoint)
+	test.Nil(t, err)
+
+	channels := nsqlookupd.DB.FindRegistrations("channel", newTopicName, "*").SubKeys()
+	test.Equal(t, []string{"channel2"}, channels)
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("channel", newTopicName, "channel2")))
+
+	// so is renaming onto a topic name that one of the channels exists under
+	nsqlookupd.DB.AddRegistration(Registration{"channel", "topic_renamed2", "channel2"})
+	resp, err := http.Post(fmt.Sprintf("http://%s/topic/rename?topic=%s&new_topic=%s",
+		httpAddr, newTopicName, "topic_renamed2"), "", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 409, resp.StatusCode)
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("topic", newTopicName, "")))
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("channel", newTopicName, "channel2")))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("channel", "topic_renamed2", "channel2")))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProxyProtocol = true
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 10.1.2.3 10.1.2.4 56324 4160\r\n"))
+	conn.Write(nsq.MagicV1)
+
+	identify(t, conn)
+
+	producers := nsqlookupd.DB.FindProducers("client", "", "")
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, "10.1.2.3:56324", producers[0].peerInfo.id)
+	test.Equal(t, "10.1.2.3:56324", producers[0].peerInfo.RemoteAddress)
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProxyProtocol = true
+	opts.ProxyProtocolTrustedCIDR = "10.0.0.0/8"
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	// a PROXY header from an untrusted address isn't parsed
+	conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 10.1.2.3 10.1.2.4 56324 4160\r\n"))
+	data, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("E_BAD_PROTOCOL"), data)
+
+	// and without one it keeps its own address
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+	producers := nsqlookupd.DB.FindProducers("client", "", "")
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, conn.LocalAddr().String(), producers[0].peerInfo.id)
+
+	opts = NewOptions()
+	opts.ProxyProtocol = true
+	opts.ProxyProtocolTrustedCIDR = "10.0.0.0"
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
+
+func TestProxyProtocolHeaderTimeout(t *testing.T) {
+	defer func(d time.Duration) { proxyHeaderTimeout = d }(proxyHeaderTimeout)
+	proxyHeaderTimeout = 50 * time.Millisecond
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProxyProtocol = true
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	// a trusted proxy that never sends the header is closed
+	conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	test.Equal(t, io.EOF, err)
+
+	// the deadline is cleared once the header is read
+	conn, err = net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 10.1.2.3 10.1.2.4 56324 4160\r\n"))
+	conn.Write(nsq.MagicV1)
+	time.Sleep(100 * time.Millisecond)
+	identify(t, conn)
+}
+
+func TestSharedIDOwnership(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProxyProtocol = true
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	// both connections get the id 10.1.2.3:56324
+	connect := func() net.Conn {
+		conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+		test.Nil(t, err)
+		conn.Write([]byte("PROXY TCP4 10.1.2.3 10.1.2.4 56324 4160\r\n"))
+		conn.Write(nsq.MagicV1)
+		identify(t, conn)
+		return conn
+	}
+	register := func(conn net.Conn, topic string) {
+		nsq.Register(topic, "").WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	connA := connect()
+	defer connA.Close()
+	register(connA, "shared_id1")
+	register(connA, "shared_id2")
+
+	// the last connection to register the id (its IDENTIFY) takes over
+	// all of the id's producers
+	connB := connect()
+	defer connB.Close()
+	register(connB, "shared_id2")
+
+	connA.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	client := nsqlookupd.DB.FindProducers("client", "", "")
+	test.Equal(t, 1, len(client))
+	for _, topic := range []string{"shared_id1", "shared_id2"} {
+		producers := nsqlookupd.DB.FindProducers("topic", topic, "")
+		test.Equal(t, 1, len(producers))
+		test.Equal(t, true, producers[0].owner == producers[0].peerInfo)
+		test.Equal(t, true, producers[0].peerInfo == client[0].peerInfo)
+	}
+
+	connB.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("topic", "shared_id1", "")))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("topic", "shared_id2", "")))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("client", "", "")))
+}
+
+func TestRegistrations(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	for _, topicName := range []string{"registrations1", "registrations2"} {
+		nsq.Register(topicName, "channel1").WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	var data map[string][]map[string]interface{}
+	endpoint := fmt.Sprintf("http://%s/registrations?category=topic&key=registrations1&subkey=", httpAddr)
+	err := client.GETV1(endpoint, &data)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(data))
+	test.Equal(t, 1, len(data["topic:registrations1:"]))
+	test.Equal(t, HostAddr, data["topic:registrations1:"][0]["broadcast_address"])
+
+	data = nil
+	endpoint = fmt.Sprintf("http://%s/registrations?category=channel&key=*&subkey=channel1", httpAddr)
+	err = client.GETV1(endpoint, &data)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(data))
+	test.Equal(t, 1, len(data["channel:registrations1:channel1"]))
+	test.Equal(t, 1, len(data["channel:registrations2:channel1"]))
+
+	data = nil
+	endpoint = fmt.Sprintf("http://%s/registrations?category=topic", httpAddr)
+	err = client.GETV1(endpoint, &data)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(data))
+
+	endpoint = fmt.Sprintf("http://%s/registrations", httpAddr)
+	err = client.GETV1(endpoint, &data)
+	test.NotNil(t, err)
+}
+
+func TestNodesCache(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.NodesCacheTTL = time.Hour
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/nodes", httpAddr)
+
+	conn1 := mustConnectLookupd(t, tcpAddr)
+	defer conn1.Close()
+	identify(t, conn1)
+
+	pr := ProducersDoc{}
+	err := client.GETV1(endpoint, &pr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(pr.Producers))
+
+	conn2 := mustConnectLookupd(t, tcpAddr)
+	defer conn2.Close()
+	identify(t, conn2)
+
+	// still within the TTL, the DB is not scanned again
+	pr = ProducersDoc{}
+	err = client.GETV1(endpoint, &pr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(pr.Producers))
+
+	pr = ProducersDoc{}
+	err = client.GETV1(endpoint+"?nocache=true", &pr)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(pr.Producers))
+
+	nsqlookupd.getOpts().NodesCacheTTL = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+
+	pr = ProducersDoc{}
+	err = client.GETV1(endpoint, &pr)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(pr.Producers))
+}
+
 func TestInactiveNodes(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -313,58 +660,1777 @@ func TestInactiveNodes(t *testing.T) {
 	test.Equal(t, 0, len(producers))
 }
 
-func TestTombstonedNodes(t *testing.T) {
+func TestEphemeralTopicUnregister(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
 	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
 	defer nsqlookupd.Exit()
 
-	lookupdHTTPAddrs := []string{fmt.Sprintf("%s", httpAddr)}
+	topicName := "ephemeral_topic_unregister#ephemeral"
 
-	topicName := "inactive_nodes"
+	conn1 := mustConnectLookupd(t, tcpAddr)
+	defer conn1.Close()
+	identify(t, conn1)
+
+	conn2 := mustConnectLookupd(t, tcpAddr)
+	defer conn2.Close()
+	identify(t, conn2)
+
+	for _, conn := range []net.Conn{conn1, conn2} {
+		nsq.Register(topicName, "").WriteTo(conn)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		test.Equal(t, []byte("OK"), v)
+	}
+
+	// leave a channel registration behind with no producers
+	nsq.Register(topicName, "ch1").WriteTo(conn1)
+	_, err := nsq.ReadResponse(conn1)
+	test.Nil(t, err)
+	nsq.UnRegister(topicName, "ch1").WriteTo(conn1)
+	_, err = nsq.ReadResponse(conn1)
+	test.Nil(t, err)
+
+	channels := nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
+	test.Equal(t, 1, len(channels))
+
+	// the topic survives while another producer still has it
+	nsq.UnRegister(topicName, "").WriteTo(conn1)
+	_, err = nsq.ReadResponse(conn1)
+	test.Nil(t, err)
+
+	topics := nsqlookupd.DB.FindRegistrations("topic", topicName, "")
+	test.Equal(t, 1, len(topics))
+
+	nsq.UnRegister(topicName, "").WriteTo(conn2)
+	_, err = nsq.ReadResponse(conn2)
+	test.Nil(t, err)
+
+	topics = nsqlookupd.DB.FindRegistrations("topic", topicName, "")
+	test.Equal(t, 0, len(topics))
+	channels = nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
+	test.Equal(t, 0, len(channels))
+
+	// a regular topic is kept after its last producer leaves
+	nsq.Register("regular_topic", "").WriteTo(conn1)
+	_, err = nsq.ReadResponse(conn1)
+	test.Nil(t, err)
+	nsq.UnRegister("regular_topic", "").WriteTo(conn1)
+	_, err = nsq.ReadResponse(conn1)
+	test.Nil(t, err)
+
+	topics = nsqlookupd.DB.FindRegistrations("topic", "regular_topic", "")
+	test.Equal(t, 1, len(topics))
+
+	// ephemeral topics cannot be created by hand
+	endpoint := fmt.Sprintf("http://%s/topic/create?topic=%s", httpAddr, url.QueryEscape(topicName))
+	resp, err := http.Post(endpoint, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	topics = nsqlookupd.DB.FindRegistrations("topic", topicName, "")
+	test.Equal(t, 0, len(topics))
+}
+
+func TestMultiRegister(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
 
 	conn := mustConnectLookupd(t, tcpAddr)
 	defer conn.Close()
+	identify(t, conn)
+
+	// extra whitespace between the topic and channel is ignored
+	body := []byte("mregister1\nmregister2 ch1\nmregister3\nmregister4  \tch2\nmregister5\n")
+	cmd := &nsq.Command{Name: []byte("MREGISTER"), Body: body}
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+
+	for i := 1; i <= 5; i++ {
+		topicName := fmt.Sprintf("mregister%d", i)
+		producers := nsqlookupd.DB.FindProducers("topic", topicName, "")
+		test.Equal(t, 1, len(producers))
+	}
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("channel", "mregister2", "ch1")))
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("channel", "mregister4", "ch2")))
+}
+
+func TestMultiRegisterMaxBodySize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxBodySize = 256
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
 
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
 	identify(t, conn)
 
-	nsq.Register(topicName, "channel1").WriteTo(conn)
-	_, err := nsq.ReadResponse(conn)
+	// only the size is read, the body isn't allocated
+	var buf bytes.Buffer
+	buf.WriteString("MREGISTER\n")
+	binary.Write(&buf, binary.BigEndian, int32(1<<30))
+	_, err := conn.Write(buf.Bytes())
+	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
 	test.Nil(t, err)
+	test.Equal(t, "E_BAD_BODY MREGISTER body too big 1073741824 > 256", string(v))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindRegistrations("topic", "*", "")))
+}
 
-	ci := clusterinfo.New(nil, http_api.NewClient(nil, ConnectTimeout, RequestTimeout))
+func TestList(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
 
-	producers, _ := ci.GetLookupdProducers(lookupdHTTPAddrs)
-	test.Equal(t, 1, len(producers))
-	test.Equal(t, 1, len(producers[0].Topics))
-	test.Equal(t, topicName, producers[0].Topics[0].Topic)
-	test.Equal(t, false, producers[0].Topics[0].Tombstoned)
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
 
-	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=%s:%d",
-		httpAddr, topicName, HostAddr, HTTPPort)
-	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	// requires IDENTIFY
+	cmd := &nsq.Command{Name: []byte("LIST")}
+	_, err := cmd.WriteTo(conn)
 	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, "E_INVALID client must IDENTIFY", string(v))
 
-	producers, _ = ci.GetLookupdProducers(lookupdHTTPAddrs)
-	test.Equal(t, 1, len(producers))
-	test.Equal(t, 1, len(producers[0].Topics))
-	test.Equal(t, topicName, producers[0].Topics[0].Topic)
-	test.Equal(t, true, producers[0].Topics[0].Tombstoned)
+	conn = mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	// other clients' registrations aren't listed
+	other := mustConnectLookupd(t, tcpAddr)
+	defer other.Close()
+	identify(t, other)
+	nsq.Register("list_other", "").WriteTo(other)
+	_, err = nsq.ReadResponse(other)
+	test.Nil(t, err)
+
+	nsq.Register("list_b", "").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	nsq.Register("list_a", "ch").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, `{"registrations":[{"topic":"list_a"},{"topic":"list_a","channel":"ch"},{"topic":"list_b"}]}`, string(v))
 }
 
-func TestCrashingLogger(t *testing.T) {
-	if os.Getenv("BE_CRASHER") == "1" {
-		// Test invalid log level causes error
-		opts := NewOptions()
-		opts.LogLevel = "bad"
-		_ = New(opts)
-		return
-	}
-	cmd := exec.Command(os.Args[0], "-test.run=TestCrashingLogger")
-	cmd.Env = append(os.Environ(), "BE_CRASHER=1")
-	err := cmd.Run()
-	if e, ok := err.(*exec.ExitError); ok && !e.Success() {
-		return
+func TestStatsCommand(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	producer := mustConnectLookupd(t, tcpAddr)
+	defer producer.Close()
+	identify(t, producer)
+	nsq.Register("stats_a", "ch1").WriteTo(producer)
+	_, err := nsq.ReadResponse(producer)
+	test.Nil(t, err)
+	nsq.Register("stats_b", "").WriteTo(producer)
+	_, err = nsq.ReadResponse(producer)
+	test.Nil(t, err)
+
+	// doesn't require IDENTIFY
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	cmd := &nsq.Command{Name: []byte("STATS")}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	var stats struct {
+		Topics    int `json:"topics"`
+		Channels  int `json:"channels"`
+		Producers int `json:"producers"`
+	}
+	err = json.Unmarshal(v, &stats)
+	test.Nil(t, err)
+	test.Equal(t, 2, stats.Topics)
+	test.Equal(t, 1, stats.Channels)
+	test.Equal(t, 1, stats.Producers)
+}
+
+func TestMultiRegisterInvalidEntry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	// one bad entry rejects the whole command
+	body := []byte("mregister_ok\nmregister_bad!\n")
+	cmd := &nsq.Command{Name: []byte("MREGISTER"), Body: body}
+	_, err := cmd.WriteTo(conn)
+	test.Nil(t, err)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, "E_BAD_TOPIC MREGISTER topic name 'mregister_bad!' is not valid", string(v))
+
+	test.Equal(t, 0, len(nsqlookupd.DB.FindRegistrations("topic", "mregister_ok", "")))
+}
+
+func TestCommandRateLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.CommandRateLimit = 10
+	opts.CommandRateBurst = 3
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	for i := 0; i < 3; i++ {
+		nsq.Register(fmt.Sprintf("rate_limit%d", i), "").WriteTo(conn)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		test.Equal(t, []byte("OK"), v)
+	}
+
+	nsq.Register("rate_limit3", "").WriteTo(conn)
+	v, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, "E_RATE_LIMITED REGISTER rate limit exceeded", string(v))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindRegistrations("topic", "rate_limit3", "")))
+
+	// PING isn't limited and the connection stays open
+	for i := 0; i < 5; i++ {
+		nsq.Ping().WriteTo(conn)
+		v, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		test.Equal(t, []byte("OK"), v)
+	}
+
+	// the rejected command paused long enough for a token to be available
+	nsq.Register("rate_limit3", "").WriteTo(conn)
+	v, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("OK"), v)
+}
+
+func TestDebugClientTimes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	before := time.Now().UnixNano()
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	debugClient := func() map[string]interface{} {
+		var data map[string][]map[string]interface{}
+		err := client.GETV1(fmt.Sprintf("http://%s/debug", httpAddr), &data)
+		test.Nil(t, err)
+		test.Equal(t, 1, len(data["client::"]))
+		return data["client::"][0]
+	}
+
+	d1 := debugClient()
+	connectedAt := int64(d1["connected_at"].(float64))
+	test.Equal(t, true, connectedAt >= before)
+	test.Equal(t, true, connectedAt <= time.Now().UnixNano())
+
+	time.Sleep(50 * time.Millisecond)
+
+	d2 := debugClient()
+	test.Equal(t, d1["connected_at"], d2["connected_at"])
+	test.Equal(t, true, d2["last_ping_ago_ms"].(float64) >= d1["last_ping_ago_ms"].(float64)+50)
+
+	nsq.Ping().WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	d3 := debugClient()
+	test.Equal(t, d1["connected_at"], d3["connected_at"])
+	test.Equal(t, true, d3["last_ping_ago_ms"].(float64) < d2["last_ping_ago_ms"].(float64))
+}
+
+func TestDebugClientTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("./test/server.pem", "./test/server.key")
+	test.Nil(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	test.Nil(t, err)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPListener = listener
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	clientCert, err := tls.LoadX509KeyPair("./test/client.pem", "./test/client.key")
+	test.Nil(t, err)
+	conn, err := tls.Dial("tcp", tcpAddr.String(), &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write(nsq.MagicV1)
+	identify(t, conn)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	var data map[string][]map[string]interface{}
+	err = client.GETV1(fmt.Sprintf("http://%s/debug", httpAddr), &data)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(data["client::"]))
+	test.Equal(t, true, data["client::"][0]["tls"])
+	test.Equal(t, "nsq.io", data["client::"][0]["tls_common_name"])
+}
+
+func TestNodesTopicListedOnce(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	// the topic is registered on its own and again by each channel
+	for _, channel := range []string{"", "ch1", "ch2"} {
+		nsq.Register("nodes_once", channel).WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	var doc struct {
+		Producers []struct {
+			Topics     []string `json:"topics"`
+			Tombstones []bool   `json:"tombstones"`
+		} `json:"producers"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/nodes?nocache=true", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Producers))
+	test.Equal(t, []string{"nodes_once"}, doc.Producers[0].Topics)
+	test.Equal(t, []bool{false}, doc.Producers[0].Tombstones)
+}
+
+func TestNodesRegistrationCounts(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+	identify(t, conn)
+
+	for _, r := range [][2]string{
+		{"nodes_counts1", ""},
+		{"nodes_counts1", "ch1"},
+		{"nodes_counts1", "ch2"},
+		{"nodes_counts2", "ch1"},
+		{"nodes_counts3", ""},
+	} {
+		nsq.Register(r[0], r[1]).WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	var doc struct {
+		Producers []struct {
+			TopicCount   int `json:"topic_count"`
+			ChannelCount int `json:"channel_count"`
+		} `json:"producers"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/nodes?nocache=true", nsqlookupd.RealHTTPAddr()), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Producers))
+	test.Equal(t, 3, doc.Producers[0].TopicCount)
+	test.Equal(t, 3, doc.Producers[0].ChannelCount)
+}
+
+func TestNodesByBroadcastAddress(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	// the same node connected twice, so under two ids
+	for _, topic := range []string{"nodes_addr1", "nodes_addr2"} {
+		conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+		defer conn.Close()
+		identify(t, conn)
+		nsq.Register(topic, "ch").WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+	// another node
+	other := &PeerInfo{
+		lastUpdate:       time.Now().UnixNano(),
+		id:               "other:1",
+		BroadcastAddress: "other",
+		TCPPort:          TCPPort,
+		HTTPPort:         HTTPPort,
+		Version:          NSQDVersion,
+	}
+	nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: other})
+	nsqlookupd.DB.AddProducer(Registration{"topic", "nodes_addr3", ""}, &Producer{peerInfo: other})
+
+	var doc struct {
+		Producers []struct {
+			BroadcastAddress string   `json:"broadcast_address"`
+			Topics           []string `json:"topics"`
+		} `json:"producers"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/nodes?broadcast_address=%s", nsqlookupd.RealHTTPAddr(), HostAddr)
+	err := client.GETV1(endpoint, &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Producers))
+	topics := []string{}
+	for _, p := range doc.Producers {
+		test.Equal(t, HostAddr, p.BroadcastAddress)
+		topics = append(topics, p.Topics...)
+	}
+	sort.Strings(topics)
+	test.Equal(t, []string{"nodes_addr1", "nodes_addr2"}, topics)
+
+	endpoint = fmt.Sprintf("http://%s/nodes?broadcast_address=other", nsqlookupd.RealHTTPAddr())
+	err = client.GETV1(endpoint, &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Producers))
+	test.Equal(t, []string{"nodes_addr3"}, doc.Producers[0].Topics)
+}
+
+func TestNodesErrors(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+	identify(t, conn)
+
+	// e.g. registered by a more lenient IDENTIFY
+	now := time.Now().UnixNano()
+	nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: &PeerInfo{
+		lastUpdate:       now,
+		id:               "bad:1",
+		RemoteAddress:    "bad:1",
+		BroadcastAddress: "bad",
+		TCPPort:          0,
+		HTTPPort:         4151,
+		Version:          NSQDVersion,
+	}})
+
+	var doc struct {
+		Producers []*PeerInfo `json:"producers"`
+		Errors    []struct {
+			ID    string `json:"id"`
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/nodes?nocache=true", nsqlookupd.RealHTTPAddr()), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Producers))
+	test.Equal(t, HostAddr, doc.Producers[0].BroadcastAddress)
+	test.Equal(t, 1, len(doc.Errors))
+	test.Equal(t, "bad:1", doc.Errors[0].ID)
+	test.Equal(t, "invalid tcp_port 0", doc.Errors[0].Error)
+}
+
+func TestNodesProbe(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	now := time.Now().UnixNano()
+	for _, port := range []int{nsqlookupd.RealHTTPAddr().Port, closedPort} {
+		nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: &PeerInfo{
+			lastUpdate:       now,
+			id:               "127.0.0.1:" + strconv.Itoa(port),
+			BroadcastAddress: "127.0.0.1",
+			TCPPort:          TCPPort,
+			HTTPPort:         port,
+			Version:          NSQDVersion,
+		}})
+	}
+
+	var doc struct {
+		Producers []struct {
+			HTTPPort  int   `json:"http_port"`
+			Reachable *bool `json:"reachable"`
+		} `json:"producers"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err = client.GETV1(fmt.Sprintf("http://%s/nodes?probe=true", nsqlookupd.RealHTTPAddr()), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Producers))
+	for _, p := range doc.Producers {
+		test.NotNil(t, p.Reachable)
+		test.Equal(t, p.HTTPPort != closedPort, *p.Reachable)
+	}
+
+	// opt-in
+	doc.Producers = nil
+	err = client.GETV1(fmt.Sprintf("http://%s/nodes", nsqlookupd.RealHTTPAddr()), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Producers))
+	for _, p := range doc.Producers {
+		test.Equal(t, true, p.Reachable == nil)
+	}
+}
+
+func TestNodeProberCache(t *testing.T) {
+	prober := newNodeProber(time.Hour, time.Second)
+	var dials int32
+	prober.dial = func(addr string) error {
+		atomic.AddInt32(&dials, 1)
+		if addr == "down:4151" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	addrs := []string{"up:4151", "down:4151", "up:4151"}
+	test.Equal(t, map[string]bool{"up:4151": true, "down:4151": false}, prober.probe(addrs))
+	test.Equal(t, int32(2), atomic.LoadInt32(&dials))
+	test.Equal(t, map[string]bool{"up:4151": true, "down:4151": false}, prober.probe(addrs))
+	test.Equal(t, int32(2), atomic.LoadInt32(&dials))
+
+	prober.ttl = 0
+	prober.entries = make(map[string]nodeProbeEntry)
+	prober.probe(addrs)
+	prober.probe(addrs)
+	test.Equal(t, int32(6), atomic.LoadInt32(&dials))
+}
+
+func TestTombstonedNodes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	lookupdHTTPAddrs := []string{fmt.Sprintf("%s", httpAddr)}
+
+	topicName := "inactive_nodes"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register(topicName, "channel1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	ci := clusterinfo.New(nil, http_api.NewClient(nil, ConnectTimeout, RequestTimeout))
+
+	producers, _ := ci.GetLookupdProducers(lookupdHTTPAddrs)
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, 1, len(producers[0].Topics))
+	test.Equal(t, topicName, producers[0].Topics[0].Topic)
+	test.Equal(t, false, producers[0].Topics[0].Tombstoned)
+
+	endpoint := fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=%s:%d",
+		httpAddr, topicName, HostAddr, HTTPPort)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	test.Nil(t, err)
+
+	producers, _ = ci.GetLookupdProducers(lookupdHTTPAddrs)
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, 1, len(producers[0].Topics))
+	test.Equal(t, topicName, producers[0].Topics[0].Topic)
+	test.Equal(t, true, producers[0].Topics[0].Tombstoned)
+}
+
+func TestUnregisterNode(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	topicName := "unregister_node"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register(topicName, "channel1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	endpoint := fmt.Sprintf("http://%s/node/unregister?node=%s:%d", httpAddr, HostAddr, 1234)
+	resp, err := http.Post(endpoint, "", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+
+	endpoint = fmt.Sprintf("http://%s/node/unregister?node=%s:%d", httpAddr, HostAddr, HTTPPort)
+	resp, err = http.Post(endpoint, "", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	var ur struct {
+		Count int `json:"count"`
+	}
+	err = json.Unmarshal(body, &ur)
+	test.Nil(t, err)
+	// client, topic and channel registrations
+	test.Equal(t, 3, ur.Count)
+
+	lr := LookupDoc{}
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(lr.Producers))
+
+	pr := ProducersDoc{}
+	endpoint = fmt.Sprintf("http://%s/nodes", httpAddr)
+	err = client.GETV1(endpoint, &pr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(pr.Producers))
+}
+
+func TestProducerTombstoneAfter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProducerTombstoneAfter = 100 * time.Millisecond
+	opts.ProducerExpiryInterval = 20 * time.Millisecond
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	topicName := "tombstone_after"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register(topicName, "").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	lr := LookupDoc{}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Producers))
+
+	// no PING, the producer is tombstoned but kept
+	time.Sleep(200 * time.Millisecond)
+	lr = LookupDoc{}
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(lr.Producers))
+	producers := nsqlookupd.DB.FindProducers("topic", topicName, "")
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, true, producers[0].IsTombstoned(opts.TombstoneLifetime))
+}
+
+func TestTouchNode(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.InactiveProducerTimeout = 500 * time.Millisecond
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	topicName := "touch_node"
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register(topicName, "channel1").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	// no PING, the node becomes inactive
+	time.Sleep(600 * time.Millisecond)
+	lr := LookupDoc{}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(lr.Producers))
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/node/touch?node=%s:%d", httpAddr, HostAddr, 1234), "", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/node/touch?node=%s:%d", httpAddr, HostAddr, HTTPPort), "", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var tr struct {
+		Count int `json:"count"`
+	}
+	err = json.Unmarshal(body, &tr)
+	test.Nil(t, err)
+	test.Equal(t, 1, tr.Count)
+
+	lr = LookupDoc{}
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Producers))
+	test.Equal(t, TCPPort, lr.Producers[0].TCPPort)
+}
+
+func TestStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/stats", httpAddr)
+
+	var stats Stats
+	err := client.GETV1(endpoint, &stats)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), stats.Commands.Identify)
+	test.Equal(t, int64(0), stats.Clients)
+	test.Equal(t, int64(0), stats.LastRegistrationChange)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Ping().WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	nsq.Register("stats_topic", "channel1").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	nsq.UnRegister("stats_topic", "channel1").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	err = client.GETV1(endpoint, &stats)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), stats.Commands.Ping)
+	test.Equal(t, int64(1), stats.Commands.Identify)
+	test.Equal(t, int64(1), stats.Commands.Register)
+	test.Equal(t, int64(1), stats.Commands.Unregister)
+	test.Equal(t, int64(1), stats.Clients)
+	test.NotEqual(t, int64(0), stats.LastRegistrationChange)
+}
+
+func TestStatsHTTPRegistrationChange(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/stats", httpAddr)
+
+	var stats Stats
+	err := client.GETV1(endpoint, &stats)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), stats.LastRegistrationChange)
+
+	// changes made over HTTP count as well
+	err = client.POSTV1(fmt.Sprintf("http://%s/channel/create?topic=stats_http&channel=ch1", httpAddr))
+	test.Nil(t, err)
+
+	err = client.GETV1(endpoint, &stats)
+	test.Nil(t, err)
+	test.NotEqual(t, int64(0), stats.LastRegistrationChange)
+}
+
+func TestEphemeralPorts(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPAddress = ":0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	err = nsqlookupd.Main()
+	test.Nil(t, err)
+	defer nsqlookupd.Exit()
+
+	tcpAddr := nsqlookupd.RealTCPAddr()
+	httpAddr := nsqlookupd.RealHTTPAddr()
+	test.NotEqual(t, 0, tcpAddr.Port)
+	test.NotEqual(t, 0, httpAddr.Port)
+	test.NotEqual(t, tcpAddr.Port, httpAddr.Port)
+	test.Equal(t, "127.0.0.1", httpAddr.IP.String())
+
+	conn := mustConnectLookupd(t, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: tcpAddr.Port})
+	defer conn.Close()
+
+	// IDENTIFY reports the ports that were actually bound
+	cmd, _ := nsq.Identify(map[string]interface{}{
+		"tcp_port":          TCPPort,
+		"http_port":         HTTPPort,
+		"broadcast_address": HostAddr,
+		"hostname":          HostAddr,
+		"version":           NSQDVersion,
+	})
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	data, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	var info struct {
+		TCPPort  int `json:"tcp_port"`
+		HTTPPort int `json:"http_port"`
+	}
+	err = json.Unmarshal(data, &info)
+	test.Nil(t, err)
+	test.Equal(t, tcpAddr.Port, info.TCPPort)
+	test.Equal(t, httpAddr.Port, info.HTTPPort)
+}
+
+func TestRegisterEpoch(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	topicName := "register_epoch"
+
+	connect := func(epoch int64) net.Conn {
+		conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+		ci := map[string]interface{}{
+			"tcp_port":          TCPPort,
+			"http_port":         HTTPPort,
+			"broadcast_address": HostAddr,
+			"version":           NSQDVersion,
+		}
+		if epoch != 0 {
+			ci["epoch"] = epoch
+		}
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		return conn
+	}
+	register := func(conn net.Conn) string {
+		nsq.Register(topicName, "").WriteTo(conn)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		return string(v)
+	}
+
+	conn2 := connect(2)
+	defer conn2.Close()
+	test.Equal(t, "OK", register(conn2))
+
+	// a stale node (lower epoch) is rejected, the connection stays open
+	conn1 := connect(1)
+	defer conn1.Close()
+	test.Equal(t, true, strings.HasPrefix(register(conn1), "E_STALE"))
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("topic", topicName, "")))
+
+	// the same or a higher epoch is accepted, and fences off the older one
+	conn3 := connect(3)
+	defer conn3.Close()
+	test.Equal(t, "OK", register(conn3))
+	test.Equal(t, true, strings.HasPrefix(register(conn2), "E_STALE"))
+
+	// without an epoch there is no fencing
+	conn0 := connect(0)
+	defer conn0.Close()
+	test.Equal(t, "OK", register(conn0))
+}
+
+func TestRegisterEpochAfterDisconnect(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	defer exit()
+
+	topicName := "register_epoch_disconnect"
+
+	register := func(epoch int64) (net.Conn, string) {
+		conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+		cmd, _ := nsq.Identify(map[string]interface{}{
+			"tcp_port":          TCPPort,
+			"http_port":         HTTPPort,
+			"broadcast_address": HostAddr,
+			"version":           NSQDVersion,
+			"epoch":             epoch,
+		})
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		nsq.Register(topicName, "").WriteTo(conn)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		return conn, string(v)
+	}
+
+	conn, resp := register(2)
+	test.Equal(t, "OK", resp)
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		if len(nsqlookupd.DB.FindProducers("client", "", "")) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("client", "", "")))
+
+	// the node's epoch outlives its last registration
+	conn, resp = register(1)
+	defer conn.Close()
+	test.Equal(t, true, strings.HasPrefix(resp, "E_STALE"))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("topic", topicName, "")))
+}
+
+func TestListeners(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPListener = tcpListener
+	opts.HTTPListener = httpListener
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	err = nsqlookupd.Main()
+	test.Nil(t, err)
+	defer nsqlookupd.Exit()
+
+	test.Equal(t, tcpListener.Addr().String(), nsqlookupd.RealTCPAddr().String())
+	test.Equal(t, httpListener.Addr().String(), nsqlookupd.RealHTTPAddr().String())
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+	identify(t, conn)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	pr := ProducersDoc{}
+	err = client.GETV1(fmt.Sprintf("http://%s/nodes", nsqlookupd.RealHTTPAddr()), &pr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(pr.Producers))
+}
+
+// fakeStore is a RegistrationStore backed by the in-memory
+// implementation that records which registrations were added
+type fakeStore struct {
+	*RegistrationDB
+	sync.Mutex
+	added []Registration
+}
+
+func (f *fakeStore) AddProducer(k Registration, p *Producer) bool {
+	f.Lock()
+	f.added = append(f.added, k)
+	f.Unlock()
+	return f.RegistrationDB.AddProducer(k, p)
+}
+
+func TestRegistrationStore(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	store := &fakeStore{RegistrationDB: NewRegistrationDB()}
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	nsqlookupd.DB = store
+	err = nsqlookupd.Main()
+	test.Nil(t, err)
+	defer nsqlookupd.Exit()
+
+	topicName := "registration_store"
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register(topicName, "channel1").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	store.Lock()
+	test.Equal(t, []Registration{
+		{"client", "", ""},
+		{"channel", topicName, "channel1"},
+		{"topic", topicName, ""},
+	}, store.added)
+	store.Unlock()
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	lr := LookupDoc{}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", nsqlookupd.RealHTTPAddr(), topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Producers))
+	test.Equal(t, 1, len(lr.Channels))
+}
+
+func TestEvents(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/events", httpAddr))
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	eventChan := make(chan RegistrationEvent)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var e RegistrationEvent
+			if json.Unmarshal([]byte(line[len("data: "):]), &e) == nil {
+				eventChan <- e
+			}
+		}
+		close(eventChan)
+	}()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+
+	identify(t, conn)
+
+	nsq.Register("events_topic", "").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	var events []RegistrationEvent
+	for len(events) < 2 {
+		select {
+		case e := <-eventChan:
+			events = append(events, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for events, got %v", events)
+		}
+	}
+	test.Equal(t, RegistrationEvent{EventAdd, "client", "", "", events[0].PeerID}, events[0])
+	test.NotEqual(t, "", events[0].PeerID)
+	test.Equal(t, RegistrationEvent{EventAdd, "topic", "events_topic", "", events[0].PeerID}, events[1])
+
+	// the subscription is removed once the client goes away
+	resp.Body.Close()
+	for i := 0; i < 100; i++ {
+		db := nsqlookupd.DB.(*RegistrationDB)
+		db.subscribers.Lock()
+		n := len(db.subscribers.chans)
+		db.subscribers.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("subscription was not removed")
+}
+
+func TestInvalidLogLevel(t *testing.T) {
+	opts := NewOptions()
+	opts.LogLevel = "bad"
+	_, err := New(opts)
+	test.NotNil(t, err)
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	opts := NewOptions()
+	opts.LogFormat = "json"
+	opts.LogWriter = &buf
+	_, err := New(opts)
+	test.Nil(t, err)
+
+	var entry map[string]string
+	err = json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &entry)
+	test.Nil(t, err)
+	test.Equal(t, "INFO", entry["level"])
+	test.Equal(t, "nsqlookupd", entry["component"])
+	test.Equal(t, true, strings.HasPrefix(entry["msg"], "nsqlookupd v"))
+
+	opts = NewOptions()
+	opts.LogFormat = "xml"
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
+
+func TestRegistrationLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	opts := NewOptions()
+	opts.LogLevel = "debug"
+	opts.RegistrationLogLevel = "debug"
+	opts.LogFormat = "json"
+	opts.LogWriter = &buf
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn)
+	nsq.Register("reglog", "ch").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	nsqlookupd.Exit()
+
+	id := conn.LocalAddr().String()
+	expected := []string{
+		") REGISTER category:client key: subkey: id:" + id + " conn:1",
+		") REGISTER category:channel key:reglog subkey:ch id:" + id + " conn:1",
+		") REGISTER category:topic key:reglog subkey: id:" + id + " conn:1",
+		// on disconnect
+		") UNREGISTER category:client key: subkey: id:" + id + " conn:1",
+		") UNREGISTER category:channel key:reglog subkey:ch id:" + id + " conn:1",
+		") UNREGISTER category:topic key:reglog subkey: id:" + id + " conn:1",
+	}
+	found := 0
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]string
+		err = json.Unmarshal(line, &entry)
+		test.Nil(t, err)
+		for _, e := range expected {
+			if strings.HasSuffix(entry["msg"], e) {
+				test.Equal(t, "DEBUG", entry["level"])
+				found++
+			}
+		}
+	}
+	test.Equal(t, len(expected), found)
+
+	opts = NewOptions()
+	opts.RegistrationLogLevel = "loud"
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
+
+func TestLogRepeatWindow(t *testing.T) {
+	var buf bytes.Buffer
+	opts := NewOptions()
+	opts.LogFormat = "json"
+	opts.LogWriter = &buf
+	opts.LogRepeatWindow = time.Hour
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+
+	// a broken client reconnecting in a loop
+	for i := 0; i < 5; i++ {
+		conn := mustConnectLookupd(t, tcpAddr)
+		_, err := conn.Write([]byte("BAD\n"))
+		test.Nil(t, err)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		test.Equal(t, "E_INVALID invalid command BAD", string(v))
+		conn.Close()
+	}
+	time.Sleep(10 * time.Millisecond)
+	// the repeats are logged at the latest on exit
+	nsqlookupd.Exit()
+
+	var msgs []string
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]string
+		err := json.Unmarshal(line, &entry)
+		test.Nil(t, err)
+		if strings.Contains(entry["msg"], "invalid command BAD") {
+			test.Equal(t, "ERROR", entry["level"])
+			msgs = append(msgs, entry["msg"])
+		}
+	}
+	// IOLoop's, and the one when the connection is closed
+	expected := []string{
+		"] - E_INVALID invalid command BAD",
+		"] - E_INVALID invalid command BAD (repeated 4 times)",
+		"] - closed - E_INVALID invalid command BAD",
+		"] - closed - E_INVALID invalid command BAD (repeated 4 times)",
+	}
+	test.Equal(t, len(expected), len(msgs))
+	for _, e := range expected {
+		found := 0
+		for _, msg := range msgs {
+			if strings.HasSuffix(msg, e) {
+				found++
+			}
+		}
+		test.Equal(t, 1, found)
+	}
+}
+
+func TestTopicWebhook(t *testing.T) {
+	events := make(chan TopicWebhookEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e TopicWebhookEvent
+		json.NewDecoder(req.Body).Decode(&e)
+		events <- e
+	}))
+	defer webhook.Close()
+
+	opts := NewOptions()
+	opts.TopicWebhookURL = webhook.URL
+	opts.TopicWebhookOnEmpty = true
+	nsqlookupd, exit := startLookupd(t, opts)
+	defer exit()
+
+	nextEvent := func() TopicWebhookEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for webhook")
+		}
+		return TopicWebhookEvent{}
+	}
+
+	// created without producers
+	nsqlookupd.DB.AddRegistration(Registration{"topic", "webhook", ""})
+
+	start := time.Now().Unix()
+	conn1 := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn1.Close()
+	identify(t, conn1)
+	nsq.Register("webhook", "ch").WriteTo(conn1)
+	_, err := nsq.ReadResponse(conn1)
+	test.Nil(t, err)
+
+	e := nextEvent()
+	test.Equal(t, TopicEventFirstProducer, e.Event)
+	test.Equal(t, "webhook", e.Topic)
+	test.Equal(t, true, e.Timestamp >= start)
+
+	// a second producer isn't a transition
+	conn2 := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn2.Close()
+	identify(t, conn2)
+	nsq.Register("webhook", "").WriteTo(conn2)
+	_, err = nsq.ReadResponse(conn2)
+	test.Nil(t, err)
+
+	conn1.Close()
+	conn2.Close()
+	e = nextEvent()
+	test.Equal(t, TopicEventNoProducers, e.Event)
+	test.Equal(t, "webhook", e.Topic)
+
+	opts = NewOptions()
+	opts.TopicWebhookURL = "localhost:1234"
+	_, err = New(opts)
+	test.NotNil(t, err)
+}
+
+func TestListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = listener.Addr().String()
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	err = nsqlookupd.Main()
+	test.NotNil(t, err)
+}
+
+func TestProducerExpiry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProducerExpiry = 100 * time.Millisecond
+	_, err := New(opts)
+	test.NotNil(t, err)
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.InactiveProducerTimeout = 50 * time.Millisecond
+	opts.ProducerExpiry = 100 * time.Millisecond
+	opts.ProducerExpiryInterval = 10 * time.Millisecond
+	_, _, nsqlookupd := mustStartLookupd(opts)
+
+	topicName := "producer_expiry"
+	nsqlookupd.DB.AddProducer(Registration{"topic", topicName, ""},
+		&Producer{peerInfo: &PeerInfo{id: "1", lastUpdate: time.Now().UnixNano()}})
+	test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("topic", topicName, "")))
+
+	start := time.Now()
+	for len(nsqlookupd.DB.FindRegistrations("topic", topicName, "")) > 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("producer was not expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, true, time.Since(start) >= opts.ProducerExpiry-10*time.Millisecond)
+
+	// Exit stops the sweeper
+	nsqlookupd.Exit()
+}
+
+func TestExitTwice(t *testing.T) {
+	nsqlookupd, exit := startLookupd(t, NewOptions())
+	exit()
+	// e.g. a deferred Exit after an explicit one
+	exit()
+
+	_, err := net.Dial("tcp", nsqlookupd.RealTCPAddr().String())
+	test.NotNil(t, err)
+}
+
+func TestLookupCache(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LookupCacheSize = 10
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "lookup_cache"
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	nsq.Register(topicName, "").WriteTo(conn)
+	_, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	for i := 0; i < 2; i++ {
+		lr := LookupDoc{}
+		err = client.GETV1(endpoint, &lr)
+		test.Nil(t, err)
+		test.Equal(t, 1, len(lr.Producers))
+	}
+	stats := nsqlookupd.Stats()
+	test.Equal(t, int64(1), stats.LookupCacheHits)
+	test.Equal(t, int64(1), stats.LookupCacheMisses)
+
+	// the cached lookup is refreshed as soon as the producer unregisters
+	nsq.UnRegister(topicName, "").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	lr := LookupDoc{}
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(lr.Producers))
+	stats = nsqlookupd.Stats()
+	test.Equal(t, int64(2), stats.LookupCacheMisses)
+
+	// and a channel registration refreshes it too
+	nsq.Register(topicName, "ch").WriteTo(conn)
+	_, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lr.Producers))
+	test.Equal(t, []interface{}{"ch"}, lr.Channels)
+}
+
+func TestLookupCacheLRU(t *testing.T) {
+	c := newLookupCache(2)
+	fills := 0
+	fill := func() (bool, []string, Producers) {
+		fills++
+		return true, nil, nil
+	}
+
+	c.get("a", fill)
+	c.get("b", fill)
+	c.get("a", fill)
+	test.Equal(t, 2, fills)
+
+	// evicts b, the least recently used
+	c.get("c", fill)
+	test.Equal(t, 3, fills)
+	c.get("a", fill)
+	test.Equal(t, 3, fills)
+	c.get("b", fill)
+	test.Equal(t, 4, fills)
+	test.Equal(t, 2, c.ll.Len())
+
+	// a change while the DB is read isn't cached
+	c.get("d", func() (bool, []string, Producers) {
+		c.invalidate(RegistrationEvent{Action: EventAdd, Category: "topic", Key: "d"})
+		return true, nil, nil
+	})
+	fills = 0
+	c.get("d", fill)
+	test.Equal(t, 1, fills)
+}
+
+func TestLookupCacheTakeOver(t *testing.T) {
+	db := NewRegistrationDB()
+	c := newLookupCache(10)
+	db.OnChange(c.invalidate)
+	fill := func() (bool, []string, Producers) {
+		return true, nil, db.FindProducers("topic", "b", "")
+	}
+
+	pi1 := &PeerInfo{id: "1"}
+	db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: pi1})
+	db.AddProducer(Registration{"topic", "b", ""}, &Producer{peerInfo: pi1})
+	_, _, producers := c.get("b", fill)
+	test.Equal(t, true, producers[0].peerInfo == pi1)
+
+	// registering a from another connection with the same id takes over b
+	// as well, the cached lookup of b must not keep the old PeerInfo
+	pi2 := &PeerInfo{id: "1"}
+	test.Equal(t, true, db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: pi2}))
+	_, _, producers = c.get("b", fill)
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, true, producers[0].peerInfo == pi2)
+}
+
+func TestRestoreReadiness(t *testing.T) {
+	topicName := "restore_readiness"
+	release := make(chan struct{})
+	opts := NewOptions()
+	opts.Restore = func(db RegistrationStore) error {
+		db.AddRegistration(Registration{"topic", topicName, ""})
+		<-release
+		return nil
+	}
+	nsqlookupd, exit := startLookupd(t, opts)
+	defer exit()
+	httpAddr := nsqlookupd.RealHTTPAddr()
+
+	get := func(path string) int {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a slow restore
+	test.Equal(t, 503, get("/health"))
+	test.Equal(t, 503, get("/lookup?topic="+topicName))
+	test.Equal(t, 200, get("/ping"))
+	test.Equal(t, false, nsqlookupd.IsReady())
+
+	close(release)
+	start := time.Now()
+	for get("/health") != 200 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("not ready after restore")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 200, get("/lookup?topic="+topicName))
+}
+
+func TestRegistrationLimits(t *testing.T) {
+	opts := NewOptions()
+	opts.MaxTopics = 2
+	opts.MaxChannelsPerTopic = 1
+	nsqlookupd, exit := startLookupd(t, opts)
+	defer exit()
+	httpAddr := nsqlookupd.RealHTTPAddr()
+
+	conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+	defer conn.Close()
+	identify(t, conn)
+
+	register := func(topic, channel string) string {
+		nsq.Register(topic, channel).WriteTo(conn)
+		v, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		return string(v)
+	}
+	post := func(path string) (int, string) {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr, path), "", nil)
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		em := ErrMessage{}
+		json.Unmarshal(body, &em)
+		return resp.StatusCode, em.Error
+	}
+
+	test.Equal(t, "OK", register("limits1", "ch1"))
+	// registering again doesn't count
+	test.Equal(t, "OK", register("limits1", "ch1"))
+	test.Equal(t, "E_LIMIT REGISTER failed, too many channels for topic limits1 (max 1)",
+		register("limits1", "ch2"))
+
+	code, _ := post("/topic/create?topic=limits2")
+	test.Equal(t, 200, code)
+	code, key := post("/topic/create?topic=limits3")
+	test.Equal(t, 403, code)
+	test.Equal(t, "LIMIT_EXCEEDED", key)
+	code, _ = post("/channel/create?topic=limits2&channel=ch1")
+	test.Equal(t, 200, code)
+	code, key = post("/channel/create?topic=limits2&channel=ch2")
+	test.Equal(t, 403, code)
+	test.Equal(t, "LIMIT_EXCEEDED", key)
+
+	// the connection is still usable after E_LIMIT
+	test.Equal(t, "E_LIMIT REGISTER failed, too many topics (max 2)", register("limits4", ""))
+	test.Equal(t, "OK", register("limits2", ""))
+
+	test.Equal(t, 2, len(nsqlookupd.DB.FindRegistrations("topic", "*", "")))
+	test.Equal(t, 1, len(nsqlookupd.DB.FindRegistrations("channel", "limits1", "*")))
+	test.Equal(t, 1, len(nsqlookupd.DB.FindRegistrations("channel", "limits2", "*")))
+}
+
+func TestRequireExplicitTopics(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		opts := NewOptions()
+		opts.RequireExplicitTopics = strict
+		nsqlookupd, exit := startLookupd(t, opts)
+
+		conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+		identify(t, conn)
+		register := func(topic, channel string) string {
+			nsq.Register(topic, channel).WriteTo(conn)
+			v, err := nsq.ReadResponse(conn)
+			test.Nil(t, err)
+			return string(v)
+		}
+
+		if strict {
+			test.Equal(t, "E_TOPIC_NOT_FOUND REGISTER failed, topic explicit has not been created",
+				register("explicit", "ch"))
+			test.Equal(t, 0, len(nsqlookupd.DB.FindRegistrations("topic", "explicit", "")))
+			test.Equal(t, "OK", register("explicit#ephemeral", ""))
+
+			resp, err := http.Post(fmt.Sprintf("http://%s/topic/create?topic=explicit",
+				nsqlookupd.RealHTTPAddr()), "", nil)
+			test.Nil(t, err)
+			resp.Body.Close()
+			test.Equal(t, 200, resp.StatusCode)
+		}
+
+		// the default, or once the topic is created
+		test.Equal(t, "OK", register("explicit", "ch"))
+		test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("topic", "explicit", "")))
+		test.Equal(t, 1, len(nsqlookupd.DB.FindProducers("channel", "explicit", "ch")))
+
+		conn.Close()
+		exit()
+	}
+}
+
+func TestCaseInsensitiveTopics(t *testing.T) {
+	for _, insensitive := range []bool{false, true} {
+		opts := NewOptions()
+		opts.CaseInsensitiveTopics = insensitive
+		opts.CaseInsensitiveChannels = insensitive
+		nsqlookupd, exit := startLookupd(t, opts)
+
+		conn := mustConnectLookupd(t, nsqlookupd.RealTCPAddr())
+		identify(t, conn)
+		for _, tc := range [][2]string{{"Events", "Archive"}, {"events", "archive"}, {"EVENTS", ""}} {
+			nsq.Register(tc[0], tc[1]).WriteTo(conn)
+			v, err := nsq.ReadResponse(conn)
+			test.Nil(t, err)
+			test.Equal(t, []byte("OK"), v)
+		}
+
+		topics := nsqlookupd.DB.FindRegistrations("topic", "*", "").Keys()
+		sort.Strings(topics)
+		channels := nsqlookupd.DB.FindRegistrations("channel", "*", "*").SubKeys()
+		sort.Strings(channels)
+		if insensitive {
+			test.Equal(t, []string{"events"}, topics)
+			test.Equal(t, []string{"archive"}, channels)
+		} else {
+			test.Equal(t, []string{"EVENTS", "Events", "events"}, topics)
+			test.Equal(t, []string{"Archive", "archive"}, channels)
+		}
+
+		// lookups are normalized the same way
+		client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+		var data struct {
+			Channels []string `json:"channels"`
+		}
+		endpoint := fmt.Sprintf("http://%s/lookup?topic=Events", nsqlookupd.RealHTTPAddr())
+		err := client.GETV1(endpoint, &data)
+		test.Nil(t, err)
+		if insensitive {
+			test.Equal(t, []string{"archive"}, data.Channels)
+		} else {
+			test.Equal(t, []string{"Archive"}, data.Channels)
+		}
+
+		// and so are the channels created along with a topic
+		resp, err := http.Post(fmt.Sprintf("http://%s/topic/create?topic=t&channel=Foo",
+			nsqlookupd.RealHTTPAddr()), "", nil)
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		channels = nsqlookupd.DB.FindRegistrations("channel", "t", "*").SubKeys()
+		if insensitive {
+			test.Equal(t, []string{"foo"}, channels)
+		} else {
+			test.Equal(t, []string{"Foo"}, channels)
+		}
+
+		conn.Close()
+		exit()
+	}
+}
+
+func TestProducerWeight(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	for i, weight := range []interface{}{nil, 5} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		ci := map[string]interface{}{
+			"tcp_port":          TCPPort + i,
+			"http_port":         HTTPPort + i,
+			"broadcast_address": HostAddr,
+			"version":           NSQDVersion,
+		}
+		if weight != nil {
+			ci["weight"] = weight
+		}
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+
+		nsq.Register("weighted", "").WriteTo(conn)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	var data struct {
+		Producers []struct {
+			TCPPort int `json:"tcp_port"`
+			Weight  int `json:"weight"`
+		} `json:"producers"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/lookup?topic=weighted", httpAddr), &data)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(data.Producers))
+	weights := map[int]int{}
+	for _, p := range data.Producers {
+		weights[p.TCPPort] = p.Weight
+	}
+	// not sent defaults to 1
+	test.Equal(t, map[int]int{TCPPort: 1, TCPPort + 1: 5}, weights)
+}
+
+func TestLookupGroupBy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	for i, dc := range []string{"east", "west", "east", ""} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		ci := map[string]interface{}{
+			"tcp_port":          TCPPort + i,
+			"http_port":         HTTPPort + i,
+			"broadcast_address": HostAddr,
+			"version":           NSQDVersion,
+		}
+		if dc != "" {
+			ci["metadata"] = map[string]string{"dc": dc}
+		}
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+
+		nsq.Register("grouped", "").WriteTo(conn)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	var data struct {
+		Producers []*PeerInfo            `json:"producers"`
+		Groups    map[string][]*PeerInfo `json:"groups"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/lookup?topic=grouped&group_by=dc", httpAddr), &data)
+	test.Nil(t, err)
+	test.Equal(t, 4, len(data.Producers))
+
+	ports := map[string][]int{}
+	for group, producers := range data.Groups {
+		for _, p := range producers {
+			ports[group] = append(ports[group], p.TCPPort)
+		}
+		sort.Ints(ports[group])
+	}
+	test.Equal(t, map[string][]int{
+		"east":    {TCPPort, TCPPort + 2},
+		"west":    {TCPPort + 1},
+		"unknown": {TCPPort + 3},
+	}, ports)
+	test.Equal(t, map[string]string{"dc": "west"}, data.Groups["west"][0].Metadata)
+
+	// without group_by
+	data.Groups = nil
+	err = client.GETV1(fmt.Sprintf("http://%s/lookup?topic=grouped", httpAddr), &data)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(data.Groups))
+}
+
+func TestFindOrphanedChannels(t *testing.T) {
+	for _, repair := range []bool{false, true} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		_, _, nsqlookupd := mustStartLookupd(opts)
+
+		nsqlookupd.DB.AddRegistration(Registration{"topic", "ok", ""})
+		nsqlookupd.DB.AddRegistration(Registration{"channel", "ok", "ch"})
+		// only the channels are registered
+		nsqlookupd.DB.AddRegistration(Registration{"channel", "orphan", "ch1"})
+		nsqlookupd.DB.AddRegistration(Registration{"channel", "orphan", "ch2"})
+
+		orphans := nsqlookupd.findOrphanedChannels(repair)
+		test.Equal(t, []string{"orphan", "orphan"}, orphans.Keys())
+		test.Equal(t, []string{"ch1", "ch2"}, orphans.SubKeys())
+
+		topics := nsqlookupd.DB.FindRegistrations("topic", "orphan", "")
+		if repair {
+			test.Equal(t, 1, len(topics))
+			test.Equal(t, 0, len(nsqlookupd.findOrphanedChannels(repair)))
+		} else {
+			test.Equal(t, 0, len(topics))
+			test.Equal(t, 2, len(nsqlookupd.findOrphanedChannels(repair)))
+		}
+
+		nsqlookupd.Exit()
 	}
-	t.Fatalf("process ran with err %v, want exit status 1", err)
 }
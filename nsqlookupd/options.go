@@ -1,7 +1,9 @@
 package nsqlookupd
 
 import (
+	"io"
 	"log"
+	"net"
 	"os"
 	"time"
 
@@ -12,15 +14,133 @@ type Options struct {
 	LogLevel  string `flag:"log-level"`
 	LogPrefix string `flag:"log-prefix"`
 	Verbose   bool   `flag:"verbose"` // for backwards compatibility
+	LogFormat string `flag:"log-format"`
 	Logger    Logger
 	logLevel  lg.LogLevel // private, not really an option
 
+	// identical protocol errors from one IP within this window are logged
+	// once, then as a "(repeated N times)" line (0 logs every one)
+	LogRepeatWindow time.Duration `flag:"log-repeat-window"`
+
+	// the level registration changes made by TCP clients are logged at
+	RegistrationLogLevel string `flag:"registration-log-level"`
+	registrationLogLevel lg.LogLevel
+
+	// where the default Logger writes, os.Stderr when nil (unused if Logger is set)
+	LogWriter io.Writer
+
 	TCPAddress       string `flag:"tcp-address"`
 	HTTPAddress      string `flag:"http-address"`
 	BroadcastAddress string `flag:"broadcast-address"`
+	ProxyProtocol    bool   `flag:"proxy-protocol"`
+
+	// with ProxyProtocol, the load balancers expected to send a PROXY
+	// header, connections from other addresses are handled without one
+	ProxyProtocolTrustedCIDR string `flag:"proxy-protocol-trusted-cidr"`
+
+	AllowConfigFromCIDR string `flag:"allow-config-from-cidr"`
+
+	// what IDENTIFY does with a loopback, unspecified or link-local
+	// broadcast address: "" accepts it, "reject" closes the connection and
+	// "replace" uses the IP the client connected from instead. Addresses
+	// in BroadcastAddressAllowCIDR are accepted, those in
+	// BroadcastAddressDenyCIDR handled the same way.
+	BroadcastAddressCheck     string `flag:"broadcast-address-check"`
+	BroadcastAddressAllowCIDR string `flag:"broadcast-address-allow-cidr"`
+	BroadcastAddressDenyCIDR  string `flag:"broadcast-address-deny-cidr"`
+
+	// reject REGISTER/UNREGISTER and HTTP requests that change the DB,
+	// lookups are still served
+	ReadOnly bool `flag:"read-only"`
+
+	// reject REGISTER for topics that weren't created with /topic/create
+	// (ephemeral topics, which can't be created, are still allowed)
+	RequireExplicitTopics bool `flag:"require-explicit-topics"`
+
+	// lowercase topic (and channel) names in REGISTER/UNREGISTER and HTTP
+	// requests, so names differing only in case are the same registration
+	CaseInsensitiveTopics   bool `flag:"case-insensitive-topics"`
+	CaseInsensitiveChannels bool `flag:"case-insensitive-channels"`
+
+	// record how long registration changes wait for the DB lock, in /stats
+	DBLockMetrics bool `flag:"db-lock-metrics"`
+
+	// pre-created listeners, used instead of listening on
+	// TCPAddress/HTTPAddress when set
+	TCPListener  net.Listener
+	HTTPListener net.Listener
+
+	// Restore, when set, loads registrations into the DB at startup (e.g.
+	// from a snapshot). Until it returns TCP clients wait, HTTP requests
+	// other than /ping, /health and /info get a 503 and /health reports
+	// not ready.
+	Restore func(db RegistrationStore) error
+
+	TCPKeepAlivePeriod time.Duration `flag:"tcp-keepalive-period"`
+
+	// how long writing a response to a client may take (0 disables)
+	TCPWriteTimeout time.Duration `flag:"tcp-write-timeout"`
+
+	// how long Exit waits for connected clients before closing them
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout"`
+
+	MaxLineLength int `flag:"max-line-length"`
+
+	// the largest IDENTIFY/MREGISTER body a client can send
+	MaxBodySize int `flag:"max-body-size"`
+
+	// the most TCP connections from one IP, excess connections are closed
+	// (0 for no limit), with ProxyProtocol the IP is the one in the header
+	MaxConnectionsPerIP int `flag:"max-connections-per-ip"`
+
+	// per connection limit of REGISTER/UNREGISTER commands per second (0 disables)
+	CommandRateLimit float64 `flag:"command-rate-limit"`
+	CommandRateBurst int     `flag:"command-rate-burst"`
+
+	// the most topics, and channels per topic, that can be registered or
+	// created (0 for no limit)
+	MaxTopics           int `flag:"max-topics"`
+	MaxChannelsPerTopic int `flag:"max-channels-per-topic"`
 
 	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
 	TombstoneLifetime       time.Duration `flag:"tombstone-lifetime"`
+
+	// producers not heard from for ProducerExpiry are removed from the DB,
+	// checked every ProducerExpiryInterval (0 expiry disables)
+	ProducerExpiry         time.Duration `flag:"producer-expiry"`
+	ProducerExpiryInterval time.Duration `flag:"producer-expiry-interval"`
+
+	// topic producers not heard from for ProducerTombstoneAfter are
+	// tombstoned rather than removed, until TombstoneLifetime after they
+	// PING again (0 disables)
+	ProducerTombstoneAfter time.Duration `flag:"producer-tombstone-after"`
+
+	NodesCacheTTL time.Duration `flag:"nodes-cache-ttl"`
+
+	// how often channels registered without their topic are looked for and
+	// logged (0 disables), with ConsistencyCheckRepair the topic is added
+	ConsistencyCheckInterval time.Duration `flag:"consistency-check-interval"`
+	ConsistencyCheckRepair   bool          `flag:"consistency-check-repair"`
+
+	// the most topics whose /lookup registrations are cached (0 disables)
+	LookupCacheSize int `flag:"lookup-cache-size"`
+
+	// POSTed to when a topic gets its first producer, and when it loses
+	// its last one if TopicWebhookOnEmpty is set
+	TopicWebhookURL     string `flag:"topic-webhook-url"`
+	TopicWebhookOnEmpty bool   `flag:"topic-webhook-on-empty"`
+
+	// a 0 timeout or max body size is disabled, 0 max header bytes uses
+	// the net/http default
+	HTTPReadTimeout    time.Duration `flag:"http-read-timeout"`
+	HTTPWriteTimeout   time.Duration `flag:"http-write-timeout"`
+	HTTPIdleTimeout    time.Duration `flag:"http-idle-timeout"`
+	HTTPMaxHeaderBytes int           `flag:"http-max-header-bytes"`
+	HTTPMaxBodySize    int64         `flag:"http-max-body-size"`
+
+	HTTPLogMinStatus  int     `flag:"http-log-min-status"`
+	HTTPLogSampleRate float64 `flag:"http-log-sample-rate"`
+	HTTPLogFormat     string  `flag:"http-log-format"`
 }
 
 func NewOptions() *Options {
@@ -32,11 +152,31 @@ func NewOptions() *Options {
 	return &Options{
 		LogPrefix:        "[nsqlookupd] ",
 		LogLevel:         "info",
+		LogFormat:        "text",
 		TCPAddress:       "0.0.0.0:4160",
 		HTTPAddress:      "0.0.0.0:4161",
 		BroadcastAddress: hostname,
 
+		ProxyProtocolTrustedCIDR: "127.0.0.1/8",
+
+		TCPKeepAlivePeriod: 30 * time.Second,
+		ShutdownTimeout:    5 * time.Second,
+
+		MaxLineLength: 4096,
+		MaxBodySize:   1024 * 1024,
+
+		RegistrationLogLevel: "info",
+		LogRepeatWindow:      10 * time.Second,
+
+		CommandRateBurst: 100,
+
 		InactiveProducerTimeout: 300 * time.Second,
 		TombstoneLifetime:       45 * time.Second,
+
+		ProducerExpiryInterval: 60 * time.Second,
+
+		HTTPMaxBodySize: 1024 * 1024,
+
+		HTTPLogFormat: "text",
 	}
 }
@@ -0,0 +1,46 @@
+package nsqlookupd
+
+import (
+	"time"
+)
+
+// the longest a rate limited client is paused before it is told so
+const maxRateLimitPause = time.Second
+
+// tokenBucket is a token bucket rate limiter, it is only used by the
+// goroutine handling a single connection so it isn't safe for concurrent use
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take removes a token, when none are available it returns false and
+// how long until the next one is
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
@@ -1,15 +1,86 @@
 package nsqlookupd
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	errRegistrationNotFound = errors.New("registration not found")
+	errRegistrationExists   = errors.New("registration already exists")
+)
+
+// RegistrationStore is the storage used by the TCP and HTTP servers for
+// registrations and their producers. RegistrationDB is the default,
+// in-memory, implementation; others may share state across instances.
+type RegistrationStore interface {
+	AddRegistration(k Registration) bool
+	AddProducer(k Registration, p *Producer) bool
+	RemoveProducer(k Registration, id string) (bool, int)
+	RemoveOwnedProducer(k Registration, owner *PeerInfo) (bool, int)
+	RemoveAllProducersByID(id string) Registrations
+	RemoveAllProducersOwnedBy(owner *PeerInfo) Registrations
+	RemoveAllProducersFromRegistration(k Registration) int
+	RemoveExpiredProducers(before time.Time) int
+	ClearExpiredTombstones(lifetime time.Duration) int
+	TombstoneStaleProducers(before time.Time) int
+	RemoveEmptyRegistrations() int
+	FenceEpoch(node string, epoch int64) bool
+	ClearExpiredEpochs(before time.Time) int
+	RemoveRegistration(k Registration)
+	RenameTopic(oldName string, newName string) error
+	RenameChannel(topicName string, oldName string, newName string) error
+	FindRegistrations(category string, key string, subkey string) Registrations
+	FindProducers(category string, key string, subkey string) Producers
+	FindProducersByBroadcastAddress(addr string) Producers
+	LookupRegistrations(id string) Registrations
+	TopicStaleness(topic string) (time.Duration, bool)
+	TopicChannels(limit int) (map[string][]string, bool)
+	Snapshot() map[Registration]Producers
+	Subscribe() (<-chan RegistrationEvent, func())
+	Ping(timeout time.Duration) error
+}
+
 type RegistrationDB struct {
 	sync.RWMutex
 	registrationMap map[Registration]Producers
+	subscribers     subscribers
+
+	// canonical PeerInfo for each producer id, shared by all of its
+	// registrations and reference counted by the number of producers
+	peers map[string]*internedPeer
+
+	// highest epoch seen from each node (broadcast_address:tcp_port), kept
+	// across reconnects, so that a stale node can't register over a newer one,
+	// see ClearExpiredEpochs
+	epochs map[string]*nodeEpoch
+
+	// when set, the time AddProducer and RemoveProducer wait for the write
+	// lock, see EnableLockWaitMetrics
+	lockWait *waitHistogram
+
+	// the Ping probe in flight, if any, closed once it gets the read lock
+	ping struct {
+		sync.Mutex
+		done chan struct{}
+	}
+}
+
+type nodeEpoch struct {
+	epoch int64
+	// when the node last fenced, or last had a producer removed
+	lastSeen time.Time
+}
+
+type internedPeer struct {
+	peerInfo *PeerInfo
+	refs     int
 }
 
 /*
@@ -42,19 +113,51 @@ type Registrations []Registration
 // producer info
 type PeerInfo struct {
 	lastUpdate       int64
-	id               string  // id 是client.RemoteAddr (IP:Port)
+	connectedAt      int64 // set at IDENTIFY
+	tls              bool
+	tlsCommonName    string // CN of the client certificate
+	epoch            int64  // fencing token from IDENTIFY, 0 when not sent
+	id               string // id 是client.RemoteAddr (IP:Port)
 	RemoteAddress    string `json:"remote_address"`
 	Hostname         string `json:"hostname"`
 	BroadcastAddress string `json:"broadcast_address"`
 	TCPPort          int    `json:"tcp_port"`
 	HTTPPort         int    `json:"http_port"`
 	Version          string `json:"version"`
+
+	// a hint for clients choosing between producers, not used by nsqlookupd
+	Weight int `json:"weight"`
+
+	// free form tags (e.g. "dc"), /lookup?group_by= groups producers by one
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// check returns what is wrong with p, if anything, that would make it
+// unusable by a client (e.g. a port it can't connect to)
+func (p *PeerInfo) check() error {
+	if p.BroadcastAddress == "" {
+		return errors.New("empty broadcast_address")
+	}
+	if p.TCPPort <= 0 || p.TCPPort > 65535 {
+		return fmt.Errorf("invalid tcp_port %d", p.TCPPort)
+	}
+	if p.HTTPPort <= 0 || p.HTTPPort > 65535 {
+		return fmt.Errorf("invalid http_port %d", p.HTTPPort)
+	}
+	if p.Version == "" {
+		return errors.New("empty version")
+	}
+	return nil
 }
 
 type Producer struct {
-	peerInfo     *PeerInfo
-	tombstoned   bool
-	tombstonedAt time.Time
+	peerInfo *PeerInfo
+	owner    *PeerInfo // PeerInfo of the connection that registered it, see AddProducer
+
+	// the producer's tombstone can change while readers of the DB use it
+	tombstoneLock sync.Mutex
+	tombstoned    bool
+	tombstonedAt  time.Time
 }
 
 type Producers []*Producer
@@ -63,55 +166,217 @@ func (p *Producer) String() string {
 	return fmt.Sprintf("%s [%d, %d]", p.peerInfo.BroadcastAddress, p.peerInfo.TCPPort, p.peerInfo.HTTPPort)
 }
 
+// matches reports whether p is the producer for id, owned by owner unless
+// it is nil
+func (p *Producer) matches(id string, owner *PeerInfo) bool {
+	return p.peerInfo.id == id && (owner == nil || p.owner == owner)
+}
+
 func (p *Producer) Tombstone() {
+	p.tombstoneLock.Lock()
 	p.tombstoned = true
 	p.tombstonedAt = time.Now()
+	p.tombstoneLock.Unlock()
 }
 
 func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
-	return p.tombstoned && time.Now().Sub(p.tombstonedAt) < lifetime
+	tombstoned, at := p.tombstoneState()
+	return tombstoned && time.Now().Sub(at) < lifetime
+}
+
+// TombstoneExpired reports whether p was tombstoned more than lifetime ago,
+// it is then no longer IsTombstoned but still flagged
+func (p *Producer) TombstoneExpired(lifetime time.Duration) bool {
+	tombstoned, at := p.tombstoneState()
+	return tombstoned && time.Now().Sub(at) >= lifetime
+}
+
+// tombstoneState returns whether, and when, p was tombstoned
+func (p *Producer) tombstoneState() (bool, time.Time) {
+	p.tombstoneLock.Lock()
+	defer p.tombstoneLock.Unlock()
+	return p.tombstoned, p.tombstonedAt
+}
+
+func (p *Producer) clearTombstone() {
+	p.tombstoneLock.Lock()
+	p.tombstoned = false
+	p.tombstonedAt = time.Time{}
+	p.tombstoneLock.Unlock()
+}
+
+const (
+	ProducerActive     = "active"
+	ProducerInactive   = "inactive"
+	ProducerTombstoned = "tombstoned"
+)
+
+// Status reports whether the producer is tombstoned, has not been heard
+// from within inactivityTimeout, or is active
+func (p *Producer) Status(inactivityTimeout time.Duration, tombstoneLifetime time.Duration) string {
+	if p.IsTombstoned(tombstoneLifetime) {
+		return ProducerTombstoned
+	}
+	cur := time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate))
+	if time.Now().Sub(cur) > inactivityTimeout {
+		return ProducerInactive
+	}
+	return ProducerActive
 }
 
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
 		registrationMap: make(map[Registration]Producers),
+		peers:           make(map[string]*internedPeer),
+		epochs:          make(map[string]*nodeEpoch),
+	}
+}
+
+// EnableLockWaitMetrics starts recording how long AddProducer and
+// RemoveProducer wait for the write lock, it must be called before the DB
+// is used
+func (r *RegistrationDB) EnableLockWaitMetrics() {
+	r.lockWait = newWaitHistogram()
+}
+
+// LockWaitStats returns the lock waits recorded so far, false if they
+// aren't being recorded
+func (r *RegistrationDB) LockWaitStats() (LockWaitStats, bool) {
+	if r.lockWait == nil {
+		return LockWaitStats{}, false
+	}
+	return r.lockWait.stats(), true
+}
+
+// lockTimed takes the write lock, recording the wait when enabled
+func (r *RegistrationDB) lockTimed() {
+	if r.lockWait == nil {
+		r.Lock()
+		return
+	}
+	start := time.Now()
+	r.Lock()
+	r.lockWait.observe(time.Since(start))
+}
+
+// point p at the canonical PeerInfo for its id, must be called with the lock held
+func (r *RegistrationDB) intern(p *Producer) {
+	ip, ok := r.peers[p.peerInfo.id]
+	if !ok {
+		ip = &internedPeer{peerInfo: p.peerInfo}
+		r.peers[p.peerInfo.id] = ip
+	}
+	ip.refs++
+	p.peerInfo = ip.peerInfo
+}
+
+// drop a reference to the PeerInfo for id, must be called with the lock held
+func (r *RegistrationDB) release(id string) {
+	ip, ok := r.peers[id]
+	if !ok {
+		return
+	}
+	ip.refs--
+	if ip.refs <= 0 {
+		delete(r.peers, id)
+		if e, ok := r.epochs[epochNode(ip.peerInfo)]; ok {
+			e.lastSeen = time.Now()
+		}
 	}
 }
 
 // add a registration key
-func (r *RegistrationDB) AddRegistration(k Registration) {
+func (r *RegistrationDB) AddRegistration(k Registration) bool {
 	r.Lock()
 	defer r.Unlock()
 	_, ok := r.registrationMap[k]
 	if !ok {
 		r.registrationMap[k] = Producers{}
+		r.subscribers.publish(EventAdd, k, "")
 	}
+	return !ok
 }
 
 // add a producer to a registration
 // 拿 k 为 client为列：
 // 先获取现有的client's producers, RemoteAddr为ID，如果存在该ID， 什么也不做，返回false
 // 如果不存在该ID， 则追加该Product 到client 里面，返回true
+//
+// p.owner is the PeerInfo of the connection registering it, p.peerInfo when
+// not set. Two connections can share an id (e.g. behind a NAT or the PROXY
+// protocol), when the other one registers an id that is already there the
+// last writer wins: it takes over every producer of the id, which then
+// follow its PeerInfo, and true is returned. A connection can only remove
+// the producers it owns, see RemoveOwnedProducer and RemoveAllProducersOwnedBy.
 func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
-	r.Lock()
+	r.lockTimed()
 	defer r.Unlock()
-	producers := r.registrationMap[k]
-	found := false
-	for _, producer := range producers {
-		if producer.peerInfo.id == p.peerInfo.id {
-			found = true
-			break
+	if p.owner == nil {
+		p.owner = p.peerInfo
+	}
+	for _, producer := range r.registrationMap[k] {
+		if producer.peerInfo.id != p.peerInfo.id {
+			continue
+		}
+		if producer.owner == p.owner {
+			return false
+		}
+		r.takeOver(p.peerInfo.id, p.owner)
+		return true
+	}
+	r.intern(p)
+	r.registrationMap[k] = append(r.registrationMap[k], p)
+	r.subscribers.publish(EventAdd, k, p.peerInfo.id)
+	return true
+}
+
+// takeOver makes owner the owner of every producer of id, and its PeerInfo
+// the canonical one, keeping their tombstones. The number of producers is
+// unchanged so is the reference count. Every registration whose producer was
+// replaced is published as changed. It must be called with the lock held.
+func (r *RegistrationDB) takeOver(id string, owner *PeerInfo) {
+	for k, producers := range r.registrationMap {
+		var cleaned Producers
+		for i, producer := range producers {
+			if producer.peerInfo.id != id {
+				continue
+			}
+			if cleaned == nil {
+				// the slice may be in use by readers, replace it rather than the element
+				cleaned = append(Producers{}, producers...)
+			}
+			tombstoned, tombstonedAt := producer.tombstoneState()
+			cleaned[i] = &Producer{
+				peerInfo:     owner,
+				owner:        owner,
+				tombstoned:   tombstoned,
+				tombstonedAt: tombstonedAt,
+			}
+		}
+		if cleaned != nil {
+			r.registrationMap[k] = cleaned
+			r.subscribers.publish(EventAdd, k, id)
 		}
 	}
-	if found == false {
-		r.registrationMap[k] = append(producers, p)
+	if ip, ok := r.peers[id]; ok {
+		ip.peerInfo = owner
 	}
-	return !found
 }
 
 // remove a producer from a registration
 func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
-	r.Lock()
+	return r.removeProducer(k, id, nil)
+}
+
+// remove the producer for owner.id from a registration, only if the
+// connection owner belongs to still owns it
+func (r *RegistrationDB) RemoveOwnedProducer(k Registration, owner *PeerInfo) (bool, int) {
+	return r.removeProducer(k, owner.id, owner)
+}
+
+// a nil owner matches any
+func (r *RegistrationDB) removeProducer(k Registration, id string, owner *PeerInfo) (bool, int) {
+	r.lockTimed()
 	defer r.Unlock()
 	producers, ok := r.registrationMap[k]
 	if !ok {
@@ -120,7 +385,7 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	removed := false
 	cleaned := Producers{}
 	for _, producer := range producers {
-		if producer.peerInfo.id != id {
+		if !producer.matches(id, owner) {
 			cleaned = append(cleaned, producer)
 		} else {
 			removed = true
@@ -128,16 +393,308 @@ func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	}
 	// Note: this leaves keys in the DB even if they have empty lists
 	r.registrationMap[k] = cleaned
+	if removed {
+		r.release(id)
+		r.subscribers.publish(EventRemove, k, id)
+	}
 	return removed, len(cleaned)
 }
 
+// remove a producer from every registration it belongs to, returning
+// the registrations it was removed from
+func (r *RegistrationDB) RemoveAllProducersByID(id string) Registrations {
+	return r.removeAllProducers(id, nil)
+}
+
+// remove the producers owned by the connection owner belongs to from every
+// registration, returning the registrations they were removed from, the
+// ones another connection with the same id took over are kept
+func (r *RegistrationDB) RemoveAllProducersOwnedBy(owner *PeerInfo) Registrations {
+	return r.removeAllProducers(owner.id, owner)
+}
+
+func (r *RegistrationDB) removeAllProducers(id string, owner *PeerInfo) Registrations {
+	r.Lock()
+	defer r.Unlock()
+	removed := Registrations{}
+	for k, producers := range r.registrationMap {
+		cleaned := Producers{}
+		for _, producer := range producers {
+			if !producer.matches(id, owner) {
+				cleaned = append(cleaned, producer)
+			}
+		}
+		if len(cleaned) != len(producers) {
+			// Note: this leaves keys in the DB even if they have empty lists
+			r.registrationMap[k] = cleaned
+			removed = append(removed, k)
+			r.release(id)
+			r.subscribers.publish(EventRemove, k, id)
+		}
+	}
+	return removed
+}
+
+// remove producers whose lastUpdate is before the given time, and the
+// registrations that they leave empty (registrations that were already
+// empty, e.g. created with /topic/create, are kept), returning how many
+// producers were removed
+func (r *RegistrationDB) RemoveExpiredProducers(before time.Time) int {
+	expired := func(p *Producer) bool {
+		return atomic.LoadInt64(&p.peerInfo.lastUpdate) < before.UnixNano()
+	}
+
+	// most sweeps find nothing, only take the write lock when they don't
+	r.RLock()
+	found := false
+	for _, producers := range r.registrationMap {
+		for _, p := range producers {
+			if expired(p) {
+				found = true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	r.RUnlock()
+	if !found {
+		return 0
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	removed := 0
+	for k, producers := range r.registrationMap {
+		cleaned := Producers{}
+		for _, p := range producers {
+			if !expired(p) {
+				cleaned = append(cleaned, p)
+				continue
+			}
+			removed++
+			r.release(p.peerInfo.id)
+			r.subscribers.publish(EventRemove, k, p.peerInfo.id)
+		}
+		if len(cleaned) == len(producers) {
+			continue
+		}
+		if len(cleaned) == 0 {
+			delete(r.registrationMap, k)
+			r.subscribers.publish(EventRemove, k, "")
+			continue
+		}
+		r.registrationMap[k] = cleaned
+	}
+	return removed
+}
+
+// clear the tombstone of producers tombstoned more than lifetime ago,
+// returning how many were cleared
+func (r *RegistrationDB) ClearExpiredTombstones(lifetime time.Duration) int {
+	r.Lock()
+	defer r.Unlock()
+	cleared := 0
+	for _, producers := range r.registrationMap {
+		for _, p := range producers {
+			if p.TombstoneExpired(lifetime) {
+				p.clearTombstone()
+				cleared++
+			}
+		}
+	}
+	return cleared
+}
+
+// tombstone the topic producers last updated before before, refreshing
+// the tombstones of those already tombstoned so they don't expire while the
+// producer stays stale, returning how many weren't tombstoned yet
+func (r *RegistrationDB) TombstoneStaleProducers(before time.Time) int {
+	r.Lock()
+	defer r.Unlock()
+	tombstoned := 0
+	for k, producers := range r.registrationMap {
+		if k.Category != "topic" {
+			continue
+		}
+		for _, p := range producers {
+			if atomic.LoadInt64(&p.peerInfo.lastUpdate) >= before.UnixNano() {
+				continue
+			}
+			if wasTombstoned, _ := p.tombstoneState(); !wasTombstoned {
+				tombstoned++
+			}
+			p.Tombstone()
+		}
+	}
+	return tombstoned
+}
+
+// remove every producer from a registration but keep the registration,
+// returning how many were removed
+func (r *RegistrationDB) RemoveAllProducersFromRegistration(k Registration) int {
+	r.Lock()
+	defer r.Unlock()
+	producers, ok := r.registrationMap[k]
+	if !ok {
+		return 0
+	}
+	r.registrationMap[k] = Producers{}
+	for _, p := range producers {
+		r.release(p.peerInfo.id)
+		r.subscribers.publish(EventRemove, k, p.peerInfo.id)
+	}
+	return len(producers)
+}
+
 // remove a Registration and all it's producers
 func (r *RegistrationDB) RemoveRegistration(k Registration) {
 	r.Lock()
 	defer r.Unlock()
 	// delete map 中的一个key,就会把key中的指针数组删除没毛病，但是指针指向的对象呢？
 	// 如何做到也一起删除呢？ 看来golang的基础没学好
-	delete(r.registrationMap, k)
+	if producers, ok := r.registrationMap[k]; ok {
+		for _, p := range producers {
+			r.release(p.peerInfo.id)
+		}
+		delete(r.registrationMap, k)
+		r.subscribers.publish(EventRemove, k, "")
+	}
+}
+
+// remove the topic and channel registrations that have no producers,
+// including ones created with /topic/create or /channel/create that were
+// never registered by a producer, returning how many were removed
+func (r *RegistrationDB) RemoveEmptyRegistrations() int {
+	r.Lock()
+	defer r.Unlock()
+	removed := 0
+	for k, producers := range r.registrationMap {
+		if len(producers) > 0 || (k.Category != "topic" && k.Category != "channel") {
+			continue
+		}
+		delete(r.registrationMap, k)
+		r.subscribers.publish(EventRemove, k, "")
+		removed++
+	}
+	return removed
+}
+
+// epochNode is the node that peerInfo's epoch is fenced per
+func epochNode(peerInfo *PeerInfo) string {
+	return net.JoinHostPort(peerInfo.BroadcastAddress, strconv.Itoa(peerInfo.TCPPort))
+}
+
+// FenceEpoch records epoch as the latest for node, returning false (and
+// leaving it unchanged) if a higher epoch was already seen
+func (r *RegistrationDB) FenceEpoch(node string, epoch int64) bool {
+	r.Lock()
+	defer r.Unlock()
+	e, ok := r.epochs[node]
+	if !ok {
+		e = &nodeEpoch{}
+		r.epochs[node] = e
+	} else if epoch < e.epoch {
+		return false
+	}
+	e.epoch = epoch
+	e.lastSeen = time.Now()
+	return true
+}
+
+// ClearExpiredEpochs forgets the epochs of the nodes that have no producers
+// and haven't been seen since before, returning how many were forgotten
+func (r *RegistrationDB) ClearExpiredEpochs(before time.Time) int {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.epochs) == 0 {
+		return 0
+	}
+	registered := make(map[string]bool, len(r.peers))
+	for _, ip := range r.peers {
+		registered[epochNode(ip.peerInfo)] = true
+	}
+	cleared := 0
+	for node, e := range r.epochs {
+		if !registered[node] && e.lastSeen.Before(before) {
+			delete(r.epochs, node)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// Subscribe returns a channel of changes made to the DB from now on and
+// a function that must be called to stop receiving them
+func (r *RegistrationDB) Subscribe() (<-chan RegistrationEvent, func()) {
+	return r.subscribers.subscribe()
+}
+
+// OnChange registers f to be called for every change made to the DB from
+// now on. Unlike Subscribe no events are dropped, f is called with the DB
+// locked so it must be quick and must not call back into the DB.
+func (r *RegistrationDB) OnChange(f func(RegistrationEvent)) {
+	r.subscribers.hook(f)
+}
+
+// rename a topic, re-keying the topic registration and all of its channel
+// registrations under a single write lock so that lookups never observe a gap
+func (r *RegistrationDB) RenameTopic(oldName string, newName string) error {
+	r.Lock()
+	defer r.Unlock()
+	oldKey := Registration{"topic", oldName, ""}
+	newKey := Registration{"topic", newName, ""}
+	producers, ok := r.registrationMap[oldKey]
+	if !ok {
+		return errRegistrationNotFound
+	}
+	if _, ok := r.registrationMap[newKey]; ok {
+		return errRegistrationExists
+	}
+	// check every channel first, an existing one under the new name would
+	// otherwise be overwritten along with its producers
+	var channelKeys []Registration
+	for k := range r.registrationMap {
+		if k.IsMatch("channel", oldName, "*") {
+			if _, ok := r.registrationMap[Registration{"channel", newName, k.SubKey}]; ok {
+				return errRegistrationExists
+			}
+			channelKeys = append(channelKeys, k)
+		}
+	}
+	for _, k := range channelKeys {
+		newChannelKey := Registration{"channel", newName, k.SubKey}
+		r.registrationMap[newChannelKey] = r.registrationMap[k]
+		delete(r.registrationMap, k)
+		r.subscribers.publish(EventRemove, k, "")
+		r.subscribers.publish(EventAdd, newChannelKey, "")
+	}
+	delete(r.registrationMap, oldKey)
+	r.registrationMap[newKey] = producers
+	r.subscribers.publish(EventRemove, oldKey, "")
+	r.subscribers.publish(EventAdd, newKey, "")
+	return nil
+}
+
+// rename a channel of a topic, keeping its producers
+func (r *RegistrationDB) RenameChannel(topicName string, oldName string, newName string) error {
+	r.Lock()
+	defer r.Unlock()
+	oldKey := Registration{"channel", topicName, oldName}
+	newKey := Registration{"channel", topicName, newName}
+	producers, ok := r.registrationMap[oldKey]
+	if !ok {
+		return errRegistrationNotFound
+	}
+	if _, ok := r.registrationMap[newKey]; ok {
+		return errRegistrationExists
+	}
+	delete(r.registrationMap, oldKey)
+	r.registrationMap[newKey] = producers
+	r.subscribers.publish(EventRemove, oldKey, "")
+	r.subscribers.publish(EventAdd, newKey, "")
+	return nil
 }
 
 func (r *RegistrationDB) needFilter(key string, subkey string) bool {
@@ -167,6 +724,59 @@ func (r *RegistrationDB) FindRegistrations(category string, key string, subkey s
 	return results
 }
 
+// TopicStaleness returns how long ago the most recently updated producer of
+// topic was last heard from, false if the topic has no producers
+func (r *RegistrationDB) TopicStaleness(topic string) (time.Duration, bool) {
+	producers := r.FindProducers("topic", topic, "")
+	if len(producers) == 0 {
+		return 0, false
+	}
+	now := time.Now()
+	var staleness time.Duration
+	for i, p := range producers {
+		lag := now.Sub(time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate)))
+		if i == 0 || lag < staleness {
+			staleness = lag
+		}
+	}
+	return staleness, true
+}
+
+// TopicChannels returns the (sorted) channels of each topic, in one pass
+// under the read lock. Only the first limit topics, in name order, are
+// returned, the bool reports whether there were more.
+func (r *RegistrationDB) TopicChannels(limit int) (map[string][]string, bool) {
+	r.RLock()
+	var topics []string
+	channels := make(map[string][]string)
+	for k := range r.registrationMap {
+		switch k.Category {
+		case "topic":
+			topics = append(topics, k.Key)
+		case "channel":
+			channels[k.Key] = append(channels[k.Key], k.SubKey)
+		}
+	}
+	r.RUnlock()
+
+	sort.Strings(topics)
+	truncated := false
+	if len(topics) > limit {
+		topics = topics[:limit]
+		truncated = true
+	}
+	results := make(map[string][]string, len(topics))
+	for _, topic := range topics {
+		c := channels[topic]
+		if c == nil {
+			c = []string{}
+		}
+		sort.Strings(c)
+		results[topic] = c
+	}
+	return results, truncated
+}
+
 // 和上面的是同样的套路，如果没有通配符，就直接返回对应的Producers([]*Producer)
 // 如果有通配符，就返回所有匹配的
 func (r *RegistrationDB) FindProducers(category string, key string, subkey string) Producers {
@@ -199,6 +809,78 @@ func (r *RegistrationDB) FindProducers(category string, key string, subkey strin
 	return results
 }
 
+// return a copy of every registration and its producers, the producers are
+// shallow copies (sharing PeerInfo) so that callers can work on the result
+// without holding the lock, only the copying itself is done under it
+func (r *RegistrationDB) Snapshot() map[Registration]Producers {
+	r.RLock()
+	defer r.RUnlock()
+	results := make(map[Registration]Producers, len(r.registrationMap))
+	for k, producers := range r.registrationMap {
+		snapshot := make(Producers, len(producers))
+		for i, p := range producers {
+			cp := &Producer{peerInfo: p.peerInfo, owner: p.owner}
+			cp.tombstoned, cp.tombstonedAt = p.tombstoneState()
+			snapshot[i] = cp
+		}
+		results[k] = snapshot
+	}
+	return results
+}
+
+// Ping returns an error if the read lock can't be acquired within timeout,
+// the attempt is left running (and releases the lock once it gets it). Only
+// one attempt is made at a time, concurrent and later calls wait on the one
+// in flight rather than each queueing for the lock.
+func (r *RegistrationDB) Ping(timeout time.Duration) error {
+	r.ping.Lock()
+	done := r.ping.done
+	if done == nil {
+		done = make(chan struct{})
+		r.ping.done = done
+		go func() {
+			r.RLock()
+			r.RUnlock()
+			r.ping.Lock()
+			r.ping.done = nil
+			r.ping.Unlock()
+			close(done)
+		}()
+	}
+	r.ping.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("lock not acquired within %s", timeout)
+	}
+}
+
+// FindProducersByBroadcastAddress returns the producers of the node at
+// addr, once per id (a node that reconnected from another port has a new
+// id), the producer of an id's "client" registration is returned when it
+// has one as it isn't tombstoned with a topic
+func (r *RegistrationDB) FindProducersByBroadcastAddress(addr string) Producers {
+	r.RLock()
+	defer r.RUnlock()
+	byID := make(map[string]*Producer)
+	for k, producers := range r.registrationMap {
+		for _, p := range producers {
+			if p.peerInfo.BroadcastAddress != addr {
+				continue
+			}
+			if _, ok := byID[p.peerInfo.id]; !ok || k.Category == "client" {
+				byID[p.peerInfo.id] = p
+			}
+		}
+	}
+	results := make(Producers, 0, len(byID))
+	for _, p := range byID {
+		results = append(results, p)
+	}
+	return results
+}
+
 func (r *RegistrationDB) LookupRegistrations(id string) Registrations {
 	r.RLock()
 	defer r.RUnlock()
@@ -237,11 +919,14 @@ func (rr Registrations) Filter(category string, key string, subkey string) Regis
 	return output
 }
 
+// Keys and SubKeys are sorted so that responses built from them are
+// stable (and so are their ETags) regardless of map iteration order
 func (rr Registrations) Keys() []string {
 	keys := make([]string, len(rr))
 	for i, k := range rr {
 		keys[i] = k.Key
 	}
+	sort.Strings(keys)
 	return keys
 }
 
@@ -250,15 +935,14 @@ func (rr Registrations) SubKeys() []string {
 	for i, k := range rr {
 		subkeys[i] = k.SubKey
 	}
+	sort.Strings(subkeys)
 	return subkeys
 }
 
 func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLifetime time.Duration) Producers {
-	now := time.Now()
 	results := Producers{}
 	for _, p := range pp {
-		cur := time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate))
-		if now.Sub(cur) > inactivityTimeout || p.IsTombstoned(tombstoneLifetime) {
+		if p.Status(inactivityTimeout, tombstoneLifetime) != ProducerActive {
 			continue
 		}
 		results = append(results, p)
@@ -266,6 +950,19 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	return results
 }
 
+// SortByFreshness orders producers by most recent lastUpdate first
+func (pp Producers) SortByFreshness() {
+	sort.Sort(producersByFreshness(pp))
+}
+
+type producersByFreshness Producers
+
+func (pp producersByFreshness) Len() int      { return len(pp) }
+func (pp producersByFreshness) Swap(i, j int) { pp[i], pp[j] = pp[j], pp[i] }
+func (pp producersByFreshness) Less(i, j int) bool {
+	return atomic.LoadInt64(&pp[i].peerInfo.lastUpdate) > atomic.LoadInt64(&pp[j].peerInfo.lastUpdate)
+}
+
 func (pp Producers) PeerInfo() []*PeerInfo {
 	results := []*PeerInfo{}
 	for _, p := range pp {
@@ -273,3 +970,20 @@ func (pp Producers) PeerInfo() []*PeerInfo {
 	}
 	return results
 }
+
+// the group of producers without the metadata key GroupByMetadata groups by
+const unknownMetadataGroup = "unknown"
+
+// GroupByMetadata returns the PeerInfo of the producers keyed by their value
+// for the metadata key, in the order of pp
+func (pp Producers) GroupByMetadata(key string) map[string][]*PeerInfo {
+	groups := make(map[string][]*PeerInfo)
+	for _, p := range pp {
+		group, ok := p.peerInfo.Metadata[key]
+		if !ok {
+			group = unknownMetadataGroup
+		}
+		groups[group] = append(groups[group], p.peerInfo)
+	}
+	return groups
+}
@@ -1,6 +1,8 @@
 package nsqlookupd
 
 import (
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,13 +12,13 @@ import (
 func TestRegistrationDB(t *testing.T) {
 	sec30 := 30 * time.Second
 	beginningOfTime := time.Unix(1348797047, 0)
-	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1"}
-	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1"}
-	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1"}
-	p1 := &Producer{pi1, false, beginningOfTime}
-	p2 := &Producer{pi2, false, beginningOfTime}
-	p3 := &Producer{pi3, false, beginningOfTime}
-	p4 := &Producer{pi1, false, beginningOfTime}
+	pi1 := &PeerInfo{beginningOfTime.UnixNano(), 0, false, "", 0, "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1", 1, nil}
+	pi2 := &PeerInfo{beginningOfTime.UnixNano(), 0, false, "", 0, "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1", 1, nil}
+	pi3 := &PeerInfo{beginningOfTime.UnixNano(), 0, false, "", 0, "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1", 1, nil}
+	p1 := &Producer{peerInfo: pi1, tombstonedAt: beginningOfTime}
+	p2 := &Producer{peerInfo: pi2, tombstonedAt: beginningOfTime}
+	p3 := &Producer{peerInfo: pi3, tombstonedAt: beginningOfTime}
+	p4 := &Producer{peerInfo: pi1, tombstonedAt: beginningOfTime}
 
 	db := NewRegistrationDB()
 
@@ -96,3 +98,487 @@ func TestRegistrationDB(t *testing.T) {
 	k = db.FindRegistrations("c", "*", "*").Keys()
 	test.Equal(t, 0, len(k))
 }
+
+func TestRemoveAllProducersByID(t *testing.T) {
+	db := NewRegistrationDB()
+	p1 := &Producer{peerInfo: &PeerInfo{id: "1"}}
+	p2 := &Producer{peerInfo: &PeerInfo{id: "2"}}
+
+	db.AddProducer(Registration{"client", "", ""}, p1)
+	db.AddProducer(Registration{"client", "", ""}, p2)
+	db.AddProducer(Registration{"topic", "a", ""}, p1)
+	db.AddProducer(Registration{"channel", "a", "b"}, p1)
+
+	removed := db.RemoveAllProducersByID(p1.peerInfo.id)
+	test.Equal(t, 3, len(removed))
+	test.Equal(t, 0, len(db.LookupRegistrations(p1.peerInfo.id)))
+	test.Equal(t, 1, len(db.FindProducers("client", "", "")))
+
+	removed = db.RemoveAllProducersByID(p1.peerInfo.id)
+	test.Equal(t, 0, len(removed))
+}
+
+func TestRegistrationDBRename(t *testing.T) {
+	pi1 := &PeerInfo{time.Now().UnixNano(), 0, false, "", 0, "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1", 1, nil}
+	p1 := &Producer{peerInfo: pi1}
+	p2 := &Producer{peerInfo: pi1}
+
+	db := NewRegistrationDB()
+	db.AddProducer(Registration{"topic", "a", ""}, p1)
+	db.AddProducer(Registration{"channel", "a", "ch"}, p2)
+	test.Equal(t, true, db.AddRegistration(Registration{"topic", "b", ""}))
+	test.Equal(t, false, db.AddRegistration(Registration{"topic", "b", ""}))
+	p1.Tombstone()
+
+	test.Equal(t, errRegistrationNotFound, db.RenameTopic("c", "d"))
+	test.Equal(t, errRegistrationExists, db.RenameTopic("a", "b"))
+
+	test.Nil(t, db.RenameTopic("a", "d"))
+	test.Equal(t, 0, len(db.FindRegistrations("topic", "a", "")))
+	test.Equal(t, 0, len(db.FindRegistrations("channel", "a", "*")))
+	p := db.FindProducers("topic", "d", "")
+	test.Equal(t, 1, len(p))
+	test.Equal(t, true, p[0].IsTombstoned(time.Minute))
+	test.Equal(t, 1, len(db.FindProducers("channel", "d", "ch")))
+
+	// a channel that already exists under the new name isn't overwritten
+	db.AddRegistration(Registration{"channel", "e", "ch"})
+	test.Equal(t, errRegistrationExists, db.RenameTopic("d", "e"))
+	test.Equal(t, 1, len(db.FindProducers("topic", "d", "")))
+	test.Equal(t, 1, len(db.FindProducers("channel", "d", "ch")))
+	test.Equal(t, 0, len(db.FindProducers("channel", "e", "ch")))
+	test.Equal(t, 0, len(db.FindRegistrations("topic", "e", "")))
+
+	db.AddRegistration(Registration{"channel", "d", "other"})
+	test.Equal(t, errRegistrationNotFound, db.RenameChannel("d", "missing", "x"))
+	test.Equal(t, errRegistrationExists, db.RenameChannel("d", "ch", "other"))
+	test.Nil(t, db.RenameChannel("d", "ch", "x"))
+	test.Equal(t, 1, len(db.FindProducers("channel", "d", "x")))
+	test.Equal(t, 0, len(db.FindRegistrations("channel", "d", "ch")))
+}
+
+func TestRegistrationDBSubscribe(t *testing.T) {
+	db := NewRegistrationDB()
+	p1 := &Producer{peerInfo: &PeerInfo{id: "1"}}
+
+	events, cancel := db.Subscribe()
+
+	db.AddProducer(Registration{"topic", "a", ""}, p1)
+	db.AddProducer(Registration{"topic", "a", ""}, p1)
+	db.RemoveProducer(Registration{"topic", "a", ""}, p1.peerInfo.id)
+	db.RemoveRegistration(Registration{"topic", "a", ""})
+
+	test.Equal(t, RegistrationEvent{EventAdd, "topic", "a", "", "1"}, <-events)
+	test.Equal(t, RegistrationEvent{EventRemove, "topic", "a", "", "1"}, <-events)
+	test.Equal(t, RegistrationEvent{EventRemove, "topic", "a", "", ""}, <-events)
+	test.Equal(t, 0, len(events))
+
+	cancel()
+	db.AddRegistration(Registration{"topic", "b", ""})
+	test.Equal(t, 0, len(events))
+}
+
+func TestRegistrationDBInternsPeerInfo(t *testing.T) {
+	db := NewRegistrationDB()
+
+	// distinct PeerInfo values for the same producer id
+	db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: &PeerInfo{id: "1"}})
+	db.AddProducer(Registration{"topic", "b", ""}, &Producer{peerInfo: &PeerInfo{id: "1"}})
+	db.AddProducer(Registration{"channel", "b", "c"}, &Producer{peerInfo: &PeerInfo{id: "1"}})
+
+	pa := db.FindProducers("topic", "a", "")
+	pb := db.FindProducers("topic", "b", "")
+	test.Equal(t, true, pa[0].peerInfo == pb[0].peerInfo)
+	test.Equal(t, 1, len(db.peers))
+	test.Equal(t, 3, db.peers["1"].refs)
+
+	db.RemoveProducer(Registration{"topic", "a", ""}, "1")
+	test.Equal(t, 2, db.peers["1"].refs)
+	db.RemoveRegistration(Registration{"topic", "b", ""})
+	test.Equal(t, 1, db.peers["1"].refs)
+	db.RemoveAllProducersByID("1")
+	test.Equal(t, 0, len(db.peers))
+}
+
+func TestRegistrationDBTakeOver(t *testing.T) {
+	db := NewRegistrationDB()
+
+	// two connections sharing the id 1
+	connA := &PeerInfo{id: "1"}
+	connB := &PeerInfo{id: "1"}
+	keys := []Registration{{"client", "", ""}, {"topic", "a", ""}, {"topic", "b", ""}}
+	for _, k := range keys {
+		test.Equal(t, true, db.AddProducer(k, &Producer{peerInfo: connA}))
+	}
+	db.FindProducers("topic", "a", "")[0].Tombstone()
+
+	test.Equal(t, true, db.AddProducer(Registration{"topic", "b", ""}, &Producer{peerInfo: connB}))
+	test.Equal(t, false, db.AddProducer(Registration{"topic", "b", ""}, &Producer{peerInfo: connB}))
+
+	for _, k := range keys {
+		producers := db.FindProducers(k.Category, k.Key, k.SubKey)
+		test.Equal(t, 1, len(producers))
+		test.Equal(t, true, producers[0].peerInfo == connB)
+		test.Equal(t, true, producers[0].owner == connB)
+	}
+	test.Equal(t, true, db.FindProducers("topic", "a", "")[0].IsTombstoned(time.Minute))
+	test.Equal(t, false, db.FindProducers("topic", "b", "")[0].IsTombstoned(time.Minute))
+	test.Equal(t, true, db.peers["1"].peerInfo == connB)
+	test.Equal(t, 3, db.peers["1"].refs)
+
+	// the first connection disconnecting doesn't remove them
+	test.Equal(t, 0, len(db.RemoveAllProducersOwnedBy(connA)))
+	test.Equal(t, 3, db.peers["1"].refs)
+	test.Equal(t, 3, len(db.RemoveAllProducersOwnedBy(connB)))
+	test.Equal(t, 0, len(db.peers))
+}
+
+func TestRegistrationDBSnapshot(t *testing.T) {
+	db := NewRegistrationDB()
+	k := Registration{"topic", "a", ""}
+	p := &Producer{peerInfo: &PeerInfo{id: "1"}}
+	db.AddProducer(k, p)
+
+	snapshot := db.Snapshot()
+	test.Equal(t, 1, len(snapshot[k]))
+	test.Equal(t, p.peerInfo, snapshot[k][0].peerInfo)
+
+	// producers are copies, changes to either side aren't shared
+	test.Equal(t, false, p == snapshot[k][0])
+	p.Tombstone()
+	test.Equal(t, false, snapshot[k][0].tombstoned)
+}
+
+func TestRegistrationDBRemoveExpiredProducers(t *testing.T) {
+	db := NewRegistrationDB()
+	now := time.Now()
+	fresh := &PeerInfo{id: "1", lastUpdate: now.UnixNano()}
+	stale := &PeerInfo{id: "2", lastUpdate: now.Add(-time.Hour).UnixNano()}
+
+	db.AddRegistration(Registration{"topic", "empty", ""})
+	db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: fresh})
+	db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: stale})
+	db.AddProducer(Registration{"topic", "b", ""}, &Producer{peerInfo: stale})
+
+	// nothing is older than 2 hours
+	test.Equal(t, 0, db.RemoveExpiredProducers(now.Add(-2*time.Hour)))
+	test.Equal(t, 3, len(db.FindRegistrations("topic", "*", "")))
+
+	test.Equal(t, 2, db.RemoveExpiredProducers(now.Add(-time.Minute)))
+	test.Equal(t, 1, len(db.FindProducers("topic", "a", "")))
+	test.Equal(t, "1", db.FindProducers("topic", "a", "")[0].peerInfo.id)
+	// "b" was emptied and is removed, "empty" never had producers and is kept
+	test.Equal(t, []string{"a", "empty"}, db.FindRegistrations("topic", "*", "").Keys())
+	test.Equal(t, 0, len(db.LookupRegistrations("2")))
+	_, ok := db.peers["2"]
+	test.Equal(t, false, ok)
+
+	// advancing time expires the remaining producer
+	test.Equal(t, 1, db.RemoveExpiredProducers(now.Add(time.Minute)))
+	test.Equal(t, 0, len(db.FindProducers("topic", "*", "")))
+}
+
+func TestRegistrationDBClearExpiredTombstones(t *testing.T) {
+	db := NewRegistrationDB()
+	k := Registration{"topic", "a", ""}
+	db.AddProducer(k, &Producer{peerInfo: &PeerInfo{id: "1"}})
+	db.AddProducer(k, &Producer{peerInfo: &PeerInfo{id: "2"}})
+	producers := db.FindProducers("topic", "a", "")
+	producers[0].Tombstone()
+	producers[1].Tombstone()
+
+	lifetime := 45 * time.Second
+	test.Equal(t, 0, db.ClearExpiredTombstones(lifetime))
+	test.Equal(t, true, producers[0].IsTombstoned(lifetime))
+
+	// advance past the lifetime of the first one
+	producers[0].tombstonedAt = producers[0].tombstonedAt.Add(-lifetime)
+	test.Equal(t, true, producers[0].TombstoneExpired(lifetime))
+	test.Equal(t, false, producers[1].TombstoneExpired(lifetime))
+	test.Equal(t, 1, db.ClearExpiredTombstones(lifetime))
+	test.Equal(t, false, producers[0].tombstoned)
+	test.Equal(t, false, producers[0].TombstoneExpired(lifetime))
+	test.Equal(t, true, producers[1].tombstoned)
+	// the producer itself is kept
+	test.Equal(t, 2, len(db.FindProducers("topic", "a", "")))
+}
+
+func TestRegistrationDBTombstoneStaleProducers(t *testing.T) {
+	db := NewRegistrationDB()
+	now := time.Now()
+	stale := &PeerInfo{id: "1", lastUpdate: now.UnixNano()}
+	fresh := &PeerInfo{id: "2", lastUpdate: now.UnixNano()}
+	for _, pi := range []*PeerInfo{stale, fresh} {
+		db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: pi})
+		db.AddProducer(Registration{"channel", "a", "ch"}, &Producer{peerInfo: pi})
+	}
+
+	test.Equal(t, 0, db.TombstoneStaleProducers(now.Add(-time.Minute)))
+
+	// advance past the threshold for the first one
+	atomic.StoreInt64(&stale.lastUpdate, now.Add(-2*time.Minute).UnixNano())
+	test.Equal(t, 1, db.TombstoneStaleProducers(now.Add(-time.Minute)))
+	lifetime := 45 * time.Second
+	producers := db.FindProducers("topic", "a", "")
+	test.Equal(t, 2, len(producers))
+	for _, p := range producers {
+		test.Equal(t, p.peerInfo == stale, p.IsTombstoned(lifetime))
+	}
+	test.Equal(t, 1, len(producers.FilterByActive(time.Hour, lifetime)))
+	// only topic producers
+	for _, p := range db.FindProducers("channel", "a", "ch") {
+		test.Equal(t, false, p.tombstoned)
+	}
+
+	// still stale, the tombstone is refreshed but not counted again
+	tombstonedAt := producers[0].tombstonedAt
+	if producers[1].peerInfo == stale {
+		tombstonedAt = producers[1].tombstonedAt
+	}
+	time.Sleep(time.Millisecond)
+	test.Equal(t, 0, db.TombstoneStaleProducers(now.Add(-time.Minute)))
+	for _, p := range producers {
+		if p.peerInfo == stale {
+			test.Equal(t, true, p.tombstonedAt.After(tombstonedAt))
+		}
+	}
+}
+
+func TestFindProducersByBroadcastAddress(t *testing.T) {
+	db := NewRegistrationDB()
+	// a node that reconnected from another port, and another node
+	pi1 := &PeerInfo{id: "a:1", BroadcastAddress: "a"}
+	pi2 := &PeerInfo{id: "a:2", BroadcastAddress: "a"}
+	pi3 := &PeerInfo{id: "b:1", BroadcastAddress: "b"}
+	for _, pi := range []*PeerInfo{pi1, pi2, pi3} {
+		db.AddProducer(Registration{"topic", "t", ""}, &Producer{peerInfo: pi})
+		db.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: pi})
+	}
+	db.AddProducer(Registration{"channel", "t", "c"}, &Producer{peerInfo: pi1})
+	db.FindProducers("topic", "t", "")[0].Tombstone()
+
+	producers := db.FindProducersByBroadcastAddress("a")
+	test.Equal(t, 2, len(producers))
+	ids := map[string]bool{}
+	for _, p := range producers {
+		ids[p.peerInfo.id] = true
+		// the "client" producer, not the tombstoned topic one
+		test.Equal(t, false, p.tombstoned)
+	}
+	test.Equal(t, map[string]bool{"a:1": true, "a:2": true}, ids)
+
+	test.Equal(t, 1, len(db.FindProducersByBroadcastAddress("b")))
+	test.Equal(t, 0, len(db.FindProducersByBroadcastAddress("c")))
+}
+
+func TestRegistrationDBFenceEpoch(t *testing.T) {
+	db := NewRegistrationDB()
+	test.Equal(t, true, db.FenceEpoch("a:4150", 2))
+	test.Equal(t, false, db.FenceEpoch("a:4150", 1))
+	test.Equal(t, true, db.FenceEpoch("a:4150", 2))
+	test.Equal(t, true, db.FenceEpoch("a:4150", 5))
+	test.Equal(t, false, db.FenceEpoch("a:4150", 4))
+	// epochs are per node
+	test.Equal(t, true, db.FenceEpoch("b:4150", 1))
+
+	// and are kept across disconnects
+	pi1 := &PeerInfo{id: "1", BroadcastAddress: "c", TCPPort: 4150}
+	pi2 := &PeerInfo{id: "2", BroadcastAddress: "c", TCPPort: 4150}
+	db.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: pi1})
+	db.AddProducer(Registration{"topic", "a", ""}, &Producer{peerInfo: pi1})
+	db.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: pi2})
+	test.Equal(t, true, db.FenceEpoch("c:4150", 3))
+	db.RemoveAllProducersByID("1")
+	test.Equal(t, false, db.FenceEpoch("c:4150", 2))
+	db.RemoveProducer(Registration{"client", "", ""}, "2")
+	test.Equal(t, false, db.FenceEpoch("c:4150", 2))
+
+	// until the node has been gone for long enough
+	test.Equal(t, 0, db.ClearExpiredEpochs(time.Now().Add(-time.Hour)))
+	db.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: pi2})
+	test.Equal(t, 2, db.ClearExpiredEpochs(time.Now().Add(time.Minute)))
+	test.Equal(t, false, db.FenceEpoch("c:4150", 2))
+	db.RemoveProducer(Registration{"client", "", ""}, "2")
+	test.Equal(t, 1, db.ClearExpiredEpochs(time.Now().Add(time.Minute)))
+	test.Equal(t, true, db.FenceEpoch("c:4150", 1))
+}
+
+func TestRegistrationDBPing(t *testing.T) {
+	db := NewRegistrationDB()
+	test.Nil(t, db.Ping(time.Second))
+
+	// while the lock is held every Ping shares the one probe
+	db.Lock()
+	test.NotNil(t, db.Ping(10*time.Millisecond))
+	db.ping.Lock()
+	done := db.ping.done
+	db.ping.Unlock()
+	test.NotNil(t, done)
+	for i := 0; i < 10; i++ {
+		test.NotNil(t, db.Ping(time.Millisecond))
+	}
+	db.ping.Lock()
+	test.Equal(t, done, db.ping.done)
+	db.ping.Unlock()
+	db.Unlock()
+
+	<-done
+	test.Nil(t, db.Ping(time.Second))
+}
+
+func TestRegistrationDBLockWaitMetrics(t *testing.T) {
+	db := NewRegistrationDB()
+	_, ok := db.LockWaitStats()
+	test.Equal(t, false, ok)
+
+	db.EnableLockWaitMetrics()
+	k := Registration{"topic", "a", ""}
+	db.AddProducer(k, &Producer{peerInfo: &PeerInfo{id: "1"}})
+	db.AddProducer(k, &Producer{peerInfo: &PeerInfo{id: "2"}})
+	db.RemoveProducer(k, "1")
+	// other changes aren't recorded
+	db.AddRegistration(Registration{"topic", "b", ""})
+
+	stats, ok := db.LockWaitStats()
+	test.Equal(t, true, ok)
+	test.Equal(t, int64(3), stats.Count)
+	test.Equal(t, len(lockWaitBuckets)+1, len(stats.Buckets))
+	test.Equal(t, "+Inf", stats.Buckets[len(stats.Buckets)-1].LE)
+	var n int64
+	for _, b := range stats.Buckets {
+		n += b.Count
+	}
+	test.Equal(t, int64(3), n)
+
+	// a wait behind a held lock lands in a later bucket
+	db.Lock()
+	done := make(chan struct{})
+	go func() {
+		db.AddProducer(k, &Producer{peerInfo: &PeerInfo{id: "3"}})
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	db.Unlock()
+	<-done
+
+	stats, _ = db.LockWaitStats()
+	test.Equal(t, int64(4), stats.Count)
+	test.Equal(t, true, stats.TotalMs >= 20)
+	test.Equal(t, int64(1), stats.Buckets[5].Count+stats.Buckets[6].Count+stats.Buckets[7].Count)
+}
+
+func BenchmarkRegistrationDBManyTopics(b *testing.B) {
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("topic%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db := NewRegistrationDB()
+		for _, topic := range topics {
+			// a copy of the node's PeerInfo per registration, as when
+			// producers are rebuilt from a snapshot, interning keeps one
+			peerInfo := &PeerInfo{id: "ip.address:4150", BroadcastAddress: "ip.address"}
+			db.AddProducer(Registration{"topic", topic, ""}, &Producer{peerInfo: peerInfo})
+		}
+	}
+}
+
+func TestProducerStatus(t *testing.T) {
+	inactivityTimeout := 30 * time.Second
+	tombstoneLifetime := 45 * time.Second
+
+	p := &Producer{peerInfo: &PeerInfo{id: "1", lastUpdate: time.Now().UnixNano()}}
+	test.Equal(t, ProducerActive, p.Status(inactivityTimeout, tombstoneLifetime))
+
+	p.peerInfo.lastUpdate = time.Now().Add(-time.Minute).UnixNano()
+	test.Equal(t, ProducerInactive, p.Status(inactivityTimeout, tombstoneLifetime))
+
+	p.peerInfo.lastUpdate = time.Now().UnixNano()
+	p.Tombstone()
+	test.Equal(t, ProducerTombstoned, p.Status(inactivityTimeout, tombstoneLifetime))
+
+	// tombstones take precedence over inactivity
+	p.peerInfo.lastUpdate = time.Now().Add(-time.Minute).UnixNano()
+	test.Equal(t, ProducerTombstoned, p.Status(inactivityTimeout, tombstoneLifetime))
+
+	// once the tombstone expires the producer is active again
+	p.peerInfo.lastUpdate = time.Now().UnixNano()
+	p.tombstonedAt = time.Now().Add(-time.Minute)
+	test.Equal(t, ProducerActive, p.Status(inactivityTimeout, tombstoneLifetime))
+
+	test.Equal(t, 1, len(Producers{p}.FilterByActive(inactivityTimeout, tombstoneLifetime)))
+	p.Tombstone()
+	test.Equal(t, 0, len(Producers{p}.FilterByActive(inactivityTimeout, tombstoneLifetime)))
+}
+
+func TestTopicStaleness(t *testing.T) {
+	db := NewRegistrationDB()
+	now := time.Now()
+	db.AddProducer(Registration{"topic", "fresh", ""},
+		&Producer{peerInfo: &PeerInfo{id: "1", lastUpdate: now.Add(-5 * time.Minute).UnixNano()}})
+	db.AddProducer(Registration{"topic", "fresh", ""},
+		&Producer{peerInfo: &PeerInfo{id: "2", lastUpdate: now.Add(-time.Second).UnixNano()}})
+	db.AddProducer(Registration{"topic", "stale", ""},
+		&Producer{peerInfo: &PeerInfo{id: "3", lastUpdate: now.Add(-10 * time.Minute).UnixNano()}})
+	db.AddProducer(Registration{"topic", "stale", ""},
+		&Producer{peerInfo: &PeerInfo{id: "4", lastUpdate: now.Add(-5 * time.Minute).UnixNano()}})
+	db.AddRegistration(Registration{"topic", "empty", ""})
+
+	staleness, ok := db.TopicStaleness("fresh")
+	test.Equal(t, true, ok)
+	test.Equal(t, true, staleness >= time.Second && staleness < time.Minute)
+
+	staleness, ok = db.TopicStaleness("stale")
+	test.Equal(t, true, ok)
+	test.Equal(t, true, staleness >= 5*time.Minute && staleness < 10*time.Minute)
+
+	_, ok = db.TopicStaleness("empty")
+	test.Equal(t, false, ok)
+	_, ok = db.TopicStaleness("missing")
+	test.Equal(t, false, ok)
+}
+
+func TestRemoveAllProducersFromRegistration(t *testing.T) {
+	p1 := &Producer{peerInfo: &PeerInfo{id: "1"}}
+	p2 := &Producer{peerInfo: &PeerInfo{id: "2"}}
+
+	db := NewRegistrationDB()
+	k := Registration{"channel", "a", "ch"}
+	db.AddProducer(k, p1)
+	db.AddProducer(k, p2)
+	db.AddProducer(Registration{"topic", "a", ""}, p1)
+
+	test.Equal(t, 2, db.RemoveAllProducersFromRegistration(k))
+	test.Equal(t, 1, len(db.FindRegistrations("channel", "a", "ch")))
+	test.Equal(t, 0, len(db.FindProducers("channel", "a", "ch")))
+	test.Equal(t, 1, len(db.FindProducers("topic", "a", "")))
+	test.Equal(t, 1, len(db.peers))
+
+	test.Equal(t, 0, db.RemoveAllProducersFromRegistration(k))
+	test.Equal(t, 0, db.RemoveAllProducersFromRegistration(Registration{"channel", "a", "missing"}))
+}
+
+func benchmarkRegistrationDBAddRemove(b *testing.B, lockWait bool) {
+	db := NewRegistrationDB()
+	if lockWait {
+		db.EnableLockWaitMetrics()
+	}
+	k := Registration{"topic", "a", ""}
+	p := &Producer{peerInfo: &PeerInfo{id: "1"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.AddProducer(k, p)
+		db.RemoveProducer(k, "1")
+	}
+}
+
+func BenchmarkRegistrationDBAddRemove(b *testing.B) {
+	benchmarkRegistrationDBAddRemove(b, false)
+}
+
+func BenchmarkRegistrationDBAddRemoveLockWait(b *testing.B) {
+	benchmarkRegistrationDBAddRemove(b, true)
+}
@@ -0,0 +1,82 @@
+package nsqlookupd
+
+import (
+	"sync"
+)
+
+const (
+	EventAdd    = "add"
+	EventRemove = "remove"
+)
+
+// RegistrationEvent describes a change to the registration DB. PeerID is
+// empty when a registration itself (rather than one of its producers) was
+// added or removed.
+type RegistrationEvent struct {
+	Action   string `json:"action"`
+	Category string `json:"category"`
+	Key      string `json:"key"`
+	SubKey   string `json:"subkey"`
+	PeerID   string `json:"peer_id"`
+}
+
+// the number of events buffered per subscriber, events for subscribers
+// that fall further behind are dropped rather than blocking the DB
+const subscriberBufferSize = 128
+
+type subscribers struct {
+	sync.Mutex
+	chans map[chan RegistrationEvent]struct{}
+
+	// called synchronously for every event, they can't fall behind
+	hooks []func(RegistrationEvent)
+}
+
+func (s *subscribers) subscribe() (<-chan RegistrationEvent, func()) {
+	ch := make(chan RegistrationEvent, subscriberBufferSize)
+	s.Lock()
+	if s.chans == nil {
+		s.chans = make(map[chan RegistrationEvent]struct{})
+	}
+	s.chans[ch] = struct{}{}
+	s.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.Lock()
+			delete(s.chans, ch)
+			s.Unlock()
+		})
+	}
+}
+
+func (s *subscribers) hook(f func(RegistrationEvent)) {
+	s.Lock()
+	s.hooks = append(s.hooks, f)
+	s.Unlock()
+}
+
+func (s *subscribers) publish(action string, k Registration, id string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.chans) == 0 && len(s.hooks) == 0 {
+		return
+	}
+	e := RegistrationEvent{
+		Action:   action,
+		Category: k.Category,
+		Key:      k.Key,
+		SubKey:   k.SubKey,
+		PeerID:   id,
+	}
+	for _, f := range s.hooks {
+		f(e)
+	}
+	for ch := range s.chans {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -1,18 +1,104 @@
 package nsqlookupd
 
 import (
+	"context"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/protocol"
 )
 
+// the protocols a client can select with the 4 byte magic it sends first
+var lookupProtocols = map[string]func(ctx *Context) protocol.ContextProtocol{
+	"  V1": func(ctx *Context) protocol.ContextProtocol { return &LookupProtocolV1{ctx: ctx} },
+	"  V2": newLookupProtocolV2,
+}
+
 type tcpServer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	activeConns    int64
+	activeHandlers int64
+
 	ctx *Context
+
+	// connections currently being handled, so that they can be drained on exit
+	sync.Mutex
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+	closing bool
+
+	// connections per remote IP, for --max-connections-per-ip
+	ipConns map[string]int
+
+	// with --proxy-protocol, only connections from here send a PROXY header
+	trustedProxies *net.IPNet
+}
+
+// how long a trusted proxy has to send the PROXY header
+var proxyHeaderTimeout = 5 * time.Second
+
+func newTCPServer(ctx *Context) *tcpServer {
+	p := &tcpServer{
+		ctx:     ctx,
+		conns:   make(map[net.Conn]struct{}),
+		ipConns: make(map[string]int),
+	}
+	if opts := ctx.nsqlookupd.getOpts(); opts.ProxyProtocol {
+		// validated in New()
+		_, p.trustedProxies, _ = net.ParseCIDR(opts.ProxyProtocolTrustedCIDR)
+	}
+	return p
 }
 
 // 该方法用来处理tcp请求，当有新请求来临，Accept,然后放到这里处理
 func (p *tcpServer) Handle(clientConn net.Conn) {
+	p.HandleContext(context.Background(), clientConn)
+}
+
+// ctx 被cancel 时(nsqlookupd 退出), IOLoop 处理完当前命令后返回
+func (p *tcpServer) HandleContext(ctx context.Context, clientConn net.Conn) {
+	// deferred so that they are decremented even if the handler panics
+	atomic.AddInt64(&p.activeHandlers, 1)
+	defer atomic.AddInt64(&p.activeHandlers, -1)
+
+	if !p.track(clientConn) {
+		clientConn.Close()
+		return
+	}
+	defer p.untrack(clientConn)
+
+	// 开启TCP keepalive, 以便尽快发现崩溃主机遗留的半开连接
+	p.setKeepAlive(clientConn)
+
+	if p.trustedProxies != nil && p.trustedProxies.Contains(net.ParseIP(remoteIP(clientConn))) {
+		// behind a load balancer the real client address is carried in the
+		// PROXY header, it becomes the RemoteAddr() (and thus PeerInfo.id).
+		// Other connections can't set their address, they are handled as is.
+		clientConn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		conn, err := protocol.ReadProxyHeader(clientConn)
+		if err != nil {
+			p.ctx.nsqlookupd.logf(LOG_ERROR, "client(%s) failed to read PROXY header - %s",
+				clientConn.RemoteAddr(), err)
+			clientConn.Close()
+			return
+		}
+		clientConn.SetReadDeadline(time.Time{})
+		clientConn = conn
+	}
+
+	// 限制同一个IP 的连接数, 超过时直接关闭连接
+	ip := remoteIP(clientConn)
+	if !p.acquireIP(ip) {
+		p.ctx.nsqlookupd.logf(LOG_WARN, "client(%s) exceeds --max-connections-per-ip=%d, closing",
+			clientConn.RemoteAddr(), p.ctx.nsqlookupd.getOpts().MaxConnectionsPerIP)
+		clientConn.Close()
+		return
+	}
+	defer p.releaseIP(ip)
+
 	p.ctx.nsqlookupd.logf(LOG_INFO, "TCP: new client(%s)", clientConn.RemoteAddr())
 
 	// The client should initialize itself by sending a 4 byte sequence indicating
@@ -30,24 +116,126 @@ func (p *tcpServer) Handle(clientConn net.Conn) {
 	p.ctx.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): desired protocol magic '%s'",
 		clientConn.RemoteAddr(), protocolMagic)
 
-	var prot protocol.Protocol
-	switch protocolMagic {
-	case "  V1":
-		// 创建一个”V1“处理对象
-		prot = &LookupProtocolV1{ctx: p.ctx}
-		// 目前只支持"  V1"  ，注意这里是四字节，有两个空格
-	default:
+	// 根据magic 创建对应版本的处理对象, 支持"  V1" 和"  V2", 注意这里是四字节，有两个空格
+	newProtocol, ok := lookupProtocols[protocolMagic]
+	if !ok {
 		protocol.SendResponse(clientConn, []byte("E_BAD_PROTOCOL"))
 		clientConn.Close()
 		p.ctx.nsqlookupd.logf(LOG_ERROR, "client(%s) bad protocol magic '%s'",
 			clientConn.RemoteAddr(), protocolMagic)
 		return
 	}
+	prot := newProtocol(p.ctx)
 
 	// 这里是主要处理函数
-	err = prot.IOLoop(clientConn)
+	err = prot.IOLoopContext(ctx, clientConn)
 	if err != nil {
-		p.ctx.nsqlookupd.logf(LOG_ERROR, "client(%s) - %s", clientConn.RemoteAddr(), err)
+		p.ctx.nsqlookupd.logClientErrf(LOG_ERROR, clientConn, "closed - %s", err)
 		return
 	}
 }
+
+func (p *tcpServer) track(conn net.Conn) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.closing {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	p.wg.Add(1)
+	atomic.AddInt64(&p.activeConns, 1)
+	return true
+}
+
+func (p *tcpServer) untrack(conn net.Conn) {
+	atomic.AddInt64(&p.activeConns, -1)
+	p.Lock()
+	delete(p.conns, conn)
+	p.Unlock()
+	p.wg.Done()
+}
+
+// remoteIP is the address of conn without the port
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// acquireIP counts a connection from ip, returning false (and not counting
+// it) when ip already has --max-connections-per-ip connections
+func (p *tcpServer) acquireIP(ip string) bool {
+	max := p.ctx.nsqlookupd.getOpts().MaxConnectionsPerIP
+	p.Lock()
+	defer p.Unlock()
+	if max > 0 && p.ipConns[ip] >= max {
+		return false
+	}
+	p.ipConns[ip]++
+	return true
+}
+
+func (p *tcpServer) releaseIP(ip string) {
+	p.Lock()
+	defer p.Unlock()
+	p.ipConns[ip]--
+	if p.ipConns[ip] <= 0 {
+		delete(p.ipConns, ip)
+	}
+}
+
+// drain asks every connection to finish by expiring its read deadline, so
+// that IOLoop returns once the command in progress is done. Connections
+// still open after timeout are closed and drain returns without waiting
+// for their handlers.
+func (p *tcpServer) drain(timeout time.Duration) {
+	p.Lock()
+	p.closing = true
+	for conn := range p.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	p.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for conn := range p.conns {
+		p.ctx.nsqlookupd.logf(LOG_WARN, "client(%s) still connected after %s, closing",
+			conn.RemoteAddr(), timeout)
+		conn.Close()
+	}
+}
+
+// setKeepAlive enables TCP keepalive on *net.TCPConn connections, returning
+// whether keepalive was configured
+func (p *tcpServer) setKeepAlive(conn net.Conn) bool {
+	period := p.ctx.nsqlookupd.getOpts().TCPKeepAlivePeriod
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || period <= 0 {
+		return false
+	}
+	err := tcpConn.SetKeepAlive(true)
+	if err == nil {
+		err = tcpConn.SetKeepAlivePeriod(period)
+	}
+	if err != nil {
+		p.ctx.nsqlookupd.logf(LOG_WARN, "client(%s) failed to enable TCP keepalive - %s",
+			conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
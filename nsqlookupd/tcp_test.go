@@ -0,0 +1,293 @@
+package nsqlookupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestTCPKeepAlive(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	nsqlookupd, err := New(opts)
+	test.Nil(t, err)
+	p := &tcpServer{ctx: &Context{nsqlookupd: nsqlookupd}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	test.Nil(t, err)
+	defer conn.Close()
+
+	serverConn, err := listener.Accept()
+	test.Nil(t, err)
+	defer serverConn.Close()
+
+	test.Equal(t, true, p.setKeepAlive(serverConn))
+
+	// only *net.TCPConn supports keepalive
+	test.Equal(t, false, p.setKeepAlive(test.NewFakeNetConn()))
+
+	opts.TCPKeepAlivePeriod = 0
+	test.Equal(t, false, p.setKeepAlive(serverConn))
+}
+
+func TestExitShutdownTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ShutdownTimeout = 200 * time.Millisecond
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+
+	// a well behaved client is drained
+	conn := mustConnectLookupd(t, tcpAddr)
+	defer conn.Close()
+	identify(t, conn)
+
+	// a client whose reads ignore the deadline used to signal the drain
+	closed := make(chan struct{})
+	fakeConn := test.NewFakeNetConn()
+	sentMagic := false
+	fakeConn.ReadFunc = func(b []byte) (int, error) {
+		if !sentMagic {
+			sentMagic = true
+			return copy(b, "  V1"), nil
+		}
+		<-closed
+		return 0, io.EOF
+	}
+	var closeOnce sync.Once
+	fakeConn.CloseFunc = func() error {
+		closeOnce.Do(func() { close(closed) })
+		return nil
+	}
+	go nsqlookupd.tcpServer.Handle(&fakeConn)
+
+	for i := 0; i < 100; i++ {
+		nsqlookupd.tcpServer.Lock()
+		n := len(nsqlookupd.tcpServer.conns)
+		nsqlookupd.tcpServer.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	nsqlookupd.Exit()
+	elapsed := time.Since(start)
+
+	test.Equal(t, true, elapsed >= opts.ShutdownTimeout)
+	test.Equal(t, true, elapsed < opts.ShutdownTimeout+time.Second)
+	select {
+	case <-closed:
+	default:
+		t.Fatal("connection was not closed")
+	}
+
+	// let the straggler finish before the test (and its logger) goes away
+	for i := 0; i < 100; i++ {
+		nsqlookupd.tcpServer.Lock()
+		n := len(nsqlookupd.tcpServer.conns)
+		nsqlookupd.tcpServer.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("handler did not return after its connection was closed")
+}
+
+func waitForIdle(t *testing.T, nsqlookupd *NSQLookupd) {
+	for i := 0; i < 200; i++ {
+		stats := nsqlookupd.Stats()
+		if stats.TCPConnections == 0 && stats.TCPHandlers == 0 && stats.Clients == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := nsqlookupd.Stats()
+	t.Fatalf("leaked connections %d, handlers %d, clients %d",
+		stats.TCPConnections, stats.TCPHandlers, stats.Clients)
+}
+
+func TestNoConnectionLeaks(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	var conns []net.Conn
+	for i := 0; i < 50; i++ {
+		conn := mustConnectLookupd(t, tcpAddr)
+		// some identify, some hang up right after the protocol magic
+		if i%2 == 0 {
+			identify(t, conn)
+		}
+		conns = append(conns, conn)
+	}
+
+	for i := 0; i < 100; i++ {
+		if nsqlookupd.Stats().TCPConnections == 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := nsqlookupd.Stats()
+	test.Equal(t, int64(50), stats.TCPConnections)
+	test.Equal(t, int64(50), stats.TCPHandlers)
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitForIdle(t, nsqlookupd)
+
+	// counters are also decremented when a handler panics
+	fakeConn := test.NewFakeNetConn()
+	fakeConn.ReadFunc = func(b []byte) (int, error) {
+		panic("read failed")
+	}
+	func() {
+		defer func() {
+			test.NotNil(t, recover())
+		}()
+		nsqlookupd.tcpServer.Handle(&fakeConn)
+	}()
+	waitForIdle(t, nsqlookupd)
+
+	// and the registrations of a client that panics are removed
+	var in bytes.Buffer
+	cmd, _ := nsq.Identify(map[string]interface{}{
+		"tcp_port":          TCPPort,
+		"http_port":         HTTPPort,
+		"broadcast_address": HostAddr,
+		"version":           NSQDVersion,
+	})
+	cmd.WriteTo(&in)
+	nsq.Register("panic_topic", "ch").WriteTo(&in)
+	chunks := [][]byte{nsq.MagicV1, in.Bytes()}
+	registered := 0
+	fakeConn = test.NewFakeNetConn()
+	fakeConn.ReadFunc = func(b []byte) (int, error) {
+		if len(chunks) == 0 {
+			registered = len(nsqlookupd.DB.FindProducers("topic", "panic_topic", ""))
+			panic("read failed")
+		}
+		n := copy(b, chunks[0])
+		chunks = chunks[1:]
+		return n, nil
+	}
+	fakeConn.WriteFunc = func(b []byte) (int, error) { return len(b), nil }
+	func() {
+		defer func() {
+			test.NotNil(t, recover())
+		}()
+		nsqlookupd.tcpServer.Handle(&fakeConn)
+	}()
+	waitForIdle(t, nsqlookupd)
+	test.Equal(t, 1, registered)
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("client", "", "")))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("topic", "panic_topic", "")))
+	test.Equal(t, 0, len(nsqlookupd.DB.FindProducers("channel", "panic_topic", "ch")))
+}
+
+func TestProtocolMagic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	identifyVersion := func(magic string) int {
+		conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+		test.Nil(t, err)
+		defer conn.Close()
+		conn.Write([]byte(magic))
+
+		cmd, _ := nsq.Identify(map[string]interface{}{
+			"tcp_port":          TCPPort,
+			"http_port":         HTTPPort,
+			"broadcast_address": HostAddr,
+			"hostname":          HostAddr,
+			"version":           NSQDVersion,
+		})
+		cmd.WriteTo(conn)
+		data, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		var resp struct {
+			ProtocolVersion int `json:"protocol_version"`
+		}
+		err = json.Unmarshal(data, &resp)
+		test.Nil(t, err)
+
+		nsq.Register("protocol_magic", "").WriteTo(conn)
+		data, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		test.Equal(t, []byte("OK"), data)
+		return resp.ProtocolVersion
+	}
+
+	// V1 clients are unchanged
+	test.Equal(t, 0, identifyVersion("  V1"))
+	test.Equal(t, 2, identifyVersion("  V2"))
+
+	conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("  V9"))
+	data, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	test.Equal(t, []byte("E_BAD_PROTOCOL"), data)
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ProxyProtocol = true
+	opts.MaxConnectionsPerIP = 2
+	tcpAddr, _, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	// the PROXY header sets the client's IP
+	connectFrom := func(ip string, port int) net.Conn {
+		conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+		test.Nil(t, err)
+		fmt.Fprintf(conn, "PROXY TCP4 %s 10.0.0.100 %d 4160\r\n", ip, port)
+		conn.Write(nsq.MagicV1)
+		return conn
+	}
+
+	conns := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		conn := connectFrom("10.0.0.1", 5000+i)
+		defer conn.Close()
+		identify(t, conn)
+		conns = append(conns, conn)
+	}
+
+	// the third from the same IP is closed
+	conn := connectFrom("10.0.0.1", 5002)
+	defer conn.Close()
+	_, err := nsq.ReadResponse(conn)
+	test.NotNil(t, err)
+
+	// another IP still connects
+	other := connectFrom("10.0.0.2", 5000)
+	defer other.Close()
+	identify(t, other)
+
+	// the limit is per open connection
+	conns[0].Close()
+	time.Sleep(10 * time.Millisecond)
+	conn = connectFrom("10.0.0.1", 5003)
+	defer conn.Close()
+	identify(t, conn)
+}
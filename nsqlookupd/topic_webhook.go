@@ -0,0 +1,126 @@
+package nsqlookupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+const (
+	TopicEventFirstProducer = "first_producer"
+	TopicEventNoProducers   = "no_producers"
+)
+
+// the most topics waiting to be checked by the webhook, changes to other
+// topics are dropped rather than blocking the DB
+const topicWebhookBufferSize = 1024
+
+const topicWebhookTimeout = 5 * time.Second
+
+// TopicWebhookEvent is the JSON body POSTed to --topic-webhook-url,
+// Timestamp is in unix seconds
+type TopicWebhookEvent struct {
+	Event     string `json:"event"`
+	Topic     string `json:"topic"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// topicWebhook POSTs a TopicWebhookEvent when a topic gets its first
+// producer and, when onEmpty is set, when it loses its last one.
+//
+// A change to a topic only queues it, its producers are then compared with
+// what was last seen, so a topic that gains and loses its only producer
+// before it is checked sends nothing.
+type topicWebhook struct {
+	url     string
+	onEmpty bool
+	db      RegistrationStore
+	client  *http.Client
+	logf    lg.AppLogFunc
+
+	topics chan string
+
+	sync.Mutex
+	queued map[string]bool
+
+	// topics that had producers when last checked, only used by loop
+	seen map[string]bool
+}
+
+func newTopicWebhook(url string, onEmpty bool, db RegistrationStore, logf lg.AppLogFunc) *topicWebhook {
+	return &topicWebhook{
+		url:     url,
+		onEmpty: onEmpty,
+		db:      db,
+		client:  &http.Client{Timeout: topicWebhookTimeout},
+		logf:    logf,
+		topics:  make(chan string, topicWebhookBufferSize),
+		queued:  make(map[string]bool),
+		seen:    make(map[string]bool),
+	}
+}
+
+// onChange is called for every change to the DB, with its lock held
+func (h *topicWebhook) onChange(e RegistrationEvent) {
+	if e.Category != "topic" {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.queued[e.Key] {
+		return
+	}
+	select {
+	case h.topics <- e.Key:
+		h.queued[e.Key] = true
+	default:
+		h.logf(lg.WARN, "topic webhook: queue full, dropped change to topic(%s)", e.Key)
+	}
+}
+
+func (h *topicWebhook) loop(exitChan chan struct{}) {
+	for {
+		select {
+		case topic := <-h.topics:
+			h.Lock()
+			delete(h.queued, topic)
+			h.Unlock()
+			h.check(topic)
+		case <-exitChan:
+			return
+		}
+	}
+}
+
+func (h *topicWebhook) check(topic string) {
+	hasProducers := len(h.db.FindProducers("topic", topic, "")) > 0
+	if hasProducers == h.seen[topic] {
+		return
+	}
+	if hasProducers {
+		h.seen[topic] = true
+		h.post(TopicEventFirstProducer, topic)
+		return
+	}
+	delete(h.seen, topic)
+	if h.onEmpty {
+		h.post(TopicEventNoProducers, topic)
+	}
+}
+
+func (h *topicWebhook) post(event string, topic string) {
+	body, _ := json.Marshal(TopicWebhookEvent{event, topic, time.Now().Unix()})
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		h.logf(lg.ERROR, "topic webhook: %s for topic(%s) failed - %s", event, topic, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		h.logf(lg.ERROR, "topic webhook: %s for topic(%s) failed - status %d", event, topic, resp.StatusCode)
+	}
+}